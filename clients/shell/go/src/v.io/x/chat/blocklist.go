@@ -0,0 +1,197 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"v.io/v23/security"
+)
+
+// blocklist holds the principals whose messages we do not want to see.
+// Messages from blocked principals are dropped as soon as they are received.
+// Messages from muted principals are received and kept in the history as
+// usual, but are not displayed.
+//
+// The blocklist is kept in a per-user config file, and applies to all
+// channels.
+type blocklist struct {
+	// file is the config file the blocklist is saved to, or empty if it is
+	// not saved.
+	file string
+	// Mutex to protect config.
+	mu     sync.Mutex
+	config blocklistConfig
+}
+
+// blocklistConfig is the blocklist, as saved in the config file.
+type blocklistConfig struct {
+	Blocked []security.BlessingPattern
+	Muted   []security.BlessingPattern
+}
+
+// loadBlocklist reads the blocklist from a config file.  A missing file is an
+// empty blocklist.
+func loadBlocklist(file string) (*blocklist, error) {
+	bl := &blocklist{file: file}
+	if file == "" {
+		return bl, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &bl.config); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// save writes the blocklist to its config file.  The file is replaced
+// atomically, so that it is never left half written.  bl.mu must be held.
+func (bl *blocklist) save() error {
+	if bl.file == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(bl.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bl.file), 0700); err != nil {
+		return err
+	}
+	tmp := bl.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.file)
+}
+
+// block adds patterns to the blocked principals, and saves the blocklist.
+func (bl *blocklist) block(patterns ...security.BlessingPattern) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.config.Blocked = addPatterns(bl.config.Blocked, patterns)
+	return bl.save()
+}
+
+// unblock removes patterns from the blocked principals, and saves the
+// blocklist.  It returns false if none of the patterns was blocked.
+func (bl *blocklist) unblock(patterns ...security.BlessingPattern) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	var removed bool
+	bl.config.Blocked, removed = removePatterns(bl.config.Blocked, patterns)
+	if !removed {
+		return false, nil
+	}
+	return true, bl.save()
+}
+
+// mute adds patterns to the muted principals, and saves the blocklist.
+func (bl *blocklist) mute(patterns ...security.BlessingPattern) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.config.Muted = addPatterns(bl.config.Muted, patterns)
+	return bl.save()
+}
+
+// unmute removes patterns from the muted principals, and saves the blocklist.
+// It returns false if none of the patterns was muted.
+func (bl *blocklist) unmute(patterns ...security.BlessingPattern) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	var removed bool
+	bl.config.Muted, removed = removePatterns(bl.config.Muted, patterns)
+	if !removed {
+		return false, nil
+	}
+	return true, bl.save()
+}
+
+// isBlocked returns true if a principal with the given blessing names is
+// blocked.
+func (bl *blocklist) isBlocked(blessingNames []string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return matchAny(bl.config.Blocked, blessingNames)
+}
+
+// isMuted returns true if a principal with the given blessing names is muted.
+func (bl *blocklist) isMuted(blessingNames []string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return matchAny(bl.config.Muted, blessingNames)
+}
+
+// blocked and muted return copies of the blocked and muted patterns.
+func (bl *blocklist) blocked() []security.BlessingPattern {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return append([]security.BlessingPattern(nil), bl.config.Blocked...)
+}
+
+func (bl *blocklist) muted() []security.BlessingPattern {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return append([]security.BlessingPattern(nil), bl.config.Muted...)
+}
+
+func matchAny(patterns []security.BlessingPattern, blessingNames []string) bool {
+	if len(blessingNames) == 0 {
+		return false
+	}
+	for _, p := range patterns {
+		if p.MatchedBy(blessingNames...) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPatterns adds the patterns that are not already in list.
+func addPatterns(list, patterns []security.BlessingPattern) []security.BlessingPattern {
+	for _, p := range patterns {
+		found := false
+		for _, q := range list {
+			if p == q {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// removePatterns removes the patterns from list.  It returns false if none of
+// them was in it.
+func removePatterns(list, patterns []security.BlessingPattern) ([]security.BlessingPattern, bool) {
+	var out []security.BlessingPattern
+	removed := false
+	for _, q := range list {
+		keep := true
+		for _, p := range patterns {
+			if p == q {
+				keep = false
+				removed = true
+				break
+			}
+		}
+		if keep {
+			out = append(out, q)
+		}
+	}
+	return out, removed
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"v.io/v23/security"
+	"v.io/x/chat/chatlib"
+)
+
+// registerBlocklistCommands registers the commands that edit the blocklist.
+func (a *app) registerBlocklistCommands() error {
+	commands := []*command{
+		{
+			name:     "block",
+			args:     "[<name>|<pattern>]",
+			help:     "Drop all messages from a member or blessing pattern.  Lists the blocked patterns if none is given.",
+			minArgs:  0,
+			maxArgs:  1,
+			run:      a.blockCommand,
+			complete: a.completeMember,
+		},
+		{
+			name:     "unblock",
+			args:     "<name>|<pattern>",
+			help:     "Stop blocking a member or blessing pattern.",
+			minArgs:  1,
+			maxArgs:  1,
+			run:      a.unblockCommand,
+			complete: a.completeBlocked,
+		},
+		{
+			name:     "mute",
+			args:     "[<name>|<pattern>]",
+			help:     "Hide messages from a member or blessing pattern, but keep them in the history.  Lists the muted patterns if none is given.",
+			minArgs:  0,
+			maxArgs:  1,
+			run:      a.muteCommand,
+			complete: a.completeMember,
+		},
+		{
+			name:     "unmute",
+			args:     "<name>|<pattern>",
+			help:     "Stop muting a member or blessing pattern.",
+			minArgs:  1,
+			maxArgs:  1,
+			run:      a.unmuteCommand,
+			complete: a.completeMuted,
+		},
+	}
+	for _, c := range commands {
+		if err := a.commands.register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blocklistPatterns returns the blessing patterns that a /block or /mute
+// argument stands for.  A member name of the current channel stands for the
+// blessings of the member.  Anything else must be a blessing pattern.
+func (a *app) blocklistPatterns(arg string) ([]security.BlessingPattern, error) {
+	if blessings := a.currentTab().cr.MemberBlessings(arg); len(blessings) > 0 {
+		patterns := make([]security.BlessingPattern, len(blessings))
+		for i, b := range blessings {
+			patterns[i] = security.BlessingPattern(b)
+		}
+		return patterns, nil
+	}
+	patterns, err := chatlib.ParsePatterns(arg)
+	if err != nil || len(patterns) == 0 {
+		return nil, commandError(fmt.Sprintf("'%s' is neither a member of the channel nor a blessing pattern.", arg))
+	}
+	return patterns, nil
+}
+
+// printPatterns writes a list of blocked or muted patterns to the current tab.
+func (a *app) printPatterns(what string, patterns []security.BlessingPattern) {
+	if len(patterns) == 0 {
+		a.print(fmt.Sprintf("Nobody is %s.", what))
+		return
+	}
+	a.print(fmt.Sprintf("You have %s %s.", what, joinPatterns(patterns)))
+}
+
+func joinPatterns(patterns []security.BlessingPattern) string {
+	return strings.Join(patternStrings(patterns), ", ")
+}
+
+func (a *app) blockCommand(args []string) error {
+	if len(args) == 0 {
+		a.printPatterns("blocked", a.blocklist.blocked())
+		return nil
+	}
+	patterns, err := a.blocklistPatterns(args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.blocklist.block(patterns...); err != nil {
+		return commandError(fmt.Sprintf("Could not save the blocklist: %v", err))
+	}
+	a.print(fmt.Sprintf("Blocked %s.", joinPatterns(patterns)))
+	return nil
+}
+
+func (a *app) unblockCommand(args []string) error {
+	patterns, err := a.blocklistPatterns(args[0])
+	if err != nil {
+		return err
+	}
+	removed, err := a.blocklist.unblock(patterns...)
+	if err != nil {
+		return commandError(fmt.Sprintf("Could not save the blocklist: %v", err))
+	}
+	if !removed {
+		return commandError(fmt.Sprintf("'%s' is not blocked.", args[0]))
+	}
+	a.print(fmt.Sprintf("Unblocked %s.", joinPatterns(patterns)))
+	return nil
+}
+
+func (a *app) muteCommand(args []string) error {
+	if len(args) == 0 {
+		a.printPatterns("muted", a.blocklist.muted())
+		return nil
+	}
+	patterns, err := a.blocklistPatterns(args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.blocklist.mute(patterns...); err != nil {
+		return commandError(fmt.Sprintf("Could not save the blocklist: %v", err))
+	}
+	a.print(fmt.Sprintf("Muted %s.", joinPatterns(patterns)))
+	return nil
+}
+
+func (a *app) unmuteCommand(args []string) error {
+	patterns, err := a.blocklistPatterns(args[0])
+	if err != nil {
+		return err
+	}
+	removed, err := a.blocklist.unmute(patterns...)
+	if err != nil {
+		return commandError(fmt.Sprintf("Could not save the blocklist: %v", err))
+	}
+	if !removed {
+		return commandError(fmt.Sprintf("'%s' is not muted.", args[0]))
+	}
+	a.print(fmt.Sprintf("Unmuted %s.", joinPatterns(patterns)))
+	return nil
+}
+
+// completeBlocked completes the blocked patterns.
+func (a *app) completeBlocked(arg int) []string {
+	return patternStrings(a.blocklist.blocked())
+}
+
+// completeMuted completes the muted patterns.
+func (a *app) completeMuted(arg int) []string {
+	return patternStrings(a.blocklist.muted())
+}
+
+func patternStrings(patterns []security.BlessingPattern) []string {
+	s := make([]string, len(patterns))
+	for i, p := range patterns {
+		s[i] = string(p)
+	}
+	return s
+}
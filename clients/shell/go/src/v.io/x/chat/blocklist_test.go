@@ -0,0 +1,78 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"v.io/v23/security"
+)
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chat", "config.json")
+
+	bl, err := loadBlocklist(file)
+	if err != nil {
+		t.Fatalf("loadBlocklist of a missing file failed: %v", err)
+	}
+	alice := []string{"dev.v.io:u:alice@example.com:chat"}
+	bob := []string{"dev.v.io:u:bob@example.com"}
+	if bl.isBlocked(alice) || bl.isMuted(alice) {
+		t.Errorf("An empty blocklist blocks or mutes alice")
+	}
+
+	if err := bl.block("dev.v.io:u:alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.mute(security.BlessingPattern(bob[0])); err != nil {
+		t.Fatal(err)
+	}
+	// Blocking is saved, and matches extensions of the blocked pattern.
+	if bl, err = loadBlocklist(file); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.isBlocked(alice) || bl.isMuted(alice) {
+		t.Errorf("alice should be blocked and not muted")
+	}
+	if bl.isBlocked(bob) || !bl.isMuted(bob) {
+		t.Errorf("bob should be muted and not blocked")
+	}
+	if bl.isBlocked(nil) {
+		t.Errorf("A principal without blessings is blocked")
+	}
+
+	if removed, err := bl.unblock("dev.v.io:u:carol@example.com"); removed || err != nil {
+		t.Errorf("unblock of a pattern that is not blocked = %v, %v, want false, nil", removed, err)
+	}
+	if removed, err := bl.unblock("dev.v.io:u:alice@example.com"); !removed || err != nil {
+		t.Errorf("unblock = %v, %v, want true, nil", removed, err)
+	}
+	if bl, err = loadBlocklist(file); err != nil {
+		t.Fatal(err)
+	}
+	if bl.isBlocked(alice) || !bl.isMuted(bob) {
+		t.Errorf("alice should no longer be blocked, and bob should still be muted")
+	}
+}
+
+func TestAddRemovePatterns(t *testing.T) {
+	list := addPatterns(nil, []security.BlessingPattern{"a", "b"})
+	list = addPatterns(list, []security.BlessingPattern{"b", "c"})
+	if got := joinPatterns(list); got != "a, b, c" {
+		t.Errorf("Got %q, want \"a, b, c\"", got)
+	}
+	list, removed := removePatterns(list, []security.BlessingPattern{"b", "d"})
+	if got := joinPatterns(list); got != "a, c" || !removed {
+		t.Errorf("Got %q, %v, want \"a, c\", true", got, removed)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bot runs chat bots, i.e. members of a channel that answer the
+// messages sent to it.
+//
+// A bot is created with New, which takes the same options as chatlib.New, and
+// is given handlers with Handle before it is started with Run.  Each text
+// message received in the channel is passed to the first handler that matches
+// it, either by a prefix such as "!echo", or by a regular expression.
+// Handlers reply to the whole channel, or privately to the sender.
+//
+// The bot joins the channel as the principal of the context it is created
+// with, so it should be given its own credentials.
+package bot
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"v.io/v23/context"
+	"v.io/v23/verror"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+	"v.io/x/lib/vlog"
+)
+
+const (
+	// membersPollInterval is how often the bot lists the members of the
+	// channel, so that its replies reach the members who joined since.
+	membersPollInterval = 5 * time.Second
+	// membersPollJitter is the random delay added to membersPollInterval.
+	membersPollJitter = time.Second
+	// maxRunningHandlers is the number of handlers that run at once.  No
+	// more messages are read from the channel while this many are running,
+	// so a flood of requests is limited by the inbound limits of the
+	// channel instead of starting a goroutine for each of them.
+	maxRunningHandlers = 10
+)
+
+// Handler handles the messages it matches.  Exactly one of Prefix and Regexp
+// must be set.
+type Handler struct {
+	// Name is the name of the handler, e.g. "echo".
+	Name string
+	// Help is a one-line description of the handler.
+	Help string
+	// Prefix matches the messages that start with it, followed by a space
+	// or the end of the message, e.g. "!echo".  The words after the prefix
+	// are passed to Run as the request arguments.
+	Prefix string
+	// Regexp matches the messages that it matches anywhere in their text.
+	// Its submatches are passed to Run as the request arguments.
+	Regexp *regexp.Regexp
+	// Run handles a message that the handler matched.
+	Run func(r *Request) error
+}
+
+// match returns the arguments for the handler if it matches text.
+func (h *Handler) match(text string) ([]string, bool) {
+	if h.Regexp != nil {
+		m := h.Regexp.FindStringSubmatch(text)
+		if m == nil {
+			return nil, false
+		}
+		return m[1:], true
+	}
+	if !strings.HasPrefix(text, h.Prefix) {
+		return nil, false
+	}
+	rest := text[len(h.Prefix):]
+	if rest != "" && !unicode.IsSpace([]rune(rest)[0]) {
+		// "!echoes" does not match "!echo".
+		return nil, false
+	}
+	return strings.Fields(rest), true
+}
+
+// usage returns how the handler is invoked, e.g. "!echo" or "/^ping$/".
+func (h *Handler) usage() string {
+	if h.Regexp != nil {
+		return "/" + h.Regexp.String() + "/"
+	}
+	return h.Prefix
+}
+
+// Request is a message that a handler matched.
+type Request struct {
+	// Bot is the bot that received the message.
+	Bot *Bot
+	// Message is the message.
+	Message chatlib.Message
+	// Args are the words after the prefix of the handler, or the
+	// submatches of its regexp.
+	Args []string
+}
+
+// Reply sends text as a reply to the message.  The reply is private if the
+// message was, and sent to the whole channel otherwise.
+func (r *Request) Reply(text string) error {
+	if r.Message.Private {
+		return r.ReplyPrivately(text)
+	}
+	return r.Bot.cr.Broadcast(vdl.MessageKindText, text)
+}
+
+// ReplyPrivately sends text as a reply to the sender of the message only.  The
+// sender is named by their blessings, since other principals can have the same
+// short name.
+func (r *Request) ReplyPrivately(text string) error {
+	if len(r.Message.SenderBlessings) == 0 {
+		return verror.New(verror.ErrNoExist, nil, "sender of message "+r.Message.ID)
+	}
+	_, err := r.Bot.cr.Send(r.Message.SenderBlessings[0], vdl.MessageKindText, text)
+	return err
+}
+
+// Bot is a member of a channel that runs handlers on the messages it receives.
+type Bot struct {
+	cr *chatlib.Channel
+	// Mutex to protect handlers.
+	mu sync.Mutex
+	// Handlers, in the order they are tried.
+	handlers []*Handler
+	// running holds a token for each handler that is running.
+	running chan struct{}
+}
+
+// New creates a bot for the channel at path.  The channel is joined by Run.
+func New(ctx *context.T, path string, opts ...chatlib.Option) (*Bot, error) {
+	cr, err := chatlib.New(ctx, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Bot{cr: cr, running: make(chan struct{}, maxRunningHandlers)}, nil
+}
+
+// Channel returns the channel of the bot.
+func (b *Bot) Channel() *chatlib.Channel {
+	return b.cr
+}
+
+// Handle adds a handler.  Handlers are tried in the order they are added, and
+// only the first handler that matches a message runs.
+func (b *Bot) Handle(h *Handler) error {
+	if h.Name == "" || h.Run == nil {
+		return verror.New(verror.ErrBadArg, nil, "handler needs a name and a Run function")
+	}
+	if (h.Prefix == "") == (h.Regexp == nil) {
+		return verror.New(verror.ErrBadArg, nil, "handler "+h.Name+" needs either a prefix or a regexp")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, other := range b.handlers {
+		if other.Name == h.Name {
+			return verror.New(verror.ErrExist, nil, "handler "+h.Name)
+		}
+	}
+	b.handlers = append(b.handlers, h)
+	return nil
+}
+
+// Handlers returns the handlers of the bot, in the order they are tried.
+func (b *Bot) Handlers() []*Handler {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Handler(nil), b.handlers...)
+}
+
+// match returns the first handler that matches text, and its arguments.
+func (b *Bot) match(text string) (*Handler, []string) {
+	for _, h := range b.Handlers() {
+		if args, ok := h.match(text); ok {
+			return h, args
+		}
+	}
+	return nil, nil
+}
+
+// Run joins the channel, and runs handlers on the messages received until the
+// bot is closed.
+func (b *Bot) Run() error {
+	if err := b.cr.Join(); err != nil {
+		return err
+	}
+	// Keep the members up to date, so that replies reach all of them.
+	go func() {
+		for range b.cr.WatchMembers(membersPollInterval, membersPollJitter) {
+		}
+	}()
+	for {
+		select {
+		case m := <-b.cr.Messages():
+			b.dispatch(m)
+		case notice := <-b.cr.Notices():
+			vlog.Errorf("%s: %s", b.cr.Path(), notice)
+		case <-b.cr.Receipts():
+			// Delivery receipts are not used.
+		case <-b.cr.Done():
+			return nil
+		}
+	}
+}
+
+// dispatch runs the handler that matches a message, if any.  Our own messages,
+// messages received with the history of the channel, and actions are ignored.
+func (b *Bot) dispatch(m chatlib.Message) {
+	if b.cr.IsOwn(m) || m.Historical || m.Kind != vdl.MessageKindText {
+		return
+	}
+	h, args := b.match(strings.TrimSpace(m.Text))
+	if h == nil {
+		return
+	}
+	// Handlers may be slow, e.g. if they call other services, so they run
+	// concurrently.
+	b.start(b.cr.Done(), func() {
+		if err := h.Run(&Request{Bot: b, Message: m, Args: args}); err != nil {
+			vlog.Errorf("Handler %s failed on message %s: %v", h.Name, m.ID, err)
+		}
+	})
+}
+
+// start runs f in a goroutine once fewer than maxRunningHandlers are running.
+// It returns false without running f if done is closed first.
+func (b *Bot) start(done <-chan struct{}, f func()) bool {
+	select {
+	case b.running <- struct{}{}:
+	case <-done:
+		return false
+	}
+	go func() {
+		defer func() { <-b.running }()
+		f()
+	}()
+	return true
+}
+
+// Close leaves the channel, and makes Run return.
+func (b *Bot) Close() error {
+	err := b.cr.Leave()
+	b.cr.Close()
+	return err
+}
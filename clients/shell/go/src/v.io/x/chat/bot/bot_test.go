@@ -0,0 +1,90 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bot
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	echo := &Handler{Name: "echo", Prefix: "!echo"}
+	deploy := &Handler{Name: "deploy", Regexp: regexp.MustCompile(`^deploy (\w+) to (\w+)$`)}
+	tests := []struct {
+		h    *Handler
+		text string
+		args []string
+		ok   bool
+	}{
+		{echo, "!echo", []string{}, true},
+		{echo, "!echo hello  world", []string{"hello", "world"}, true},
+		{echo, "!echo\thello", []string{"hello"}, true},
+		{echo, "!echoes hello", nil, false},
+		{echo, "say !echo hello", nil, false},
+		{deploy, "deploy chat to staging", []string{"chat", "staging"}, true},
+		{deploy, "deploy chat", nil, false},
+	}
+	for _, test := range tests {
+		args, ok := test.h.match(test.text)
+		if ok != test.ok || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s.match(%q): got %q, %v, want %q, %v", test.h.Name, test.text, args, ok, test.args, test.ok)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	b := &Bot{}
+	run := func(*Request) error { return nil }
+	bad := []*Handler{
+		{Prefix: "!x", Run: run},
+		{Name: "x", Prefix: "!x"},
+		{Name: "x", Run: run},
+		{Name: "x", Prefix: "!x", Regexp: regexp.MustCompile("x"), Run: run},
+	}
+	for _, h := range bad {
+		if err := b.Handle(h); err == nil {
+			t.Errorf("Handle(%+v) succeeded, want an error", h)
+		}
+	}
+	if err := b.Handle(Echo()); err != nil {
+		t.Fatalf("Handle(Echo()) failed: %v", err)
+	}
+	if err := b.Handle(Echo()); err == nil {
+		t.Errorf("Handle(Echo()) succeeded twice, want an error")
+	}
+	if err := b.Handle(Ping()); err != nil {
+		t.Fatalf("Handle(Ping()) failed: %v", err)
+	}
+	if h, _ := b.match("PING?"); h == nil || h.Name != "ping" {
+		t.Errorf("Got handler %v for PING?, want ping", h)
+	}
+	if h, _ := b.match("hello"); h != nil {
+		t.Errorf("Got handler %v for hello, want none", h.Name)
+	}
+}
+
+func TestStart(t *testing.T) {
+	b := &Bot{running: make(chan struct{}, maxRunningHandlers)}
+	release := make(chan struct{})
+	for i := 0; i < maxRunningHandlers; i++ {
+		if !b.start(nil, func() { <-release }) {
+			t.Fatalf("start of handler %d failed", i)
+		}
+	}
+	// No more handlers start until one of them returns.
+	done := make(chan struct{})
+	close(done)
+	if b.start(done, func() {}) {
+		t.Errorf("Started more than %d handlers", maxRunningHandlers)
+	}
+	release <- struct{}{}
+	ran := make(chan struct{})
+	if !b.start(nil, func() { close(ran) }) {
+		t.Errorf("start failed after a handler returned")
+	}
+	<-ran
+	close(release)
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bottest runs bots, and the members that talk to them, in a channel
+// on a local mounttable, for testing handlers.  Tests that use it must call
+// v23test.TestMain from their TestMain.
+package bottest
+
+import (
+	"testing"
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/security"
+	"v.io/x/chat/bot"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/internal/chattest"
+	"v.io/x/ref/test/v23test"
+)
+
+// Harness runs bots and the members that talk to them in a channel on a local
+// mounttable.  Each of them runs as its own principal, blessed by the shell.
+type Harness struct {
+	t  *testing.T
+	sh *v23test.Shell
+	// Mounttable is the name of the local mounttable.
+	Mounttable string
+	// Path is the path of the channel.
+	Path string
+}
+
+// New starts a local mounttable, and creates the channel on it.  Cleanup must
+// be called when the test is done.
+func New(t *testing.T) *Harness {
+	sh := v23test.NewShell(t, nil)
+	h := &Harness{
+		t:          t,
+		sh:         sh,
+		Mounttable: chattest.StartRootMT(sh),
+		Path:       "path/to/channel",
+	}
+	h.createChannel()
+	return h
+}
+
+// createChannel creates the channel, so that the principals forked from the
+// shell are allowed in it.
+func (h *Harness) createChannel() {
+	cr, err := chatlib.New(h.sh.Ctx, h.Path, chatlib.WithMounttable(h.Mounttable))
+	if err != nil {
+		h.t.Fatalf("New(%v) failed: %v", h.Path, err)
+	}
+	defer cr.Close()
+	if err := cr.Create(security.DefaultBlessingPatterns(v23.GetPrincipal(h.sh.Ctx))); err != nil {
+		h.t.Fatalf("Create() failed: %v", err)
+	}
+}
+
+// Cleanup stops the mounttable, and everything else the harness started.
+func (h *Harness) Cleanup() {
+	h.sh.Cleanup()
+}
+
+// StartBot starts a bot with the given handlers, as its own principal.  The
+// bot must be closed when the test is done.
+func (h *Harness) StartBot(handlers ...*bot.Handler) *bot.Bot {
+	b, err := bot.New(h.sh.ForkContext("bot"), h.Path, chatlib.WithMounttable(h.Mounttable))
+	if err != nil {
+		h.t.Fatalf("New(%v) failed: %v", h.Path, err)
+	}
+	for _, handler := range handlers {
+		if err := b.Handle(handler); err != nil {
+			h.t.Fatalf("Handle(%v) failed: %v", handler.Name, err)
+		}
+	}
+	go func() {
+		if err := b.Run(); err != nil {
+			h.t.Errorf("Run() failed: %v", err)
+		}
+	}()
+	return b
+}
+
+// Join joins the channel as a member with the given name.  The member must
+// leave when the test is done.
+func (h *Harness) Join(name string) *chatlib.Channel {
+	cr, err := chatlib.New(h.sh.ForkContext(name), h.Path, chatlib.WithMounttable(h.Mounttable))
+	if err != nil {
+		h.t.Fatalf("New(%v) failed: %v", h.Path, err)
+	}
+	if err := cr.Join(); err != nil {
+		h.t.Fatalf("Join() failed: %v", err)
+	}
+	return cr
+}
+
+// WaitForMember waits until cr sees a member with the given name.
+func (h *Harness) WaitForMember(cr *chatlib.Channel, name string) {
+	deadline := time.Now().Add(time.Minute)
+	for !cr.HasMember(name) {
+		if _, err := cr.Members(); err != nil {
+			h.t.Fatalf("Members() failed: %v", err)
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for %v to join", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ExpectReply waits for a message that cr did not send itself, and checks its
+// text, and whether it was sent privately.
+func (h *Harness) ExpectReply(cr *chatlib.Channel, text string, private bool) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-cr.Messages():
+			if cr.IsOwn(m) {
+				continue
+			}
+			if m.Text != text || m.Private != private {
+				h.t.Errorf("Got reply %q (private: %v), want %q (private: %v)", m.Text, m.Private, text, private)
+			}
+			return
+		case <-timeout:
+			h.t.Errorf("Timed out waiting for reply %q", text)
+			return
+		}
+	}
+}
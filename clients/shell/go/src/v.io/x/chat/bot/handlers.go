@@ -0,0 +1,58 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bot
+
+// Example handlers, run by the chatbot command.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Echo returns a handler that repeats the text after "!echo".
+func Echo() *Handler {
+	return &Handler{
+		Name:   "echo",
+		Help:   "Repeats the text after it.",
+		Prefix: "!echo",
+		Run: func(r *Request) error {
+			if len(r.Args) == 0 {
+				return nil
+			}
+			return r.Reply(strings.Join(r.Args, " "))
+		},
+	}
+}
+
+// Ping returns a handler that answers "ping" with "pong", so that members can
+// check that the bot is running.
+func Ping() *Handler {
+	return &Handler{
+		Name:   "ping",
+		Help:   "Answers pong.",
+		Regexp: regexp.MustCompile(`(?i)^ping[.!?]*$`),
+		Run: func(r *Request) error {
+			return r.Reply("pong")
+		},
+	}
+}
+
+// Help returns a handler that lists the handlers of the bot when it receives
+// "!help".  The list is sent privately, so as not to clutter the channel.
+func Help() *Handler {
+	return &Handler{
+		Name:   "help",
+		Help:   "Lists what the bot answers to.",
+		Prefix: "!help",
+		Run: func(r *Request) error {
+			lines := []string{"I answer to:"}
+			for _, h := range r.Bot.Handlers() {
+				lines = append(lines, fmt.Sprintf("  %-16s %s", h.usage(), h.Help))
+			}
+			return r.ReplyPrivately(strings.Join(lines, "\n"))
+		},
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bot_test
+
+import (
+	"testing"
+
+	"v.io/x/chat/bot"
+	"v.io/x/chat/bot/bottest"
+	"v.io/x/chat/vdl"
+	_ "v.io/x/ref/runtime/factories/roaming"
+	"v.io/x/ref/test/v23test"
+)
+
+func TestBot(t *testing.T) {
+	h := bottest.New(t)
+	defer h.Cleanup()
+
+	b := h.StartBot(bot.Echo(), bot.Ping(), bot.Help())
+	defer b.Close()
+	alice := h.Join("alice")
+	defer alice.Leave()
+
+	botName := b.Channel().UserName()
+	h.WaitForMember(alice, botName)
+	h.WaitForMember(b.Channel(), alice.UserName())
+
+	if err := alice.Broadcast(vdl.MessageKindText, "!echo hello world"); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	h.ExpectReply(alice, "hello world", false)
+
+	if err := alice.Broadcast(vdl.MessageKindText, "ping"); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	h.ExpectReply(alice, "pong", false)
+
+	// Private messages are answered privately.
+	if _, err := alice.Send(botName, vdl.MessageKindText, "!echo psst"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	h.ExpectReply(alice, "psst", true)
+}
+
+func TestMain(m *testing.M) {
+	v23test.TestMain(m)
+}
@@ -0,0 +1,465 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The bridge joins a channel and exposes it to clients that do not speak
+// Vanadium, with an HTTP API:
+//
+//  GET  /members          {"members": ["alice", "bob"]}
+//  GET  /history?limit=N  {"messages": [{"event": "message", ...}, ...]}
+//  POST /messages         {"user": "carol", "text": "hello", "kind": "text", "parent": ""}
+//  GET  /events           a WebSocket stream of events
+//
+// Messages and events have the same fields as in headless mode.  GET /history
+// returns messages as they are after the edits and deletions the bridge
+// received, without reactions, which are only sent as events.  Messages
+// posted to the bridge are sent by the principal of the bridge, on behalf of
+// the user named in the request, and members who trust the bridge see them as
+// coming from that user via the bridge.  The bridge does not authenticate its
+// users, so it only listens on localhost by default, and users can only post
+// new messages, not edit or delete them.
+//
+// Every request must carry the token of the bridge, either in an
+// "Authorization: Bearer <token>" header or, since browsers cannot set headers
+// on WebSockets, in a "token" query parameter.  Requests from web pages are
+// refused unless their origin is allowed with -allow-origin, so that pages the
+// user visits cannot read the channel or post to it.  POST /messages must be
+// sent as application/json, which cross-site forms cannot do.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"v.io/v23"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+	"v.io/x/ref/lib/signals"
+)
+
+const (
+	// bridgeHistorySize is the number of recent messages that the bridge
+	// keeps for GET /history.
+	bridgeHistorySize = 500
+	// bridgeEventQueueSize is the number of events that can be waiting to
+	// be sent to a WebSocket client.  Clients that fall further behind are
+	// disconnected.
+	bridgeEventQueueSize = 100
+	// maxPostSize is the maximum size of the body of POST /messages.
+	maxPostSize = 1 << 16
+)
+
+// bridgePost is the body of POST /messages.
+type bridgePost struct {
+	User   string `json:"user"`
+	Text   string `json:"text"`
+	Kind   string `json:"kind,omitempty"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// bridge serves a channel over HTTP.
+type bridge struct {
+	cr        *chatlib.Channel
+	path      string
+	blocklist *blocklist
+	// token must be given in every request.
+	token string
+	// origins holds the origins of the web pages allowed to use the
+	// bridge.
+	origins map[string]bool
+	// Mutex to protect history and clients.
+	mu sync.Mutex
+	// Recent messages, in display order.
+	history []chatlib.Message
+	// Event queues of the WebSocket clients.
+	clients map[chan headlessEvent]bool
+}
+
+func newBridge(cr *chatlib.Channel, bl *blocklist, token string, origins []string) *bridge {
+	b := &bridge{
+		cr:        cr,
+		path:      cr.Path(),
+		blocklist: bl,
+		token:     token,
+		origins:   make(map[string]bool),
+		clients:   make(map[chan headlessEvent]bool),
+	}
+	for _, o := range origins {
+		b.origins[o] = true
+	}
+	return b
+}
+
+// handler returns the HTTP handler of the bridge.
+func (b *bridge) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", b.handleMembers)
+	mux.HandleFunc("/history", b.handleHistory)
+	mux.HandleFunc("/messages", b.handleMessages)
+	mux.Handle("/events", websocket.Server{
+		Handler:   b.handleEvents,
+		Handshake: b.checkHandshake,
+	})
+	return b.authorize(mux)
+}
+
+// authorize refuses the requests that do not carry the token of the bridge, or
+// that come from web pages on origins that are not allowed.
+func (b *bridge) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.allowedOrigin(r.Header.Get("Origin")) {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if b.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(b.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "bad token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin returns true if requests from the given origin are allowed.
+// Requests without an origin do not come from web pages, e.g. scripts.
+func (b *bridge) allowedOrigin(origin string) bool {
+	return origin == "" || b.origins[origin]
+}
+
+// checkHandshake refuses WebSocket clients on origins that are not allowed.
+// Unlike websocket.Handler, it accepts clients that send no origin.
+func (b *bridge) checkHandshake(config *websocket.Config, r *http.Request) error {
+	if !b.allowedOrigin(r.Header.Get("Origin")) {
+		return errors.New("origin not allowed")
+	}
+	return nil
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response, with the error in a JSON body.
+func writeError(w http.ResponseWriter, status int, err string) {
+	writeJSON(w, status, map[string]string{"error": err})
+}
+
+func (b *bridge) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	members, err := b.cr.Members()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	names := []string{}
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, map[string][]string{"members": uniqStrings(names)})
+}
+
+func (b *bridge) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	limit := bridgeHistorySize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "bad limit "+s)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, map[string][]headlessEvent{"messages": b.recentMessages(limit)})
+}
+
+func (b *bridge) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "use application/json")
+		return
+	}
+	var post bridgePost
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPostSize)).Decode(&post); err != nil {
+		writeError(w, http.StatusBadRequest, "bad message: "+err.Error())
+		return
+	}
+	post.User = strings.TrimSpace(post.User)
+	if post.User == "" || strings.ContainsAny(post.User, "\r\n") {
+		writeError(w, http.StatusBadRequest, "message needs a user")
+		return
+	}
+	if post.Text == "" {
+		writeError(w, http.StatusBadRequest, "message needs a text")
+		return
+	}
+	kind, ok := parseTextKind(post.Kind)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad kind "+post.Kind)
+		return
+	}
+	var opts []chatlib.MessageOption
+	if post.Parent != "" {
+		opts = append(opts, chatlib.WithParent(post.Parent))
+	}
+	if _, err := b.cr.Relay(post.User, kind, post.Text, opts...); err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEvents sends the events of the channel to a WebSocket client, until
+// the client goes away or falls behind.
+func (b *bridge) handleEvents(ws *websocket.Conn) {
+	defer ws.Close()
+	events := b.subscribe()
+	defer b.unsubscribe(events)
+
+	// Nothing is read from the client, but reading tells us when it goes
+	// away.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(gone)
+	}()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// subscribe returns a queue of the events of the channel.
+func (b *bridge) subscribe() chan headlessEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := make(chan headlessEvent, bridgeEventQueueSize)
+	b.clients[events] = true
+	return events
+}
+
+// unsubscribe stops sending events to a queue, and closes it.
+func (b *bridge) unsubscribe(events chan headlessEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[events] {
+		delete(b.clients, events)
+		close(events)
+	}
+}
+
+// publish sends an event to all WebSocket clients.  The queues of clients that
+// are too far behind are closed, which disconnects them.
+func (b *bridge) publish(e headlessEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.clients {
+		select {
+		case events <- e:
+		default:
+			delete(b.clients, events)
+			close(events)
+		}
+	}
+}
+
+// addHistory adds a message to the recent messages, in display order, and
+// drops the oldest message if there are too many.  Edits and deletions are
+// applied to the message they target instead, and reactions are not kept:
+// clients get them as events as they happen.
+func (b *bridge) addHistory(m chatlib.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m.IsOp() {
+		b.applyHistoryEdit(m)
+		return
+	}
+	i := sort.Search(len(b.history), func(i int) bool { return m.Before(b.history[i]) })
+	b.history = append(b.history, chatlib.Message{})
+	copy(b.history[i+1:], b.history[i:])
+	b.history[i] = m
+	if len(b.history) > bridgeHistorySize {
+		b.history = b.history[1:]
+	}
+}
+
+// applyHistoryEdit applies an edit or deletion to the recent message it
+// targets, if it is one of them.  b.mu must be held.
+func (b *bridge) applyHistoryEdit(op chatlib.Message) {
+	for i, m := range b.history {
+		if !op.Modifies(m) {
+			continue
+		}
+		if op.Kind == vdl.MessageKindDelete {
+			b.history = append(b.history[:i], b.history[i+1:]...)
+		} else {
+			b.history[i].Text = op.Text
+		}
+		return
+	}
+}
+
+// recentMessages returns the events for up to limit of the most recent
+// messages.
+func (b *bridge) recentMessages(limit int) []headlessEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	history := b.history
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	events := []headlessEvent{}
+	for _, m := range history {
+		events = append(events, messageEvent(b.path, m))
+	}
+	return events
+}
+
+// relayEvents publishes the messages received in the channel, and the members
+// who join or leave it, until the channel is closed.  Messages from muted
+// principals are not published, nor private messages to the bridge.
+func (b *bridge) relayEvents() {
+	go func() {
+		for update := range b.cr.WatchMembers(*membersPollInterval, *membersPollJitter) {
+			for _, e := range update.Events {
+				event := "join"
+				if e.Kind == chatlib.MemberLeft {
+					event = "leave"
+				}
+				b.publish(headlessEvent{Event: event, Channel: b.path, Member: e.Member.Name})
+			}
+		}
+	}()
+	for {
+		select {
+		case m := <-b.cr.Messages():
+			if m.Private || b.blocklist.isMuted(m.SenderBlessings) {
+				continue
+			}
+			b.addHistory(m)
+			b.publish(messageEvent(b.path, m))
+		case notice := <-b.cr.Notices():
+			b.publish(headlessEvent{Event: "error", Channel: b.path, Error: notice})
+		case <-b.cr.Receipts():
+			// Delivery receipts are not reported.
+		case <-b.cr.Done():
+			return
+		}
+	}
+}
+
+// newBridgeToken returns a random token for the bridge.
+func newBridgeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// runBridge joins a channel, and serves it over HTTP until it is interrupted.
+func runBridge(args []string) error {
+	fs := flag.NewFlagSet("bridge", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	addr := fs.String("http", "localhost:8080", "Address to serve the HTTP API on.")
+	token := fs.String("token", "", "Token that requests must carry.  If empty, a random token is chosen and printed.")
+	allowOrigin := fs.String("allow-origin", "", "Comma-separated list of origins of the web pages allowed to use the bridge, e.g. http://localhost:3000.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *token == "" {
+		*token = newBridgeToken()
+	}
+	var origins []string
+	for _, o := range strings.Split(*allowOrigin, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	path := strings.TrimSpace(strings.Split(*channelNames, ",")[0])
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	limits, err := inboundLimitsFromFlags()
+	if err != nil {
+		return err
+	}
+	bl, err := loadBlocklist(*configFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	cr, err := openChannel(ctx, path, bl, limits)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	b := newBridge(cr, bl, *token, origins)
+	for _, m := range cr.ReplayHistory(bridgeHistorySize) {
+		if !bl.isMuted(m.SenderBlessings) {
+			b.addHistory(m)
+		}
+	}
+	if err := cr.Join(); err != nil {
+		return err
+	}
+	go b.relayEvents()
+	go cr.SyncHistory(*historySync)
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		cr.Leave()
+		return err
+	}
+	go http.Serve(ln, b.handler())
+	fmt.Printf("Serving '%s' on http://%s with token %s\n", path, ln.Addr(), *token)
+
+	<-signals.ShutdownOnSignals(ctx)
+	ln.Close()
+	return cr.Leave()
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+)
+
+const testBridgeToken = "secret"
+
+func newTestBridge() *bridge {
+	return &bridge{
+		path:    "path/to/channel",
+		token:   testBridgeToken,
+		origins: map[string]bool{"http://localhost:3000": true},
+		clients: make(map[chan headlessEvent]bool),
+	}
+}
+
+// newBridgeRequest returns a request to the bridge with its token, and a JSON
+// body if there is one.
+func newBridgeRequest(t *testing.T, method, path, body string) *http.Request {
+	r, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+testBridgeToken)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+func TestBridgeHistory(t *testing.T) {
+	b := newTestBridge()
+	// Messages are kept in display order, whatever order they arrive in.
+	for _, clock := range []uint64{3, 1, 2} {
+		b.addHistory(chatlib.Message{ID: string('a' + rune(clock)), Clock: clock})
+	}
+	for i := 0; i < bridgeHistorySize; i++ {
+		b.addHistory(chatlib.Message{ID: "old", Clock: 0})
+	}
+	if got, want := len(b.history), bridgeHistorySize; got != want {
+		t.Fatalf("Got %d messages, want %d", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	b.handler().ServeHTTP(w, newBridgeRequest(t, "GET", "/history?limit=3", ""))
+	var resp struct{ Messages []headlessEvent }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range resp.Messages {
+		ids = append(ids, e.MessageID)
+	}
+	if got, want := strings.Join(ids, ","), "b,c,d"; got != want {
+		t.Errorf("Got messages %q, want %q", got, want)
+	}
+}
+
+func TestBridgeHistoryOps(t *testing.T) {
+	b := newTestBridge()
+	alice := []string{"root:alice"}
+	msg := func(id string, kind vdl.MessageKind, text string) chatlib.Message {
+		return chatlib.Message{ID: id, Kind: kind, Text: text, SenderBlessings: alice, Clock: uint64(len(b.history) + 1)}
+	}
+	b.addHistory(msg("1", vdl.MessageKindText, "lunch?"))
+	b.addHistory(msg("2", vdl.MessageKindText, "typo"))
+	edit := msg("3", vdl.MessageKindEdit, "lunch at noon?")
+	edit.Target = "1"
+	b.addHistory(edit)
+	del := msg("4", vdl.MessageKindDelete, "")
+	del.Target = "2"
+	b.addHistory(del)
+	react := msg("5", vdl.MessageKindReact, "thumbsup")
+	react.Target = "1"
+	b.addHistory(react)
+	// Edits by someone else are not applied.
+	forged := msg("6", vdl.MessageKindEdit, "forged")
+	forged.Target, forged.SenderBlessings = "1", []string{"root:mallory"}
+	b.addHistory(forged)
+
+	events := b.recentMessages(bridgeHistorySize)
+	if len(events) != 1 || events[0].MessageID != "1" || events[0].Text != "lunch at noon?" {
+		t.Errorf("Got history %+v, want only the edited message 1", events)
+	}
+}
+
+func TestBridgeBadRequests(t *testing.T) {
+	b := newTestBridge()
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/history", "", http.StatusMethodNotAllowed},
+		{"GET", "/history?limit=x", "", http.StatusBadRequest},
+		{"GET", "/messages", "", http.StatusMethodNotAllowed},
+		{"POST", "/messages", "not json", http.StatusBadRequest},
+		{"POST", "/messages", `{"text": "hello"}`, http.StatusBadRequest},
+		{"POST", "/messages", `{"user": "carol"}`, http.StatusBadRequest},
+		{"POST", "/messages", `{"user": "carol\nbob", "text": "hello"}`, http.StatusBadRequest},
+		{"POST", "/messages", `{"user": "carol", "text": "hello", "kind": "shout"}`, http.StatusBadRequest},
+		{"POST", "/messages", `{"user": "carol", "text": "hello", "kind": "edit"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		b.handler().ServeHTTP(w, newBridgeRequest(t, test.method, test.path, test.body))
+		if w.Code != test.status {
+			t.Errorf("%s %s %s: got status %d, want %d", test.method, test.path, test.body, w.Code, test.status)
+		}
+	}
+}
+
+func TestBridgeAuthorization(t *testing.T) {
+	b := newTestBridge()
+	body := `{"user": "carol", "text": "hello"}`
+	tests := []struct {
+		desc   string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"no token", func(r *http.Request) { r.Header.Del("Authorization") }, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"foreign origin", func(r *http.Request) { r.Header.Set("Origin", "http://evil.example.com") }, http.StatusForbidden},
+		{"form post", func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, http.StatusUnsupportedMediaType},
+		{"no content type", func(r *http.Request) { r.Header.Del("Content-Type") }, http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := newBridgeRequest(t, "POST", "/messages", body)
+		test.setup(r)
+		b.handler().ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.desc, w.Code, test.status)
+		}
+	}
+
+	// The token may also be given in the query, and allowed origins are
+	// accepted.
+	w := httptest.NewRecorder()
+	r := newBridgeRequest(t, "GET", "/history?token="+testBridgeToken, "")
+	r.Header.Del("Authorization")
+	r.Header.Set("Origin", "http://localhost:3000")
+	b.handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestBridgeSlowClient(t *testing.T) {
+	b := newTestBridge()
+	slow := b.subscribe()
+	for i := 0; i <= bridgeEventQueueSize; i++ {
+		b.publish(headlessEvent{Event: "join"})
+	}
+	// The client is disconnected rather than holding up the bridge.
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != bridgeEventQueueSize {
+		t.Errorf("Got %d events, want %d", n, bridgeEventQueueSize)
+	}
+	// Unsubscribing after being disconnected is harmless.
+	b.unsubscribe(slow)
+}
@@ -0,0 +1,383 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nlacasse/gocui"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+)
+
+// registerBuiltinCommands registers the commands that are always available.
+func (a *app) registerBuiltinCommands() error {
+	builtins := []*command{
+		{
+			name:     "join",
+			args:     "<channel>",
+			help:     "Join a channel, or switch to it if already joined.",
+			minArgs:  1,
+			maxArgs:  1,
+			run:      a.joinCommand,
+			complete: a.completeChannel,
+		},
+		{
+			name:     "leave",
+			args:     "[<channel>]",
+			help:     "Leave a channel.  Defaults to the current channel or private conversation.",
+			minArgs:  0,
+			maxArgs:  1,
+			run:      a.leaveCommand,
+			complete: a.completeChannel,
+		},
+		{
+			name: "who",
+			help: "List the members of the current channel.",
+			run:  a.whoCommand,
+		},
+		{
+			name:     "msg",
+			args:     "<name> [<text>]",
+			help:     "Start a private conversation with a member of the current channel.",
+			minArgs:  1,
+			maxArgs:  2,
+			rest:     true,
+			run:      a.msgCommand,
+			complete: a.completeMember,
+		},
+		{
+			name:    "me",
+			args:    "<text>",
+			help:    "Describe what you are doing, e.g. \"/me waves\".",
+			minArgs: 1,
+			maxArgs: 1,
+			rest:    true,
+			run:     a.meCommand,
+		},
+		{
+			name:    "reply",
+			args:    "<text>",
+			help:    "Reply to the selected message, or to the last message in the current tab.",
+			minArgs: 1,
+			maxArgs: 1,
+			rest:    true,
+			run:     a.replyCommand,
+		},
+		{
+			name:     "react",
+			args:     "<emoji>",
+			help:     "React to the selected message, or to the last message in the current tab, e.g. \"/react :thumbsup:\".  Reacting again with the same emoji takes the reaction back.",
+			minArgs:  1,
+			maxArgs:  1,
+			run:      a.reactCommand,
+			complete: a.completeEmoji,
+		},
+		{
+			name: "thread",
+			help: "Show the thread of the selected message, or of the last message in the current tab, in a tab of its own.",
+			run:  a.threadCommand,
+		},
+		{
+			name: "delete",
+			help: "Delete the last message you sent in the current channel or private conversation.",
+			run:  a.deleteCommand,
+		},
+		{
+			name: "clear",
+			help: "Clear the history of the current channel.",
+			run:  a.clearCommand,
+		},
+		{
+			name:     "help",
+			args:     "[<command>]",
+			help:     "List the commands, or describe one.",
+			minArgs:  0,
+			maxArgs:  1,
+			run:      a.helpCommand,
+			complete: a.completeCommand,
+		},
+		{
+			name: "quit",
+			help: "Leave all channels and exit.",
+			run: func([]string) error {
+				return gocui.Quit
+			},
+		},
+	}
+	for _, c := range builtins {
+		if err := a.commands.register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// print writes a line to the history view of the current channel.
+func (a *app) print(text string) {
+	if t := a.currentTab(); t != nil {
+		t.hw.writeWordWrap([]byte(text + "\n"))
+	}
+}
+
+// findTab returns the index of the tab for the channel at the given path, or
+// -1 if we have not joined the channel.
+func (a *app) findTab(path string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, t := range a.tabs {
+		if t.cr.Path() == path && t.isChannel() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *app) joinCommand(args []string) error {
+	path := args[0]
+	if i := a.findTab(path); i >= 0 {
+		a.switchTab(i)
+		return nil
+	}
+	if _, err := a.openTab(path); err != nil {
+		return commandError(fmt.Sprintf("Could not join '%s': %v", path, err))
+	}
+	a.switchTab(a.findTab(path))
+	return nil
+}
+
+func (a *app) leaveCommand(args []string) error {
+	t := a.currentTab()
+	if len(args) > 0 {
+		i := a.findTab(args[0])
+		if i < 0 {
+			return commandError(fmt.Sprintf("You have not joined '%s'.", args[0]))
+		}
+		a.mu.Lock()
+		t = a.tabs[i]
+		a.mu.Unlock()
+	}
+	a.mu.Lock()
+	channels := 0
+	for _, tab := range a.tabs {
+		if tab.isChannel() {
+			channels++
+		}
+	}
+	a.mu.Unlock()
+	if t.isChannel() && channels == 1 {
+		return commandError("You cannot leave the only channel you are in.  Type /quit to exit.")
+	}
+	if err := a.closeTab(t); err != nil {
+		return commandError(fmt.Sprintf("Could not leave '%s': %v", t.cr.Path(), err))
+	}
+	return nil
+}
+
+func (a *app) whoCommand(args []string) error {
+	t := a.channelTab(a.currentTab().cr)
+	names := t.memberNames()
+	a.print(fmt.Sprintf("%d members in '%s': %s", len(names), t.cr.Path(), strings.Join(names, ", ")))
+	return nil
+}
+
+func (a *app) msgCommand(args []string) error {
+	cr := a.currentTab().cr
+	peer, err := a.resolveMember(cr, args[0])
+	if err != nil {
+		return err
+	}
+	t := a.privateTab(cr, []string{peer})
+	a.switchTab(a.tabIndex(t))
+	if len(args) > 1 {
+		return a.sendPrivate(t, vdl.MessageKindText, args[1])
+	}
+	return nil
+}
+
+// resolveMember returns the blessing name of the member of a channel that a
+// name given to a command refers to.  Short names shared by several principals
+// must be given as blessing names instead.
+func (a *app) resolveMember(cr *chatlib.Channel, name string) (string, error) {
+	peer, err := cr.ResolveMember(name)
+	switch verror.ErrorID(err) {
+	case "":
+		return peer, nil
+	case verror.ErrNoExist.ID:
+		return "", commandError(fmt.Sprintf("There is no member named '%s' in '%s'.", name, cr.Path()))
+	}
+	return "", commandError(fmt.Sprintf("Could not choose a member: %v", err))
+}
+
+// sendPrivate sends a private message to the member of a private conversation
+// tab, and writes it to the tab.
+func (a *app) sendPrivate(t *chatTab, kind vdl.MessageKind, text string, opts ...chatlib.MessageOption) error {
+	m, err := t.cr.Send(t.peer, kind, text, opts...)
+	if verror.ErrorID(err) == verror.ErrNoExist.ID {
+		return commandError(fmt.Sprintf("'%s' is no longer in '%s'.", t.peerName, t.cr.Path()))
+	}
+	if err != nil {
+		return err
+	}
+	a.deliver(a.conversationTab(t), m)
+	return nil
+}
+
+func (a *app) meCommand(args []string) error {
+	t := a.currentTab()
+	return a.send(t, vdl.MessageKindAction, args[0], t.newMessageOptions()...)
+}
+
+// send sends a message to the channel of a tab, or to the member of a private
+// conversation tab.
+func (a *app) send(t *chatTab, kind vdl.MessageKind, text string, opts ...chatlib.MessageOption) error {
+	if t.peer != "" {
+		return a.sendPrivate(t, kind, text, opts...)
+	}
+	return t.cr.Broadcast(kind, text, opts...)
+}
+
+// replyTarget returns the message that a reply or thread command applies to:
+// the selected message, or the last message in the tab.
+func (a *app) replyTarget(t *chatTab) (chatlib.Message, bool) {
+	if m, ok := t.hw.selectedMessage(); ok {
+		return m, true
+	}
+	return t.hw.lastMessage(func(m chatlib.Message) bool { return !m.DecryptFailed })
+}
+
+func (a *app) replyCommand(args []string) error {
+	t := a.currentTab()
+	m, ok := a.replyTarget(t)
+	if !ok {
+		return commandError("There is no message to reply to here.")
+	}
+	t.hw.clearSelection()
+	return a.send(t, vdl.MessageKindText, args[0], chatlib.WithParent(m.ThreadID()))
+}
+
+func (a *app) reactCommand(args []string) error {
+	code, ok := parseEmoji(args[0])
+	if !ok {
+		return commandError(fmt.Sprintf("Unknown emoji %s.  Type \"/react :\" and press Tab to list them.", args[0]))
+	}
+	t := a.currentTab()
+	m, ok := a.replyTarget(t)
+	if !ok {
+		return commandError("There is no message to react to here.")
+	}
+	t.hw.clearSelection()
+	kind := vdl.MessageKindReact
+	if t.hw.reactions(m.ID).HasReacted(code, t.cr.Blessings()) {
+		kind = vdl.MessageKindUnreact
+	}
+	return a.send(t, kind, code, chatlib.WithTarget(m.ID))
+}
+
+func (a *app) threadCommand(args []string) error {
+	t := a.currentTab()
+	m, ok := a.replyTarget(t)
+	if !ok {
+		return commandError("There is no thread to show here.")
+	}
+	a.showThread(t, m)
+	return nil
+}
+
+// showThread displays the tab of the thread that a message shown in a tab
+// belongs to.
+func (a *app) showThread(t *chatTab, m chatlib.Message) {
+	t.hw.clearSelection()
+	conv := a.conversationTab(t)
+	root := m
+	if m.Parent != "" {
+		root = chatlib.Message{ID: m.Parent}
+		if r, ok := conv.hw.message(m.Parent); ok {
+			root = r
+		}
+	}
+	a.switchTab(a.tabIndex(a.threadTab(conv, root)))
+}
+
+func (a *app) deleteCommand(args []string) error {
+	t := a.currentTab()
+	m, ok := t.lastOwnMessage()
+	if !ok {
+		return commandError("You have no message to delete here.")
+	}
+	if t.editingID() == m.ID {
+		t.setEditing("")
+	}
+	return a.sendEdit(t, vdl.MessageKindDelete, m.ID, "")
+}
+
+// sendEdit sends an edit or deletion of a message we sent, to the channel or
+// to the member of a private conversation tab.
+func (a *app) sendEdit(t *chatTab, kind vdl.MessageKind, id, text string) error {
+	return a.send(t, kind, text, chatlib.WithTarget(id))
+}
+
+func (a *app) clearCommand(args []string) error {
+	a.currentTab().hw.clear()
+	return nil
+}
+
+func (a *app) helpCommand(args []string) error {
+	if len(args) > 0 {
+		c := a.commands.lookup(strings.TrimPrefix(args[0], "/"))
+		if c == nil {
+			return commandError(fmt.Sprintf("Unknown command %s.", args[0]))
+		}
+		a.print(c.usage() + "\n    " + c.help)
+		return nil
+	}
+	lines := []string{"Commands:"}
+	for _, c := range a.commands.list() {
+		lines = append(lines, fmt.Sprintf("  %-22s %s", c.usage(), c.help))
+	}
+	lines = append(lines, "Start a message with // to send a message that starts with /.")
+	a.print(strings.Join(lines, "\n"))
+	return nil
+}
+
+// completeChannel completes the paths of the channels we have joined.
+func (a *app) completeChannel(arg int) []string {
+	if arg != 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	paths := make([]string, len(a.tabs))
+	for i, t := range a.tabs {
+		paths[i] = t.cr.Path()
+	}
+	return paths
+}
+
+// completeMember completes the names of the members of the current channel.
+// Names are completed in the text of a message too.
+func (a *app) completeMember(arg int) []string {
+	return a.channelTab(a.currentTab().cr).memberNames()
+}
+
+// completeEmoji completes the short codes of emojis.
+func (a *app) completeEmoji(arg int) []string {
+	return emojiCompletions()
+}
+
+// completeCommand completes command names.
+func (a *app) completeCommand(arg int) []string {
+	if arg != 0 {
+		return nil
+	}
+	var names []string
+	for _, c := range a.commands.list() {
+		names = append(names, c.name)
+	}
+	return names
+}
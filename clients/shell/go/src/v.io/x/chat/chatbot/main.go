@@ -0,0 +1,73 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command chatbot runs a bot in a chat channel.  The bot answers "!echo",
+// "!help" and "ping".  It joins the channel as the principal given by its
+// credentials, so it should be given its own, e.g.:
+//
+//	V23_CREDENTIALS=/tmp/bot-credentials chatbot --channel=path/to/channel
+//
+// It runs until it is interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"v.io/v23"
+	"v.io/x/chat/bot"
+	"v.io/x/chat/chatlib"
+	"v.io/x/ref/lib/signals"
+
+	_ "v.io/x/ref/runtime/factories/roaming"
+)
+
+var (
+	mounttable  = flag.String("mounttable", "/ns.dev.v.io:8101", "Mounttable where channel is mounted.")
+	proxy       = flag.String("proxy", "proxy", "Proxy to listen on.")
+	channelName = flag.String("channel", "users/vanadium.bot@gmail.com/apps/chat/public", "Channel to join.")
+	encrypt     = flag.Bool("encrypt", false, "Encrypt the messages the bot sends end-to-end, with a key shared by the members of the channel.")
+)
+
+func run() error {
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	b, err := bot.New(ctx, *channelName,
+		chatlib.WithMounttable(*mounttable),
+		chatlib.WithProxy(*proxy),
+		chatlib.WithEncryption(*encrypt))
+	if err != nil {
+		return err
+	}
+	for _, h := range []*bot.Handler{bot.Echo(), bot.Ping(), bot.Help()} {
+		if err := b.Handle(h); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run()
+	}()
+	select {
+	case err := <-done:
+		// The channel could not be joined.
+		return err
+	case <-signals.ShutdownOnSignals(ctx):
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
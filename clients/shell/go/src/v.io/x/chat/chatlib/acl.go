@@ -0,0 +1,222 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/naming"
+	"v.io/v23/security"
+	"v.io/v23/security/access"
+	mt "v.io/v23/services/mounttable"
+	"v.io/v23/verror"
+	"v.io/x/lib/vlog"
+)
+
+// aclRefreshInterval is how often the channel ACL is read again from the
+// mounttable.
+const aclRefreshInterval = time.Minute
+
+// The ACL of a channel is the Read access list of the channel root in the
+// mounttable, i.e. the principals that may list the members of the channel.
+// Channels are created with the same principals allowed to Resolve names in
+// the channel, and to Create names in it to join.  Members only accept calls
+// from principals in the ACL, and only allow them to resolve their names.
+
+// openACL is an ACL that allows anybody.  It is the ACL of channels created
+// before channels had ACLs, whose roots have no permissions set.
+var openACL = access.AccessList{
+	In: []security.BlessingPattern{security.AllPrincipals},
+}
+
+// channelPermissions returns the permissions of the root of a channel that
+// the given principals are allowed to join, and that is administered by the
+// given admins.  The admins are always allowed to join.
+func channelPermissions(admins, allowed []security.BlessingPattern) access.Permissions {
+	adminACL := access.AccessList{In: admins}
+	memberACL := access.AccessList{In: append(append([]security.BlessingPattern(nil), admins...), allowed...)}
+	return access.Permissions{
+		string(mt.Admin):   adminACL,
+		string(mt.Mount):   adminACL,
+		string(mt.Read):    memberACL,
+		string(mt.Resolve): memberACL,
+		string(mt.Create):  memberACL,
+	}
+}
+
+// memberPermissions returns the permissions of the name a member is mounted
+// at.  Everybody allowed in the channel can resolve the name, but only the
+// member, whose blessings match the given patterns, can change it.
+func memberPermissions(mine []security.BlessingPattern, channelACL access.AccessList) access.Permissions {
+	myACL := access.AccessList{In: mine}
+	return access.Permissions{
+		string(mt.Resolve): channelACL,
+		string(mt.Read):    channelACL,
+		string(mt.Admin):   myACL,
+		string(mt.Create):  myACL,
+		string(mt.Mount):   myACL,
+	}
+}
+
+// aclFromPermissions returns the ACL of a channel, given the permissions of its
+// root.  A root with no permissions at all is an open channel, but a root with
+// permissions and no Read access list lets nobody in.
+func aclFromPermissions(perms access.Permissions) access.AccessList {
+	if len(perms) == 0 {
+		return openACL
+	}
+	return perms[string(mt.Read)]
+}
+
+// isOpenChannelError returns true if err, returned when reading the
+// permissions of a channel root, means that the root was never created, as is
+// the case for channels created before channels had ACLs.
+func isOpenChannelError(err error) bool {
+	id := verror.ErrorID(err)
+	return id == verror.ErrNoExist.ID || id == naming.ErrNoSuchName.ID
+}
+
+// ParsePatterns parses a comma-separated list of blessing patterns.
+func ParsePatterns(s string) ([]security.BlessingPattern, error) {
+	var patterns []security.BlessingPattern
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		pattern := security.BlessingPattern(p)
+		if !pattern.IsValid() {
+			return nil, verror.New(verror.ErrBadArg, nil, "blessing pattern "+p)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// getACL reads the ACL of the channel from the mounttable.  It also returns
+// the version of the permissions of the channel root, for use in setACL.
+func (cr *Channel) getACL() (access.AccessList, string, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.mounttableTimeout)
+	defer cancel()
+	perms, version, err := v23.GetNamespace(ctx).GetPermissions(ctx, cr.path)
+	if isOpenChannelError(err) {
+		return openACL, "", nil
+	}
+	if err != nil {
+		return access.AccessList{}, "", err
+	}
+	return aclFromPermissions(perms), version, nil
+}
+
+// ACL reads the ACL of the channel from the mounttable, i.e. the principals
+// allowed to join the channel.
+func (cr *Channel) ACL() (access.AccessList, error) {
+	acl, _, err := cr.getACL()
+	return acl, err
+}
+
+// loadACL reads the ACL of the channel from the mounttable, and starts using
+// it.  It returns true if the ACL changed.  If it cannot be read, e.g. because
+// the mounttable is unreachable, the last ACL that was read is kept.  Until an
+// ACL is read, nobody is allowed.
+func (cr *Channel) loadACL() (bool, error) {
+	acl, _, err := cr.getACL()
+	if err != nil {
+		return false, err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	changed := !reflect.DeepEqual(cr.acl, acl)
+	cr.acl = acl
+	return changed, nil
+}
+
+// setNamePermissions sets the permissions of the name we are mounted at, so
+// that everybody in the current ACL of the channel can resolve it.
+func (cr *Channel) setNamePermissions(ctx *context.T, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, cr.mounttableTimeout)
+	defer cancel()
+	mine := security.DefaultBlessingPatterns(v23.GetPrincipal(ctx))
+	return v23.GetNamespace(ctx).SetPermissions(ctx, name, memberPermissions(mine, cr.currentACL()), "")
+}
+
+// currentACL returns the ACL of the channel.
+func (cr *Channel) currentACL() access.AccessList {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.acl
+}
+
+// watchACL reads the ACL of the channel again every aclRefreshInterval, until
+// ctx is cancelled.  Whenever the ACL changes, the permissions of name, the
+// name we are mounted at, are updated to match.
+func (cr *Channel) watchACL(ctx *context.T, name string) {
+	// stale is true if the permissions of name do not match the ACL.
+	stale := false
+	for {
+		select {
+		case <-time.After(aclRefreshInterval):
+		case <-ctx.Done():
+			return
+		}
+		changed, err := cr.loadACL()
+		if err != nil {
+			vlog.Errorf("Error getting the ACL of %v, keeping the last one: %v", cr.path, err)
+			continue
+		}
+		if !changed && !stale {
+			continue
+		}
+		if err := cr.setNamePermissions(ctx, name); err != nil {
+			vlog.Errorf("Error updating the permissions of %v: %v", name, err)
+			stale = true
+			continue
+		}
+		stale = false
+	}
+}
+
+// channelAuthorizer authorizes calls to our chat server from principals in the
+// ACL of the channel.
+type channelAuthorizer struct {
+	cr *Channel
+}
+
+func (a channelAuthorizer) Authorize(ctx *context.T, call security.Call) error {
+	// We always accept calls from ourselves and our delegates.
+	if security.DefaultAuthorizer().Authorize(ctx, call) == nil {
+		return nil
+	}
+	if err := a.cr.currentACL().Authorize(ctx, call); err != nil {
+		return verror.New(verror.ErrNoAccess, ctx, "not allowed in "+a.cr.path)
+	}
+	return nil
+}
+
+// Create sets the permissions of the root of the channel, so that only
+// the principals matching the given patterns, and us, can join it.
+func (cr *Channel) Create(allowed []security.BlessingPattern) error {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.mounttableTimeout)
+	defer cancel()
+	admins := security.DefaultBlessingPatterns(v23.GetPrincipal(ctx))
+	return v23.GetNamespace(ctx).SetPermissions(ctx, cr.path, channelPermissions(admins, allowed), "")
+}
+
+// SetACL replaces the principals allowed to join the channel.  The admins of
+// the channel are unchanged.
+func (cr *Channel) SetACL(allowed []security.BlessingPattern) error {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.mounttableTimeout)
+	defer cancel()
+	ns := v23.GetNamespace(ctx)
+	perms, version, err := ns.GetPermissions(ctx, cr.path)
+	if err != nil {
+		return err
+	}
+	admins := perms[string(mt.Admin)].In
+	return ns.SetPermissions(ctx, cr.path, channelPermissions(admins, allowed), version)
+}
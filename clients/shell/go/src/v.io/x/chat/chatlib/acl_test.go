@@ -0,0 +1,92 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"reflect"
+	"testing"
+
+	"v.io/v23/naming"
+	"v.io/v23/security"
+	"v.io/v23/security/access"
+	mt "v.io/v23/services/mounttable"
+	"v.io/v23/verror"
+)
+
+func TestChannelPermissions(t *testing.T) {
+	admins := []security.BlessingPattern{"dev.v.io:u:alice"}
+	allowed := []security.BlessingPattern{"dev.v.io:u:bob", "dev.v.io:u:carol"}
+	perms := channelPermissions(admins, allowed)
+
+	if got := perms[string(mt.Admin)].In; !reflect.DeepEqual(got, admins) {
+		t.Errorf("Got Admin %v, want %v", got, admins)
+	}
+	// Admins can always join.
+	members := []security.BlessingPattern{"dev.v.io:u:alice", "dev.v.io:u:bob", "dev.v.io:u:carol"}
+	for _, tag := range []mt.Tag{mt.Read, mt.Resolve, mt.Create} {
+		if got := perms[string(tag)].In; !reflect.DeepEqual(got, members) {
+			t.Errorf("Got %s %v, want %v", tag, got, members)
+		}
+	}
+	if got := aclFromPermissions(perms).In; !reflect.DeepEqual(got, members) {
+		t.Errorf("Got ACL %v, want %v", got, members)
+	}
+	// Channels without permissions are open to everybody, but channels
+	// with permissions and no Read ACL are closed.
+	if got := aclFromPermissions(access.Permissions{}); !reflect.DeepEqual(got, openACL) {
+		t.Errorf("Got ACL %v for a channel without permissions, want %v", got, openACL)
+	}
+	delete(perms, string(mt.Read))
+	if got := aclFromPermissions(perms); len(got.In) > 0 {
+		t.Errorf("Got ACL %v for a channel without a Read ACL, want nobody", got)
+	}
+}
+
+func TestMemberPermissions(t *testing.T) {
+	mine := []security.BlessingPattern{"dev.v.io:u:alice"}
+	channelACL := access.AccessList{In: []security.BlessingPattern{"dev.v.io:u:alice", "dev.v.io:u:bob"}}
+	perms := memberPermissions(mine, channelACL)
+
+	// Members of the channel can find us, but only we can change our name.
+	for _, tag := range []mt.Tag{mt.Read, mt.Resolve} {
+		if got := perms[string(tag)]; !reflect.DeepEqual(got, channelACL) {
+			t.Errorf("Got %s %v, want %v", tag, got, channelACL)
+		}
+	}
+	for _, tag := range []mt.Tag{mt.Admin, mt.Create, mt.Mount} {
+		if got := perms[string(tag)].In; !reflect.DeepEqual(got, mine) {
+			t.Errorf("Got %s %v, want %v", tag, got, mine)
+		}
+	}
+}
+
+func TestIsOpenChannelError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{verror.New(verror.ErrNoExist, nil, "path"), true},
+		{verror.New(naming.ErrNoSuchName, nil, "path"), true},
+		// A channel we cannot read, or a mounttable we cannot reach,
+		// is not open.
+		{verror.New(verror.ErrNoAccess, nil, "path"), false},
+		{verror.New(verror.ErrTimeout, nil, "path"), false},
+	} {
+		if got := isOpenChannelError(test.err); got != test.want {
+			t.Errorf("isOpenChannelError(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	got, err := ParsePatterns(" dev.v.io:u:bob,,dev.v.io:u:carol ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []security.BlessingPattern{"dev.v.io:u:bob", "dev.v.io:u:carol"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
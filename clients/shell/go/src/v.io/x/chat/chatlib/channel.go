@@ -0,0 +1,1275 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chatlib implements Vanadium chat channels.  A Channel finds the
+// other members of a chat channel in a mounttable, and sends messages to them
+// and receives their messages with the Chat RPC interface.
+package chatlib
+
+// Usage:
+//  // Construct a new channel.
+//  c, err := chatlib.New(ctx, "path/to/channel/name", chatlib.WithMounttable(mounttable))
+//
+//  // Join the channel.
+//  err := c.Join()
+//
+//  // Get all members in the channel.
+//  members, err := c.Members()
+//
+//  // Send a message to all members in the channel.  Changes in the delivery
+//  // state of the message are reported on c.Receipts().
+//  err := c.Broadcast(vdl.MessageKindText, "message")
+//
+//  // Send a private message to the members with a given name.
+//  m, err := c.Send("alice@example.com", vdl.MessageKindText, "message")
+//
+//  // Receive messages.
+//  for m := range c.Messages() { ... }
+//
+//  // Leave the channel, and stop everything it runs in the background.
+//  err := c.Leave()
+//  c.Close()
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/naming"
+	"v.io/v23/options"
+	"v.io/v23/rpc"
+	"v.io/v23/security"
+	"v.io/v23/security/access"
+	"v.io/v23/verror"
+	"v.io/v23/vom"
+	"v.io/x/chat/vdl"
+	"v.io/x/lib/vlog"
+)
+
+// Message is a message that will be displayed in the UI.
+type Message struct {
+	// ID uniquely identifies the message.  It is chosen by the sender.
+	ID         string
+	SenderName string
+	Text       string
+	// Timestamp is the time the message was sent, according to the sender.
+	Timestamp time.Time
+	// Channel is the path of the channel the message was sent to.
+	Channel string
+	Kind    vdl.MessageKind
+	// Clock is the sender's Lamport clock when the message was sent.
+	Clock uint64
+	// ReplyTo is the name that receipts for the message are sent to.
+	ReplyTo string
+	// Private is true if the message was sent to us only.
+	Private bool
+	// KeyID, Nonce and Ciphertext hold the text of an encrypted message,
+	// as it was sent.  Text holds the decrypted text, or a placeholder if
+	// the message could not be decrypted, in which case DecryptFailed is
+	// set.
+	KeyID         string
+	Nonce         []byte
+	Ciphertext    []byte
+	DecryptFailed bool
+	// OnBehalfOf is the user that the sender relayed the message for, or
+	// empty if the sender wrote it.  Any member can set it, so it only
+	// names the user if RelayTrusted is set.
+	OnBehalfOf string
+	// RelayTrusted is true if the message was relayed by a bridge we
+	// trust, i.e. it is signed by us or by a principal matching the
+	// patterns given to WithTrustedBridges.
+	RelayTrusted bool
+	// Target is the ID of the message that an edit or deletion applies to.
+	Target string
+	// Parent is the ID of the message that the message replies to, or empty
+	// if it is not a reply.
+	Parent string
+	// Signer is the VOM-encoded blessings that the message was signed
+	// with, and Signature is the signature of the sender.  Unverified is
+	// set if the signature is missing or not valid, in which case the
+	// sender was only named by whoever passed the message to us.
+	Signer     []byte
+	Signature  security.Signature
+	Unverified bool
+	// SenderBlessings is the remote blessings of the sender.
+	SenderBlessings []string
+	// Historical is true if the message was loaded from our history or
+	// fetched from the history of another member, rather than sent to us by
+	// its sender.
+	Historical bool
+}
+
+// RelayedFor returns the user that a trusted bridge relayed the message for,
+// or empty if the message was not relayed or the bridge is not trusted.
+func (m Message) RelayedFor() string {
+	if !m.RelayTrusted {
+		return ""
+	}
+	return m.OnBehalfOf
+}
+
+// Before returns true if m should be displayed before o.  Messages are ordered
+// by their Lamport clock, with ties broken by ID, so that all members display
+// messages in the same order.
+func (m Message) Before(o Message) bool {
+	if m.Clock != o.Clock {
+		return m.Clock < o.Clock
+	}
+	return m.ID < o.ID
+}
+
+// vdlMessage returns the message as it was sent.  The text of encrypted
+// messages is not included.
+func (m Message) vdlMessage() vdl.Message {
+	text := m.Text
+	if m.KeyID != "" {
+		text = encryptedPlaceholder
+	}
+	var signer security.Blessings
+	if len(m.Signer) > 0 {
+		vom.Decode(m.Signer, &signer)
+	}
+	return vdl.Message{
+		Id:         m.ID,
+		Timestamp:  m.Timestamp,
+		Channel:    m.Channel,
+		Kind:       m.Kind,
+		Text:       text,
+		Clock:      m.Clock,
+		ReplyTo:    m.ReplyTo,
+		Private:    m.Private,
+		KeyId:      m.KeyID,
+		Nonce:      m.Nonce,
+		Ciphertext: m.Ciphertext,
+		OnBehalfOf: m.OnBehalfOf,
+		Target:     m.Target,
+		Parent:     m.Parent,
+		Signer:     signer,
+		Signature:  m.Signature,
+	}
+}
+
+// messages are sortable in the order they are displayed.
+type byDisplayOrder []Message
+
+func (b byDisplayOrder) Len() int           { return len(b) }
+func (b byDisplayOrder) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDisplayOrder) Less(i, j int) bool { return b[i].Before(b[j]) }
+
+// newMessage creates a message for display from a message received from the
+// sender with the given blessings.
+func newMessage(senderBlessings []string, m vdl.Message) Message {
+	var signer []byte
+	if !m.Signer.IsZero() {
+		signer, _ = vom.Encode(m.Signer)
+	}
+	return Message{
+		ID:              m.Id,
+		SenderName:      firstShortName(senderBlessings),
+		Text:            m.Text,
+		Timestamp:       m.Timestamp,
+		Channel:         m.Channel,
+		Kind:            m.Kind,
+		Clock:           m.Clock,
+		ReplyTo:         m.ReplyTo,
+		Private:         m.Private,
+		KeyID:           m.KeyId,
+		Nonce:           m.Nonce,
+		Ciphertext:      m.Ciphertext,
+		OnBehalfOf:      m.OnBehalfOf,
+		Target:          m.Target,
+		Parent:          m.Parent,
+		Signer:          signer,
+		Signature:       m.Signature,
+		SenderBlessings: senderBlessings,
+	}
+}
+
+// chatServerMethods implements the chat server VDL interface.
+type chatServerMethods struct {
+	// Incoming messages get sent to messages channel.
+	messages chan<- Message
+	// Receipts for messages we sent are recorded in deliveries.
+	deliveries *deliveryTracker
+	// History that GetHistory is served from, or nil if history is not
+	// shared with other members.
+	store *historyStore
+	// Group keys that GetGroupKey grants.
+	keys *groupKeys
+	// prepare, if set, verifies and decrypts incoming messages.
+	prepare func(m *Message, from *Member)
+	// awaitKey, if set, holds back an incoming message whose group key is
+	// not known yet, and returns true if it does.  The message is queued
+	// once the key has been fetched in the background.
+	awaitKey func(m *Message) bool
+	// Messages from principals for whose blessings blocked returns true
+	// are dropped, if it is set.
+	blocked func(blessings []string) bool
+	// Limits on the messages we accept, and the recent messages of each
+	// sender.
+	limits  InboundLimits
+	limiter *rateLimiter
+	// Notices about messages we refused are sent to notices.
+	notices chan<- string
+	// Files that members send us are received by files, or refused if it
+	// is nil.
+	files *fileReceiver
+	// ownName is the name our server is mounted on, once the channel is
+	// joined.  Our own messages are not rate limited.
+	ownName string
+}
+
+var _ vdl.ChatServerMethods = (*chatServerMethods)(nil)
+
+func newChatServerMethods(messages chan<- Message, deliveries *deliveryTracker) *chatServerMethods {
+	return &chatServerMethods{
+		messages:   messages,
+		deliveries: deliveries,
+		limits:     DefaultInboundLimits,
+		limiter:    newRateLimiter(DefaultInboundLimits.Rate, DefaultInboundLimits.Burst),
+	}
+}
+
+// SendMessage is called by older clients to send a message to the server.
+// Since the message carries only text, the ID and timestamp are filled in on
+// receipt.
+func (cs *chatServerMethods) SendMessage(ctx *context.T, call rpc.ServerCall, IncomingMessage string) error {
+	return cs.SendMessageV2(ctx, call, vdl.Message{
+		Id:        NewMessageID(),
+		Timestamp: time.Now(),
+		Kind:      vdl.MessageKindText,
+		Text:      IncomingMessage,
+	})
+}
+
+// SendMessageV2 is called by clients to send a message to the server.  The
+// sender is always derived from the remote blessings.  Messages that exceed
+// the inbound limits are refused with an error.
+func (cs *chatServerMethods) SendMessageV2(ctx *context.T, call rpc.ServerCall, IncomingMessage vdl.Message) error {
+	remoteb, _ := security.RemoteBlessingNames(ctx, call.Security())
+	localb := security.LocalBlessingNames(ctx, call.Security())
+	m := newMessage(remoteb, IncomingMessage)
+	if err := cs.checkLimits(ctx, localb, remoteb, m); err != nil {
+		return err
+	}
+	if cs.prepare != nil {
+		cs.prepare(&m, nil)
+	}
+	if cs.isBlocked(remoteb, m) {
+		// The sender is not told that they are blocked.
+		return nil
+	}
+	if cs.awaitKey != nil && cs.awaitKey(&m) {
+		return nil
+	}
+	return cs.enqueue(ctx, m)
+}
+
+// isBlocked returns true if a message is from a blocked principal, either as
+// the sender or the signer of the message.
+func (cs *chatServerMethods) isBlocked(remoteBlessings []string, m Message) bool {
+	if cs.blocked == nil {
+		return false
+	}
+	return cs.blocked(remoteBlessings) || cs.blocked(m.SenderBlessings)
+}
+
+// Acknowledge is called by recipients of messages we sent, to tell us that
+// the messages reached them.  The recipient is identified by the blessings it
+// called us with.
+func (cs *chatServerMethods) Acknowledge(ctx *context.T, call rpc.ServerCall, ids []string, state vdl.ReceiptState) error {
+	remoteb, _ := security.RemoteBlessingNames(ctx, call.Security())
+	ds := DeliveryDelivered
+	if state == vdl.ReceiptStateRead {
+		ds = DeliveryRead
+	}
+	for _, id := range ids {
+		cs.deliveries.update(id, remoteb, ds)
+	}
+	return nil
+}
+
+// Ping is called by members to check that we are still reachable.
+func (cs *chatServerMethods) Ping(ctx *context.T, call rpc.ServerCall) error {
+	return nil
+}
+
+// Version is called by members to find out which kinds of message we can
+// decode.
+func (cs *chatServerMethods) Version(ctx *context.T, call rpc.ServerCall) (int32, error) {
+	return vdl.ProtocolVersion, nil
+}
+
+// GetGroupKey is called by members of an encrypted channel, to get the key
+// that messages are encrypted with.
+func (cs *chatServerMethods) GetGroupKey(ctx *context.T, call rpc.ServerCall, req vdl.GroupKeyRequest) (vdl.GroupKeyGrant, error) {
+	if cs.keys == nil {
+		return vdl.GroupKeyGrant{}, verror.New(verror.ErrNoExist, ctx, "group key")
+	}
+	return cs.keys.grant(ctx, call.Security(), req)
+}
+
+// GetHistory is called by members who have just joined the channel, to fetch
+// the messages they missed.
+func (cs *chatServerMethods) GetHistory(ctx *context.T, call rpc.ServerCall, since time.Time, limit int32) ([]vdl.HistoryEntry, error) {
+	if cs.store == nil {
+		return nil, verror.New(verror.ErrNoExist, ctx, "history")
+	}
+	if limit > maxHistorySyncLimit {
+		limit = maxHistorySyncLimit
+	}
+	var entries []vdl.HistoryEntry
+	for _, m := range cs.store.since(since, int(limit)) {
+		entries = append(entries, vdl.HistoryEntry{
+			Message:         m.vdlMessage(),
+			SenderBlessings: m.SenderBlessings,
+		})
+	}
+	return entries, nil
+}
+
+// Member is a member of the channel.
+type Member struct {
+	// Blessings is the remote blessings of the member.  There could
+	// potentially be multiple.
+	Blessings []string
+	// Name is the name we will display for this member.
+	Name string
+	// Path is the path in the mounttable where the member is mounted.
+	Path string
+}
+
+// members are sortable by Name.
+type byName []*Member
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+const (
+	// holdbackDelay is how long incoming messages are held back so that
+	// messages reordered in transit can be displayed in the correct order.
+	holdbackDelay = 500 * time.Millisecond
+	// historySyncPeers is the number of members we fetch history from
+	// when we join the channel.
+	historySyncPeers = 3
+	// maxHistorySyncLimit is the maximum number of messages returned by
+	// GetHistory.
+	maxHistorySyncLimit = 1000
+)
+
+// Channel is a chat channel, i.e. the members mounted under a path in a
+// mounttable.  A Channel is created with New, and must be joined before
+// messages can be sent or received.
+type Channel struct {
+	// Vanadium context.  It is cancelled when the channel is closed.
+	ctx    *context.T
+	cancel func()
+	// The location where we mount ourselves and look for other users.
+	path string
+	// The implementation of the chat server.
+	chatServerMethods *chatServerMethods
+	// The chat server.
+	server rpc.Server
+	stop   func()
+	// The name our chat server is mounted at.
+	name string
+	// Channel that emits incoming messages, in order.
+	messages chan Message
+	// Channel that receives incoming messages from the chat server, in the
+	// order they arrive.  It is buffered, and bounded by the inbound limits.
+	incoming chan Message
+	// Channel that emits notices about incoming messages that were refused.
+	notices chan string
+	// Channels that emit the files members offer to send us, and the state
+	// of the files we send and receive.
+	offers    chan FileOffer
+	transfers chan FileTransfer
+	// Logical clock used to order messages.
+	clock lamportClock
+	// encrypt is true if the messages we send are encrypted with the group
+	// key of the channel.  Encrypted messages we receive are decrypted
+	// either way.
+	encrypt bool
+	// Group keys of the channel.
+	keys *groupKeys
+	// Store that incoming messages are recorded in, or nil if history is
+	// not kept.
+	store *historyStore
+	// Channel that emits the delivery state of messages we sent, whenever
+	// it changes.
+	receipts chan DeliveryStatus
+	// Delivery state of messages we sent.
+	deliveries *deliveryTracker
+	// Mutex to protect members, queues and acl.
+	mu sync.Mutex
+	// ACL of the channel, which calls to our server are authorized with.
+	// It is empty, allowing nobody, until it is first read.
+	acl access.AccessList
+	// Cached list of channel members.
+	members []*Member
+	// Cached list of all members mounted in the channel, including those
+	// that have stopped answering pings.
+	mounted []*Member
+	// Outgoing message queues, keyed by member path.
+	queues map[string]*sendQueue
+	// Members that did not answer our pings.
+	liveness *livenessTracker
+	// Protocol versions of members.
+	versions *versionTracker
+	// How long we wait for other members and for the mounttable.
+	callTimeout       time.Duration
+	mounttableTimeout time.Duration
+	// authorizer authorizes calls to our chat server.
+	authorizer security.Authorizer
+	// Principals whose messages on behalf of other users are trusted, in
+	// addition to ourselves.
+	trustedBridges []security.BlessingPattern
+}
+
+// New creates the channel at the given path.  The channel is not joined.
+func New(ctx *context.T, path string, opts ...Option) (*Channel, error) {
+	o := channelOptions{
+		callTimeout:       defaultCallTimeout,
+		mounttableTimeout: defaultMounttableTimeout,
+		limits:            DefaultInboundLimits,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	newCtx := ctx
+	if o.mounttable != "" {
+		// Set the namespace root to the mounttable of the channel.
+		var err error
+		if newCtx, _, err = v23.WithNewNamespace(ctx, o.mounttable); err != nil {
+			return nil, err
+		}
+	}
+	newCtx, cancel := context.WithCancel(newCtx)
+
+	// Set the proxy that will be used to listen.
+	listenSpec := v23.GetListenSpec(ctx)
+	listenSpec.Proxy = o.proxy
+
+	incoming := make(chan Message, o.limits.QueueSize)
+	notices := make(chan string, noticeQueueSize)
+	receipts := make(chan DeliveryStatus, sendQueueSize)
+	deliveries := newDeliveryTracker(receipts)
+
+	cr := &Channel{
+		chatServerMethods: newChatServerMethods(incoming, deliveries),
+		messages:          make(chan Message),
+		incoming:          incoming,
+		notices:           notices,
+		offers:            make(chan FileOffer, fileQueueSize),
+		transfers:         make(chan FileTransfer, fileQueueSize),
+		receipts:          receipts,
+		deliveries:        deliveries,
+		queues:            make(map[string]*sendQueue),
+		liveness:          newLivenessTracker(),
+		versions:          newVersionTracker(),
+		path:              path,
+		ctx:               newCtx,
+		cancel:            cancel,
+		server:            nil,
+		encrypt:           o.encrypt,
+		callTimeout:       o.callTimeout,
+		mounttableTimeout: o.mounttableTimeout,
+		authorizer:        o.authorizer,
+		trustedBridges:    o.trustedBridges,
+	}
+	if cr.authorizer == nil {
+		cr.authorizer = channelAuthorizer{cr}
+	}
+	cr.keys = newGroupKeys(path, cr.isMember)
+	cs := cr.chatServerMethods
+	cs.keys = cr.keys
+	cs.prepare = cr.prepareMessage
+	cs.awaitKey = func(m *Message) bool {
+		return cr.awaitGroupKey(m, func(m Message) { cs.enqueue(cr.ctx, m) })
+	}
+	cs.notices = notices
+	cs.blocked = o.blocked
+	cs.limits = o.limits
+	cs.limiter = newRateLimiter(o.limits.Rate, o.limits.Burst)
+	if o.downloadDir != "" {
+		cs.files = newFileReceiver(o.downloadDir, cr.offers, cr.transfers, newCtx.Done())
+	}
+
+	if o.historyDir != "" {
+		store, err := openHistoryStore(o.historyDir, o.mounttable, path, o.historyMaxMessages, o.historyMaxAge)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cr.setHistoryStore(store, o.serveHistory)
+	}
+	return cr, nil
+}
+
+// Path returns the path of the channel in the mounttable.
+func (cr *Channel) Path() string {
+	return cr.path
+}
+
+// Encrypted returns true if the messages we send to the channel are encrypted.
+func (cr *Channel) Encrypted() bool {
+	return cr.encrypt
+}
+
+// Messages returns the channel that emits the messages we receive, in the
+// order they should be displayed.  Messages must be read for more to be
+// received.
+func (cr *Channel) Messages() <-chan Message {
+	return cr.messages
+}
+
+// Receipts returns the channel that emits the delivery state of messages we
+// sent, whenever it changes.
+func (cr *Channel) Receipts() <-chan DeliveryStatus {
+	return cr.receipts
+}
+
+// Notices returns the channel that emits notices about messages that were
+// refused, e.g. because their sender is sending too many messages.
+func (cr *Channel) Notices() <-chan string {
+	return cr.notices
+}
+
+// Done returns a channel that is closed when the channel is closed.
+func (cr *Channel) Done() <-chan struct{} {
+	return cr.ctx.Done()
+}
+
+// IsSelf returns true if a member is us, i.e. the chat server of this Channel.
+func (cr *Channel) IsSelf(m *Member) bool {
+	return m.Path == cr.name
+}
+
+// IsOwn returns true if a message was sent by us, i.e. from this Channel.
+// ReplyTo is chosen by the sender, so the message must also be signed with our
+// blessings.
+func (cr *Channel) IsOwn(m Message) bool {
+	return m.ReplyTo == cr.name && !m.Unverified && cr.hasOwnBlessings(m.SenderBlessings)
+}
+
+// Blessings returns the blessing names that our messages are signed with.
+func (cr *Channel) Blessings() []string {
+	p := v23.GetPrincipal(cr.ctx)
+	userBlessings, _ := p.BlessingStore().Default()
+	return security.BlessingNames(p, userBlessings)
+}
+
+// UserName returns a short, human-friendly representation of the chat client.
+func (cr *Channel) UserName() string {
+	// TODO(ashankar): It is wrong to assume that
+	// v23.GetPrincipal(ctx).BlessingStore().Default() returns a valid
+	// "sender". Think about the "who-am-I" API and use that here instead.
+	userBlessings, _ := v23.GetPrincipal(cr.ctx).BlessingStore().Default()
+	userName := fmt.Sprint(userBlessings)
+	if sn := shortName(userName); sn != "" {
+		userName = sn
+	}
+	return userName
+}
+
+// getLockedName picks a random name inside the channel's mounttable path and
+// tries to "lock" it by settings restrictive permissions on the name.  It
+// tries repeatedly until it finds an unused name that can be locked, and
+// returns the locked name.
+func (cr *Channel) getLockedName() (string, error) {
+	myPatterns := security.DefaultBlessingPatterns(v23.GetPrincipal(cr.ctx))
+
+	// Give everybody allowed in the channel the ability to read and
+	// resolve the name.  All other permissions are only for us.
+	permissions := memberPermissions(myPatterns, cr.currentACL())
+
+	// Repeatedly try to SetPermissions under random names until we find a free
+	// one.
+
+	// Collisions should be rare.  25 times should be enough to find a free
+	// one
+	maxTries := 25
+	for i := 0; i < maxTries; i++ {
+		// Pick a random suffix, the hash of our default blessing and the time.
+		now := time.Now().UnixNano()
+		hash := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", cr.UserName(), now)))
+		suffix := base64.URLEncoding.EncodeToString(hash[:])
+
+		name := naming.Join(cr.path, suffix)
+
+		ns := v23.GetNamespace(cr.ctx)
+
+		if err := ns.SetPermissions(cr.ctx, name, permissions, ""); err != nil {
+			// Try again with a different name.
+			continue
+		}
+
+		// SetPermissions succeeded!  We now own the name.
+		return name, nil
+	}
+	return "", fmt.Errorf("Error getting a locked name.  Tried %v times but did not succeed.", maxTries)
+}
+
+// Join starts a chat server and mounts it in the channel path.  It also starts
+// the work the channel does in the background, until it is closed.
+func (cr *Channel) Join() error {
+	// Find out who is allowed in the channel.  Without the ACL, nobody
+	// would be allowed to resolve our name.
+	if _, err := cr.loadACL(); err != nil {
+		return err
+	}
+
+	// Get a locked name in the mounttable that we can mount our server on.
+	name, err := cr.getLockedName()
+	if err != nil {
+		return err
+	}
+	// Serve the chat server on the locked name.
+	serverChat := vdl.ChatServer(cr.chatServerMethods)
+
+	cr.name = name
+	cr.chatServerMethods.ownName = name
+
+	// Create a new server, and mount it on the locked name.
+	ctx, cancel := context.WithCancel(cr.ctx)
+	_, server, err := v23.WithNewServer(ctx, "", serverChat, cr.authorizer)
+	var mounted int
+	if err == nil {
+		mounted, err = cr.mount(ctx, server, name)
+	}
+	if err != nil {
+		cancel()
+		if server != nil {
+			<-server.Closed()
+		}
+		// Give up the locked name, rather than leaving it to the
+		// janitor.
+		v23.GetNamespace(cr.ctx).Delete(cr.ctx, name, true)
+		return err
+	}
+	cr.server = server
+	go cr.refreshMount(ctx, server, name, mounted)
+	go cr.orderMessages(ctx)
+	cr.stop = func() {
+		cancel()
+		<-server.Closed()
+	}
+
+	// Clean up names left behind by our clients that crashed.
+	go newJanitor(cr).run()
+
+	// Keep up with changes to who is allowed in the channel.
+	go cr.watchACL(ctx, name)
+
+	// Get the key that messages to the channel are encrypted with.
+	if cr.encrypt {
+		go cr.joinGroupKey()
+	}
+	return nil
+}
+
+// Leave stops the chat server and removes our mounted name from the
+// mounttable.  It fails if the channel is not joined.
+func (cr *Channel) Leave() error {
+	if cr.server == nil {
+		return verror.New(verror.ErrBadState, cr.ctx, "channel "+cr.path+" is not joined")
+	}
+	// Stop serving.
+	cr.stop()
+
+	// Stop sending.
+	cr.mu.Lock()
+	for path, q := range cr.queues {
+		q.close()
+		delete(cr.queues, path)
+	}
+	cr.mu.Unlock()
+
+	// Delete the name we are mounted at, and all sub-names in the
+	// hierarchy.
+	ns := v23.GetNamespace(cr.ctx)
+	if err := ns.Delete(cr.ctx, cr.name, true); err != nil {
+		return err
+	}
+
+	cr.server = nil
+
+	return nil
+}
+
+// Close stops everything the channel runs in the background, such as the
+// membership watcher and the janitor, and closes its history store.  The
+// channel must have been left first, or never joined.
+func (cr *Channel) Close() {
+	cr.cancel()
+	if cr.store != nil {
+		cr.store.close()
+	}
+}
+
+// orderMessages reads messages from the incoming channel, holds them back
+// for a short while so that they can be reordered, and then sends them on the
+// messages channel in (Clock, ID) order.  It returns when ctx is done.
+func (cr *Channel) orderMessages(ctx *context.T) {
+	q := newHoldbackQueue(holdbackDelay)
+	for {
+		var wait <-chan time.Time
+		if due, ok := q.nextDue(); ok {
+			wait = time.After(due.Sub(time.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-cr.incoming:
+			if m.Clock == 0 {
+				// Older clients do not send a clock.  Order the
+				// message as if it had been sent by us.
+				m.Clock = cr.clock.tick()
+			} else {
+				cr.clock.witness(m.Clock)
+			}
+			q.push(m, time.Now())
+		case <-wait:
+		}
+		for _, m := range q.popDue(time.Now()) {
+			if !cr.record(m) {
+				continue
+			}
+			select {
+			case cr.messages <- m:
+				if !m.Historical {
+					cr.Acknowledge(m, vdl.ReceiptStateDelivered)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// setHistoryStore sets the store that incoming messages are recorded in.  If
+// serve is true, the store is also used to answer GetHistory calls from other
+// members.
+func (cr *Channel) setHistoryStore(store *historyStore, serve bool) {
+	cr.store = store
+	if serve {
+		cr.chatServerMethods.store = store
+	}
+}
+
+// SyncHistory fetches the messages sent since the newest message in our
+// history from a few randomly chosen members, and merges them into the
+// messages we display.  Messages are deduplicated by ID.  It returns the
+// number of messages that were new to us.  It must be called after join.
+func (cr *Channel) SyncHistory(limit int) (int, error) {
+	members, err := cr.Members()
+	if err != nil {
+		return 0, err
+	}
+	var since time.Time
+	if cr.store != nil {
+		since = cr.store.newest()
+	}
+	var peers []*Member
+	for _, i := range rand.Perm(len(members)) {
+		if members[i].Path != cr.name {
+			peers = append(peers, members[i])
+		}
+		if len(peers) == historySyncPeers {
+			break
+		}
+	}
+
+	seen := make(map[string]bool)
+	var fetched []Message
+	for _, peer := range peers {
+		entries, err := cr.getHistoryFrom(peer, since, limit)
+		if err != nil {
+			// The member may have left, or may not share its history.
+			continue
+		}
+		for _, e := range entries {
+			// Private messages are never part of the history of
+			// the channel.
+			if seen[e.Message.Id] || e.Message.Private {
+				continue
+			}
+			seen[e.Message.Id] = true
+			// Unless the message is signed, the sender is only as
+			// trustworthy as the member we fetched the message
+			// from.
+			m := newMessage(e.SenderBlessings, e.Message)
+			m.Historical = true
+			cr.prepareMessage(&m, peer)
+			if cr.chatServerMethods.isBlocked(nil, m) {
+				continue
+			}
+			fetched = append(fetched, m)
+		}
+	}
+
+	count := 0
+	for _, m := range fetched {
+		if cr.store != nil && cr.store.has(m.ID) {
+			continue
+		}
+		cr.incoming <- m
+		count++
+	}
+	return count, nil
+}
+
+// getHistoryFrom fetches history from a particular member.
+func (cr *Channel) getHistoryFrom(member *Member, since time.Time, limit int) ([]vdl.HistoryEntry, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.callTimeout)
+	defer cancel()
+	s := vdl.ChatClient(member.Path)
+	return s.GetHistory(ctx, since, int32(limit), callOptsFor(member.Blessings)...)
+}
+
+// record writes a message to the history store, if there is one.  It returns
+// false if the message is already in the store, and should not be displayed
+// again.  Private messages are not recorded, since the history is shared with
+// other members.
+func (cr *Channel) record(m Message) bool {
+	if cr.store == nil || m.Private {
+		return true
+	}
+	added, err := cr.store.append(m)
+	if err != nil {
+		vlog.Errorf("Error writing message %v to history: %v", m.ID, err)
+		return true
+	}
+	return added
+}
+
+// ReplayHistory returns up to n of the most recent messages in the history
+// store, and moves the clock past them so that new messages are ordered after
+// them.
+func (cr *Channel) ReplayHistory(n int) []Message {
+	if cr.store == nil {
+		return nil
+	}
+	msgs := cr.store.last(n)
+	for i := range msgs {
+		cr.clock.witness(msgs[i].Clock)
+		msgs[i].Historical = true
+		// The history could have been changed on disk.
+		cr.verifyMessage(&msgs[i])
+	}
+	return msgs
+}
+
+// newMember creates a new member object.
+func (cr *Channel) newMember(blessings []string, path string) *Member {
+	name := "unknown"
+	if len(blessings) > 0 {
+		// Arbitrarily choose the first blessing as the display name.
+		name = shortName(blessings[0])
+	}
+	return &Member{
+		Name:      name,
+		Blessings: blessings,
+		Path:      path,
+	}
+}
+
+// Members gets a list of members in the channel.  Members that have stopped
+// answering pings are not included.
+func (cr *Channel) Members() ([]*Member, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.mounttableTimeout)
+	defer cancel()
+
+	// Glob on the channel path for mounted members.
+	globPath := cr.path + "/*"
+	globChan, err := v23.GetNamespace(ctx).Glob(ctx, globPath)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []*Member{}
+	// All members with a server mounted, including stale ones.
+	var mounted []*Member
+
+	for reply := range globChan {
+		switch v := reply.(type) {
+		case *naming.GlobReplyEntry:
+			blessings := blessingNamesFromMountEntry(&v.Value)
+			if len(blessings) == 0 {
+				// No servers mounted at that name, likely only a
+				// lonely ACL.  Safe to ignore.  The janitor
+				// deletes the ones we own.
+				continue
+			}
+			member := cr.newMember(blessings, v.Value.Name)
+			mounted = append(mounted, member)
+			if !cr.liveness.isStale(member.Path) {
+				members = append(members, member)
+			}
+		}
+	}
+
+	sort.Sort(byName(members))
+
+	paths := make(map[string]bool, len(mounted))
+	for _, member := range mounted {
+		paths[member.Path] = true
+	}
+	cr.liveness.forget(paths)
+	cr.versions.forget(paths)
+
+	cr.mu.Lock()
+	cr.members = members
+	cr.mounted = mounted
+	cr.dropStaleQueues()
+	cr.mu.Unlock()
+	return members, nil
+}
+
+// dropStaleQueues closes the outgoing queues of members that are no longer in
+// the channel.  Messages still waiting in those queues are dropped.  cr.mu
+// must be held.
+func (cr *Channel) dropStaleQueues() {
+	current := make(map[string]bool, len(cr.members))
+	for _, member := range cr.members {
+		current[member.Path] = true
+	}
+	for path, q := range cr.queues {
+		if !current[path] {
+			q.close()
+			delete(cr.queues, path)
+		}
+	}
+}
+
+// queueFor returns the outgoing queue for a member, creating it if necessary.
+// cr.mu must be held.
+func (cr *Channel) queueFor(member *Member) *sendQueue {
+	q, ok := cr.queues[member.Path]
+	if !ok {
+		send := func(m vdl.Message) error {
+			return cr.sendMessageTo(member, m)
+		}
+		q = newSendQueue(member, send, cr.reportFailure)
+		cr.queues[member.Path] = q
+	}
+	return q
+}
+
+// reportFailure records that a message could not be delivered to a member.
+func (cr *Channel) reportFailure(f sendFailure) {
+	cr.deliveries.update(f.MessageID, []string{memberID(f.Member)}, DeliveryFailed)
+}
+
+// Acknowledge tells the sender of a message that it reached the given state
+// here.  Receipts are best-effort, so errors are ignored.
+func (cr *Channel) Acknowledge(m Message, state vdl.ReceiptState) {
+	if m.ReplyTo == "" || m.ReplyTo == cr.name {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(cr.ctx, cr.callTimeout)
+		defer cancel()
+		s := vdl.ChatClient(m.ReplyTo)
+		s.Acknowledge(ctx, []string{m.ID}, state, callOptsFor(m.SenderBlessings)...)
+	}()
+}
+
+// newOutgoingMessage creates a new message of the given kind, sent from us to
+// this channel, or privately to some of its members.  Its text is encrypted if
+// encryption is turned on for the channel, and it is signed.
+func (cr *Channel) newOutgoingMessage(kind vdl.MessageKind, messageText string, private bool, opts ...MessageOption) (vdl.Message, error) {
+	m := cr.draftMessage(kind, messageText, private)
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return cr.sealMessage(m)
+}
+
+// draftMessage creates a new message like newOutgoingMessage does, but does not
+// encrypt or sign it, so that more of its fields can be set first.
+func (cr *Channel) draftMessage(kind vdl.MessageKind, messageText string, private bool) vdl.Message {
+	return vdl.Message{
+		Id:        NewMessageID(),
+		Timestamp: time.Now(),
+		Channel:   cr.path,
+		Kind:      kind,
+		Text:      messageText,
+		Clock:     cr.clock.tick(),
+		ReplyTo:   cr.name,
+		Private:   private,
+	}
+}
+
+// sealMessage encrypts the text of a drafted message if encryption is turned on
+// for the channel, and signs it.
+func (cr *Channel) sealMessage(m vdl.Message) (vdl.Message, error) {
+	if err := cr.encryptMessage(&m); err != nil {
+		return m, err
+	}
+	return m, cr.signMessage(&m)
+}
+
+// Broadcast sends a message of the given kind to all members in the channel.
+func (cr *Channel) Broadcast(kind vdl.MessageKind, messageText string, opts ...MessageOption) error {
+	m, err := cr.newOutgoingMessage(kind, messageText, false, opts...)
+	if err != nil {
+		return err
+	}
+	return cr.broadcast(m)
+}
+
+// Relay sends a message of the given kind to all members in the channel on
+// behalf of a user who is not a member, e.g. a user of a bridge to another
+// chat system.  The message is sent and signed by us, and names the user in
+// its OnBehalfOf field.  It returns the ID of the message, which is also
+// given to the message by WithID if the caller needs to know it beforehand.
+func (cr *Channel) Relay(user string, kind vdl.MessageKind, messageText string, opts ...MessageOption) (string, error) {
+	m := cr.draftMessage(kind, messageText, false)
+	for _, opt := range opts {
+		opt(&m)
+	}
+	m.OnBehalfOf = user
+	m, err := cr.sealMessage(m)
+	if err != nil {
+		return "", err
+	}
+	return m.Id, cr.broadcast(m)
+}
+
+// broadcast sends a message to all members in the channel.  The message is
+// added to each member's outgoing queue, and sent asynchronously.  Its delivery
+// state at each member other than us is reported on cr.receipts.
+func (cr *Channel) broadcast(m vdl.Message) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	var recipients []*Member
+	for _, member := range cr.members {
+		if member.Path != cr.name {
+			recipients = append(recipients, member)
+		}
+	}
+	cr.deliveries.track(m.Id, recipients)
+	for _, member := range cr.members {
+		if err := cr.queueFor(member).enqueue(m); err != nil {
+			cr.reportFailure(sendFailure{MessageID: m.Id, Member: member, Err: err})
+		}
+	}
+	return nil
+}
+
+// HasMember returns true if a member other than us has the given short name or
+// blessing name.
+func (cr *Channel) HasMember(name string) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.membersNamed(name)) > 0
+}
+
+// MemberBlessings returns the blessings of the members other than us with the
+// given name.
+func (cr *Channel) MemberBlessings(name string) []string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	var blessings []string
+	for _, member := range cr.membersNamed(name) {
+		blessings = append(blessings, member.Blessings...)
+	}
+	return blessings
+}
+
+// membersNamed returns the members other than us with the given short name or
+// blessing name.  Principals under different blessing roots can have the same
+// short name.  cr.mu must be held.
+func (cr *Channel) membersNamed(name string) []*Member {
+	var members []*Member
+	for _, member := range cr.members {
+		if member.Path != cr.name && (member.Name == name || HasBlessing(member.Blessings, name)) {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// HasBlessing returns true if blessings include the given blessing name.
+func HasBlessing(blessings []string, name string) bool {
+	for _, b := range blessings {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// memberID returns the name that identifies the principal of a member: its
+// first blessing name, or its path if it has no blessings.
+func memberID(member *Member) string {
+	if len(member.Blessings) == 0 {
+		return member.Path
+	}
+	return member.Blessings[0]
+}
+
+// recipients returns the members other than us that a private message to the
+// given name is sent to.  The name is either the blessing name of a member, in
+// which case all its clients are included, or a short name that only one
+// principal has.  A short name shared by several principals is an error, so
+// that a principal under another blessing root cannot receive messages meant
+// for someone else.  cr.mu must be held.
+func (cr *Channel) recipients(name string) ([]*Member, error) {
+	var byBlessing, byName []*Member
+	principals := make(map[string]bool)
+	for _, member := range cr.members {
+		if member.Path == cr.name {
+			continue
+		}
+		if HasBlessing(member.Blessings, name) || member.Path == name {
+			byBlessing = append(byBlessing, member)
+		} else if member.Name == name {
+			byName = append(byName, member)
+			principals[memberID(member)] = true
+		}
+	}
+	switch {
+	case len(byBlessing) > 0:
+		return byBlessing, nil
+	case len(byName) == 0:
+		return nil, verror.New(verror.ErrNoExist, cr.ctx, name)
+	case len(principals) > 1:
+		var ids []string
+		for id := range principals {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return nil, verror.New(verror.ErrBadArg, cr.ctx, fmt.Sprintf("'%s' is the name of several principals, use one of %s", name, strings.Join(ids, ", ")))
+	}
+	return byName, nil
+}
+
+// ResolveMember returns the blessing name that identifies the member other
+// than us that a short name or blessing name refers to, for use with Send and
+// SendFile.  It returns ErrNoExist if there is no such member, and ErrBadArg
+// if the short name is shared by several principals.
+func (cr *Channel) ResolveMember(name string) (string, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	members, err := cr.recipients(name)
+	if err != nil {
+		return "", err
+	}
+	return memberID(members[0]), nil
+}
+
+// Send sends a private message to the member with the given blessing name or
+// short name only, on each of the clients it runs.  The message is sent
+// asynchronously, like broadcast messages are, and only to servers with the
+// blessings the member was globbed with.  It returns the message as we display
+// it, or an error if no member has the name or if several principals do.
+func (cr *Channel) Send(name string, kind vdl.MessageKind, messageText string, opts ...MessageOption) (Message, error) {
+	m, err := cr.newOutgoingMessage(kind, messageText, true, opts...)
+	if err != nil {
+		return Message{}, err
+	}
+	sent := newMessage(nil, m)
+	// Our signature names us as the sender, so that we can edit the
+	// message later.
+	cr.verifyMessage(&sent)
+	sent.SenderName = cr.UserName()
+	sent.Text = messageText
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	recipients, err := cr.recipients(name)
+	if err != nil {
+		return Message{}, err
+	}
+	cr.deliveries.track(m.Id, recipients)
+	for _, member := range recipients {
+		if err := cr.queueFor(member).enqueue(m); err != nil {
+			cr.reportFailure(sendFailure{MessageID: m.Id, Member: member, Err: err})
+		}
+	}
+	return sent, nil
+}
+
+// sendMessageTo sends a message to a particular member.  It ensures that the
+// receiving server has the same blessings that the member does.  Members
+// running an older client that does not implement SendMessageV2 are sent the
+// text of the message only, and are not sent the kinds of message they cannot
+// decode.
+func (cr *Channel) sendMessageTo(member *Member, m vdl.Message) error {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.callTimeout)
+	defer cancel()
+
+	if required := requiredVersion(m.Kind); required > 1 {
+		v, err := cr.peerVersion(ctx, member)
+		if err != nil {
+			return err
+		}
+		if v < required {
+			return verror.New(verror.ErrBadProtocol, ctx, "member runs an older client that cannot receive "+m.Kind.String()+" messages")
+		}
+	}
+
+	s := vdl.ChatClient(member.Path)
+
+	// The server must match the blessings we got when we globbed it.
+	opts := callOptsFor(member.Blessings)
+	err := s.SendMessageV2(ctx, m, opts...)
+	if verror.ErrorID(err) == verror.ErrUnknownMethod.ID {
+		// Older clients never send receipts, so treat the message as
+		// delivered once they accept it.
+		if err = s.SendMessage(ctx, m.Text, opts...); err == nil {
+			cr.deliveries.update(m.Id, []string{memberID(member)}, DeliveryDelivered)
+		}
+	}
+	return err
+}
+
+// callOptsFor returns options for an RPC to a server that must have one of the
+// given blessings.
+func callOptsFor(blessings []string) []rpc.CallOpt {
+	var opts []rpc.CallOpt
+	if len(blessings) > 0 {
+		// The AllowedServersPolicy options require that the server matches the
+		acl := access.AccessList{In: make([]security.BlessingPattern, len(blessings))}
+		for i, b := range blessings {
+			acl.In[i] = security.BlessingPattern(b)
+		}
+		opts = append(opts, options.ServerAuthorizer{acl})
+	}
+	return opts
+}
+
+func blessingNamesFromMountEntry(me *naming.MountEntry) []string {
+	names := me.Names()
+	if len(names) == 0 {
+		return nil
+	}
+	// Using the first valid mount entry for now.
+	// TODO(nlacasse): How should we deal with multiple members mounted on
+	// a single mountpoint?
+	for _, name := range names {
+		addr, _ := naming.SplitAddressName(name)
+		ep, err := v23.NewEndpoint(addr)
+		if err != nil {
+			// TODO(nlacasse): Log this or bubble up?
+			continue
+		}
+		return ep.BlessingNames()
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/internal/chattest"
+	"v.io/x/chat/vdl"
+	_ "v.io/x/ref/runtime/factories/roaming"
+	"v.io/x/ref/test/v23test"
+)
+
+// Asserts that the channel contains members with expected names and no others.
+func AssertMembersWithNames(channel *Channel, expectedNames []string, retry bool) error {
+
+	waitForN := func(expected int) ([]*Member, error) {
+		deadline := time.Now().Add(5 * time.Minute)
+		for {
+			members, err := channel.Members()
+			if err != nil || len(members) != expected {
+				if retry {
+					if time.Now().After(deadline) {
+						return nil, fmt.Errorf("timed out expecting %d members", expected)
+					}
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				if err != nil {
+					return nil, fmt.Errorf("channel.Members() failed: %v", err)
+				}
+				return nil, fmt.Errorf("Wrong number of members.  Expected %v, actual %v.", len(members), expected)
+			}
+			return members, nil
+		}
+	}
+
+	members, err := waitForN(len(expectedNames))
+	if err != nil {
+		return err
+	}
+
+	for _, expectedName := range expectedNames {
+		found := false
+		for _, member := range members {
+			if member.Name == expectedName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Expected member with name %v, but did not find one.", expectedName)
+		}
+	}
+	return nil
+}
+
+func TestMembers(t *testing.T) {
+	sh := v23test.NewShell(t, nil)
+	defer sh.Cleanup()
+	ctx := sh.Ctx
+
+	mounttable := chattest.StartRootMT(sh)
+
+	proxy := ""
+	path := "path/to/channel"
+
+	// Create a new channel.
+	channel, err := New(ctx, path, WithMounttable(mounttable), WithProxy(proxy))
+	if err != nil {
+		t.Fatalf("New(%v) failed: %v", path, err)
+	}
+
+	// New channel should be empty.
+	if err := AssertMembersWithNames(channel, []string{}, false); err != nil {
+		t.Error(err)
+	}
+
+	// Join the channel.
+	if err := channel.Join(); err != nil {
+		t.Fatalf("channel.Join() failed: %v", err)
+	}
+
+	// Channel should contain only current user.
+	if err := AssertMembersWithNames(channel, []string{channel.UserName()}, true); err != nil {
+		t.Error(err)
+	}
+
+	// Create and join the channel a second time.
+	channel2, err := New(ctx, path, WithMounttable(mounttable), WithProxy(proxy))
+	if err != nil {
+		t.Fatalf("New(%v) failed: %v", path, err)
+	}
+	if err := channel2.Join(); err != nil {
+		t.Fatalf("channel2.Join() failed: %v", err)
+	}
+
+	// Channel should contain both users.
+	if err := AssertMembersWithNames(channel, []string{channel.UserName(), channel2.UserName()}, true); err != nil {
+		t.Error(err)
+	}
+
+	// Leave first instance of channel.
+	if err := channel.Leave(); err != nil {
+		t.Fatalf("channel.Leave() failed: %v", err)
+	}
+
+	// Channel should contain only second user.
+	if err := AssertMembersWithNames(channel, []string{channel2.UserName()}, true); err != nil {
+		t.Error(err)
+	}
+
+	// Leave second instance of channel.
+	if err := channel2.Leave(); err != nil {
+		t.Fatalf("channel2.Leave() failed: %v", err)
+	}
+
+	// Channel should be empty.
+	if err := AssertMembersWithNames(channel, []string{}, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	alice := &Member{Name: "alice@example.com", Blessings: []string{"dev.v.io:u:alice@example.com"}, Path: "a1"}
+	aliceLaptop := &Member{Name: "alice@example.com", Blessings: []string{"dev.v.io:u:alice@example.com"}, Path: "a2"}
+	impostor := &Member{Name: "alice@example.com", Blessings: []string{"evil.example.com:alice@example.com"}, Path: "i"}
+	cr := &Channel{name: "me", members: []*Member{alice, aliceLaptop}}
+
+	// All the clients of a principal receive its private messages.
+	got, err := cr.recipients("alice@example.com")
+	if err != nil || len(got) != 2 {
+		t.Errorf("Got %v (%v), want both of alice's clients", got, err)
+	}
+
+	// Once another principal has the same short name, only blessing names
+	// identify members.
+	cr.members = append(cr.members, impostor)
+	if _, err := cr.recipients("alice@example.com"); verror.ErrorID(err) != verror.ErrBadArg.ID {
+		t.Errorf("Got error %v, want ErrBadArg for an ambiguous name", err)
+	}
+	got, err = cr.recipients("evil.example.com:alice@example.com")
+	if err != nil || len(got) != 1 || got[0] != impostor {
+		t.Errorf("Got %v (%v), want the impostor only", got, err)
+	}
+	if _, err := cr.recipients("bob@example.com"); verror.ErrorID(err) != verror.ErrNoExist.ID {
+		t.Errorf("Got error %v, want ErrNoExist", err)
+	}
+}
+
+func TestBroadcastMessage(t *testing.T) {
+	sh := v23test.NewShell(t, nil)
+	defer sh.Cleanup()
+	ctx := sh.Ctx
+
+	mounttable := chattest.StartRootMT(sh)
+
+	proxy := ""
+	path := "path/to/channel"
+
+	channel, err := New(ctx, path, WithMounttable(mounttable), WithProxy(proxy))
+	if err != nil {
+		t.Fatalf("New(%v) failed: %v", path, err)
+	}
+
+	defer channel.Leave()
+
+	if err := channel.Join(); err != nil {
+		t.Fatalf("channel.Join() failed: %v", err)
+	}
+
+	message := "Hello Vanadium world!"
+
+	go func() {
+		// Call Members(), which will set channel.members, used by
+		// channel.Broadcast().
+		deadline := time.Now().Add(time.Minute)
+		for {
+			m, err := channel.Members()
+			if err != nil {
+				t.Fatalf("channel.Members() failed: %v", err)
+			}
+			if len(m) > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("channel.getMembers: timed out getting a member")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := channel.Broadcast(vdl.MessageKindText, message); err != nil {
+			t.Fatalf("channel.Broadcast(%v) failed: %v", message, err)
+		}
+	}()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Errorf("Timeout waiting for message to be received.")
+	case m := <-channel.messages:
+		if m.Text != message {
+			t.Errorf("Expected message text to be %v but got %v", message, m.Text)
+		}
+		if got, want := m.SenderName, channel.UserName(); got != want {
+			t.Errorf("Got m.SenderName = %v, want %v", got, want)
+		}
+		if m.ID == "" {
+			t.Errorf("Expected message to have an ID")
+		}
+		if got, want := m.Channel, path; got != want {
+			t.Errorf("Got m.Channel = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSyncHistory(t *testing.T) {
+	sh := v23test.NewShell(t, nil)
+	defer sh.Cleanup()
+	ctx := sh.Ctx
+
+	mounttable := chattest.StartRootMT(sh)
+
+	proxy := ""
+	path := "path/to/channel"
+
+	historyDir, err := ioutil.TempDir("", "chat-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(historyDir)
+
+	// The first member has some history, which it shares.
+	channel, err := New(ctx, path, WithMounttable(mounttable), WithProxy(proxy))
+	if err != nil {
+		t.Fatalf("New(%v) failed: %v", path, err)
+	}
+	store, err := openHistoryStore(historyDir, mounttable, path, 0, 0)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	defer store.close()
+	for i := 0; i < 3; i++ {
+		m := Message{ID: fmt.Sprint(i), Text: fmt.Sprintf("message %d", i), Clock: uint64(i + 1), Timestamp: time.Now()}
+		if _, err := store.append(m); err != nil {
+			t.Fatalf("store.append failed: %v", err)
+		}
+	}
+	channel.setHistoryStore(store, true)
+	if err := channel.Join(); err != nil {
+		t.Fatalf("channel.Join() failed: %v", err)
+	}
+	defer channel.Leave()
+
+	// The second member joins without any history.
+	channel2, err := New(ctx, path, WithMounttable(mounttable), WithProxy(proxy))
+	if err != nil {
+		t.Fatalf("New(%v) failed: %v", path, err)
+	}
+	if err := channel2.Join(); err != nil {
+		t.Fatalf("channel2.Join() failed: %v", err)
+	}
+	defer channel2.Leave()
+	if err := AssertMembersWithNames(channel2, []string{channel.UserName(), channel2.UserName()}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if n, err := channel2.SyncHistory(10); err != nil || n != 3 {
+			t.Errorf("channel2.SyncHistory(10) = %v, %v, want 3, nil", n, err)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timeout waiting for message %d from history.", i)
+		case m := <-channel2.messages:
+			if got, want := m.ID, fmt.Sprint(i); got != want {
+				t.Errorf("Got message with ID %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	v23test.TestMain(m)
+}
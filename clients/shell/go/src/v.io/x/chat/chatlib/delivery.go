@@ -0,0 +1,180 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxTrackedMessages is the number of sent messages whose delivery state we
+// remember.  Receipts for older messages are ignored.
+const maxTrackedMessages = 1000
+
+// DeliveryState is the state of a message we sent, at one recipient.  States
+// only ever move forward, except that a failed message can still be
+// acknowledged by its recipient.
+type DeliveryState int
+
+const (
+	DeliveryPending DeliveryState = iota
+	DeliveryFailed
+	DeliveryDelivered
+	DeliveryRead
+)
+
+// DeliveryStatus is the state of a message we sent, at each of its
+// recipients.
+type DeliveryStatus struct {
+	MessageID string
+	// States holds the state of the message at each recipient, keyed by
+	// the recipient's blessing name, or its path if it has no blessings.
+	// Short names are not unique, so they cannot be used as keys.
+	States map[string]DeliveryState
+	// Names holds the short name of each recipient in States, for display.
+	Names map[string]string
+}
+
+// count returns the number of recipients at which the message has reached
+// at least the given state.
+func (s DeliveryStatus) count(state DeliveryState) int {
+	n := 0
+	for _, st := range s.States {
+		if st >= state {
+			n++
+		}
+	}
+	return n
+}
+
+// Members returns the sorted short names of the recipients at which the
+// message is in exactly the given state.
+func (s DeliveryStatus) Members(state DeliveryState) []string {
+	var names []string
+	for id, st := range s.States {
+		if st == state {
+			name := s.Names[id]
+			if name == "" {
+				name = id
+			}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns a short human-readable summary of the status, e.g.
+// "delivered to 2 of 3".  It returns an empty string if the message had no
+// recipients.
+func (s DeliveryStatus) String() string {
+	total := len(s.States)
+	if total == 0 {
+		return ""
+	}
+	failed := s.Members(DeliveryFailed)
+	delivered := s.count(DeliveryDelivered)
+	switch {
+	case len(failed) == total:
+		return "failed"
+	case delivered == 0 && len(failed) == 0:
+		return "pending"
+	}
+	parts := []string{fmt.Sprintf("delivered to %d of %d", delivered, total)}
+	if read := s.Members(DeliveryRead); len(read) > 0 {
+		parts = append(parts, "read by "+strings.Join(read, ", "))
+	}
+	if len(failed) > 0 {
+		parts = append(parts, "not delivered to "+strings.Join(failed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// deliveryTracker keeps track of the delivery state of the messages we sent.
+// Every change is sent as a snapshot on the updates channel.
+type deliveryTracker struct {
+	// Mutex to protect statuses and order.
+	mu       sync.Mutex
+	statuses map[string]*DeliveryStatus
+	// order holds the IDs of tracked messages, oldest first.
+	order   []string
+	updates chan<- DeliveryStatus
+}
+
+func newDeliveryTracker(updates chan<- DeliveryStatus) *deliveryTracker {
+	return &deliveryTracker{
+		statuses: make(map[string]*DeliveryStatus),
+		updates:  updates,
+	}
+}
+
+// track starts tracking a message sent to the given recipients.  Clients of
+// the same principal are tracked as a single recipient.
+func (t *deliveryTracker) track(messageID string, recipients []*Member) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &DeliveryStatus{
+		MessageID: messageID,
+		States:    make(map[string]DeliveryState, len(recipients)),
+		Names:     make(map[string]string, len(recipients)),
+	}
+	for _, member := range recipients {
+		id := memberID(member)
+		s.States[id] = DeliveryPending
+		s.Names[id] = member.Name
+	}
+	t.statuses[messageID] = s
+	t.order = append(t.order, messageID)
+	if len(t.order) > maxTrackedMessages {
+		delete(t.statuses, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.publish(s)
+}
+
+// update records that a message reached the given state at the recipient
+// with one of the given ids, i.e. blessing names or a member path.
+func (t *deliveryTracker) update(messageID string, ids []string, state DeliveryState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.statuses[messageID]
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		current, ok := s.States[id]
+		if !ok {
+			continue
+		}
+		if state > current {
+			s.States[id] = state
+			t.publish(s)
+		}
+		return
+	}
+}
+
+// publish sends a copy of the status on the updates channel.  If nobody is
+// reading updates and the channel is full, the update is dropped.  t.mu must
+// be held.
+func (t *deliveryTracker) publish(s *DeliveryStatus) {
+	c := DeliveryStatus{
+		MessageID: s.MessageID,
+		States:    make(map[string]DeliveryState, len(s.States)),
+		Names:     make(map[string]string, len(s.Names)),
+	}
+	for id, st := range s.States {
+		c.States[id] = st
+	}
+	for id, name := range s.Names {
+		c.Names[id] = name
+	}
+	select {
+	case t.updates <- c:
+	default:
+	}
+}
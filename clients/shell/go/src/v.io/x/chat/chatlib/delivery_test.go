@@ -0,0 +1,73 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import "testing"
+
+func TestDeliveryTracker(t *testing.T) {
+	updates := make(chan DeliveryStatus, 10)
+	dt := newDeliveryTracker(updates)
+
+	expect := func(want string) {
+		select {
+		case ds := <-updates:
+			if got := ds.String(); got != want {
+				t.Errorf("Got status %q, want %q", got, want)
+			}
+		default:
+			t.Errorf("Expected an update with status %q", want)
+		}
+	}
+
+	member := func(name string) *Member {
+		return &Member{Name: name, Blessings: []string{"root:" + name}, Path: "path/to/" + name}
+	}
+	dt.track("id", []*Member{member("alice"), member("bob"), member("carol")})
+	expect("pending")
+
+	dt.update("id", []string{"root:alice"}, DeliveryDelivered)
+	expect("delivered to 1 of 3")
+
+	dt.update("id", []string{"root:bob"}, DeliveryFailed)
+	expect("delivered to 1 of 3; not delivered to bob")
+
+	// A recipient is matched by any of its blessings.
+	dt.update("id", []string{"other:alice", "root:alice"}, DeliveryRead)
+	expect("delivered to 1 of 3; read by alice; not delivered to bob")
+
+	// States never move backwards, and unknown members and messages are
+	// ignored.  In particular, another principal with the same short name
+	// cannot acknowledge a message.
+	dt.update("id", []string{"root:alice"}, DeliveryDelivered)
+	dt.update("id", []string{"root:dave"}, DeliveryDelivered)
+	dt.update("id", []string{"other:carol"}, DeliveryRead)
+	dt.update("other", []string{"root:alice"}, DeliveryDelivered)
+	if len(updates) != 0 {
+		t.Errorf("Expected no updates, got %d", len(updates))
+	}
+
+	// A failed message can still be acknowledged.
+	dt.update("id", []string{"root:bob"}, DeliveryDelivered)
+	expect("delivered to 2 of 3; read by alice")
+
+	// Several clients of the same principal are a single recipient, and a
+	// member without blessings is identified by its path.
+	alice2 := member("alice")
+	alice2.Path = "path/to/alice2"
+	dt.track("id2", []*Member{member("alice"), alice2, {Name: "bob", Path: "path/to/bob"}})
+	expect("pending")
+	dt.update("id2", []string{"path/to/bob"}, DeliveryDelivered)
+	expect("delivered to 1 of 2")
+}
+
+func TestDeliveryStatusAllFailed(t *testing.T) {
+	ds := DeliveryStatus{
+		MessageID: "id",
+		States:    map[string]DeliveryState{"alice": DeliveryFailed},
+	}
+	if got, want := ds.String(), "failed"; got != want {
+		t.Errorf("Got status %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"v.io/x/chat/vdl"
+)
+
+// MessageOption sets optional fields of a message we send with Broadcast or
+// Send.
+type MessageOption func(*vdl.Message)
+
+// WithTarget sets the message that an edit, deletion or reaction applies to.
+func WithTarget(id string) MessageOption {
+	return func(m *vdl.Message) {
+		m.Target = id
+	}
+}
+
+// IsEdit returns true if m edits or deletes an earlier message.
+func (m Message) IsEdit() bool {
+	return m.Kind == vdl.MessageKindEdit || m.Kind == vdl.MessageKindDelete
+}
+
+// IsOp returns true if m changes an earlier message, rather than being
+// displayed itself.
+func (m Message) IsOp() bool {
+	return m.IsEdit() || m.IsReaction()
+}
+
+// Modifies returns true if m is an edit or deletion of target that should be
+// applied.  It must be signed by one of the principals that signed target, on
+// behalf of the same user if target was relayed by a bridge.
+func (m Message) Modifies(target Message) bool {
+	if !m.IsEdit() || m.Target != target.ID || m.Unverified || target.Unverified {
+		return false
+	}
+	if m.OnBehalfOf != target.OnBehalfOf {
+		return false
+	}
+	for _, b := range m.SenderBlessings {
+		for _, tb := range target.SenderBlessings {
+			if b == tb {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"testing"
+
+	"v.io/x/chat/vdl"
+)
+
+func TestModifies(t *testing.T) {
+	target := Message{
+		ID:              "1",
+		Kind:            vdl.MessageKindText,
+		SenderBlessings: []string{"dev.v.io:u:alice", "dev.v.io:u:alice:laptop"},
+	}
+	edit := Message{
+		ID:              "2",
+		Kind:            vdl.MessageKindEdit,
+		Target:          "1",
+		SenderBlessings: []string{"dev.v.io:u:alice:laptop"},
+	}
+	if !edit.Modifies(target) {
+		t.Errorf("Edit by the sender is not applied")
+	}
+
+	tests := map[string]func(edit, target *Message){
+		"another sender":      func(edit, target *Message) { edit.SenderBlessings = []string{"dev.v.io:u:bob"} },
+		"unverified edit":     func(edit, target *Message) { edit.Unverified = true },
+		"unverified target":   func(edit, target *Message) { target.Unverified = true },
+		"another message":     func(edit, target *Message) { edit.Target = "3" },
+		"a text message":      func(edit, target *Message) { edit.Kind = vdl.MessageKindText },
+		"another bridge user": func(edit, target *Message) { edit.OnBehalfOf = "carol" },
+	}
+	for name, change := range tests {
+		e, tm := edit, target
+		change(&e, &tm)
+		if e.Modifies(tm) {
+			t.Errorf("Edit from %s is applied", name)
+		}
+	}
+
+	del := edit
+	del.Kind = vdl.MessageKindDelete
+	if !del.Modifies(target) {
+		t.Errorf("Deletion by the sender is not applied")
+	}
+}
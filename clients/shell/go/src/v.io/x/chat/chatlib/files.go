@@ -0,0 +1,572 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/v23/context"
+	"v.io/v23/security"
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+const (
+	// fileChunkSize is the size of the chunks that files are streamed in.
+	fileChunkSize = 64 << 10
+	// maxFileSize is the size of the largest file we accept.
+	maxFileSize = 1 << 30
+	// maxFileIDLength is the length of the longest transfer ID we accept.
+	maxFileIDLength = 64
+	// fileOfferTimeout is how long an offer waits for the user to accept
+	// or reject it.
+	fileOfferTimeout = 5 * time.Minute
+	// minFileRate is the slowest rate, in bytes per second, that a file is
+	// allowed to be sent at before the call times out.  A transfer that
+	// times out is resumed.
+	minFileRate = 16 << 10
+	// fileQueueSize is the number of offers that can be waiting to be
+	// shown.  Further offers are refused.  It is also the number of
+	// progress reports that can be waiting to be shown, beyond which
+	// progress reports are dropped.
+	fileQueueSize = 10
+	// partialPrefix starts the names of the files that are still being
+	// received in the download directory.
+	partialPrefix = ".partial-"
+	// maxPartialAge is how long an interrupted transfer can be resumed
+	// without asking the user again.  Older partial files are removed.
+	maxPartialAge = 24 * time.Hour
+)
+
+// FileOffer is a file that a member offered to send us.  The user accepts or
+// rejects it with Accept or Reject, before Expires.
+type FileOffer struct {
+	// ID identifies the transfer of the file.
+	ID   string
+	Name string
+	// Size is the size of the file in bytes.
+	Size int64
+	// Sender is the name of the member who offered the file, and
+	// SenderBlessings their remote blessings.
+	Sender          string
+	SenderBlessings []string
+	// Expires is the time after which the offer is rejected.
+	Expires  time.Time
+	decision chan bool
+}
+
+// Accept accepts the offer, so that the file is received into the download
+// directory.  It does nothing if the offer was already decided or expired.
+func (o FileOffer) Accept() {
+	o.decide(true)
+}
+
+// Reject rejects the offer.  It does nothing if the offer was already decided
+// or expired.
+func (o FileOffer) Reject() {
+	o.decide(false)
+}
+
+func (o FileOffer) decide(accept bool) {
+	select {
+	case o.decision <- accept:
+	default:
+	}
+}
+
+// FileTransfer is the state of a file we are sending or receiving.
+type FileTransfer struct {
+	// ID identifies the transfer.
+	ID   string
+	Name string
+	// Peer is the name of the member the file is sent to, or received
+	// from if Incoming is set, and PeerBlessings their blessings.
+	Peer          string
+	PeerBlessings []string
+	Incoming      bool
+	// Size is the size of the file, and Done the number of bytes of it
+	// that have been sent or received so far.
+	Size int64
+	Done int64
+	// Path is where a file we received was saved, once it is complete.
+	Path string
+	// Complete is set once the whole file has been sent and verified by
+	// its recipient.  Err is set if the transfer failed.
+	Complete bool
+	Err      error
+}
+
+// Finished returns true if the transfer completed or failed.
+func (t FileTransfer) Finished() bool {
+	return t.Complete || t.Err != nil
+}
+
+// transferReporter reports the progress of a transfer.  Progress is reported
+// every time another percent of the file is done, and is dropped if earlier
+// reports have not been read.  The final state of the transfer is always
+// reported.
+type transferReporter struct {
+	transfers chan<- FileTransfer
+	done      <-chan struct{}
+	reported  bool
+	last      int64
+}
+
+func (r *transferReporter) progress(t FileTransfer) {
+	if r.reported && t.Done-r.last < t.Size/100 {
+		return
+	}
+	r.reported = true
+	r.last = t.Done
+	select {
+	case r.transfers <- t:
+	default:
+	}
+}
+
+func (r *transferReporter) finish(t FileTransfer) {
+	select {
+	case r.transfers <- t:
+	case <-r.done:
+	}
+}
+
+// fileReceiver receives the files that members send us into a download
+// directory, once the user has accepted them.
+type fileReceiver struct {
+	dir       string
+	maxSize   int64
+	timeout   time.Duration
+	offers    chan<- FileOffer
+	transfers chan<- FileTransfer
+	done      <-chan struct{}
+	// Mutex to protect active and accepted.
+	mu sync.Mutex
+	// active holds the keys of the transfers being received.
+	active map[string]bool
+	// accepted holds the time the user accepted the transfers that have
+	// not completed, by key, so that they are resumed without asking the
+	// user again.  Transfers are forgotten after maxPartialAge.
+	accepted map[string]time.Time
+}
+
+func newFileReceiver(dir string, offers chan<- FileOffer, transfers chan<- FileTransfer, done <-chan struct{}) *fileReceiver {
+	return &fileReceiver{
+		dir:       dir,
+		maxSize:   maxFileSize,
+		timeout:   fileOfferTimeout,
+		offers:    offers,
+		transfers: transfers,
+		done:      done,
+		active:    make(map[string]bool),
+		accepted:  make(map[string]time.Time),
+	}
+}
+
+// removeStale forgets the transfers that were accepted more than
+// maxPartialAge ago, and removes the partial files that were not written to
+// since then.  fr.mu must be held.
+func (fr *fileReceiver) removeStale() {
+	cutoff := time.Now().Add(-maxPartialAge)
+	for key, accepted := range fr.accepted {
+		if accepted.Before(cutoff) && !fr.active[key] {
+			delete(fr.accepted, key)
+		}
+	}
+	partials, _ := filepath.Glob(filepath.Join(fr.dir, partialPrefix+"*"))
+	for _, partial := range partials {
+		if fi, err := os.Stat(partial); err == nil && fi.ModTime().Before(cutoff) {
+			os.Remove(partial)
+		}
+	}
+}
+
+// check returns an error if an offer is not one we would accept.
+func (fr *fileReceiver) check(ctx *context.T, offer vdl.FileOffer) error {
+	switch name := offer.Name; {
+	case offer.Id == "" || len(offer.Id) > maxFileIDLength:
+		return verror.New(verror.ErrBadArg, ctx, "transfer ID")
+	case name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) || name != filepath.Base(name):
+		return verror.New(verror.ErrBadArg, ctx, fmt.Sprintf("file name %q", name))
+	case offer.Size < 0:
+		return verror.New(verror.ErrBadArg, ctx, "file size")
+	case offer.Size > fr.maxSize:
+		return verror.New(verror.ErrBadArg, ctx, fmt.Sprintf("file larger than %d bytes", fr.maxSize))
+	case len(offer.Sha256) != sha256.Size:
+		return verror.New(verror.ErrBadArg, ctx, "file hash")
+	}
+	return nil
+}
+
+// receive receives a file offered by the sender with the given blessings.
+// Once the user accepts the file, it is received into a partial file, which
+// is renamed once the whole file has been received and verified.  The partial
+// file is kept if the transfer is interrupted, so that it can be resumed, for
+// up to maxPartialAge.
+func (fr *fileReceiver) receive(ctx *context.T, senderBlessings []string, offer vdl.FileOffer, stream vdl.ChatSendFileServerStream) error {
+	if err := fr.check(ctx, offer); err != nil {
+		return err
+	}
+	key := strings.Join(senderBlessings, ",") + "/" + offer.Id + "/" + hex.EncodeToString(offer.Sha256)
+	fr.mu.Lock()
+	if fr.active[key] {
+		fr.mu.Unlock()
+		return verror.New(verror.ErrExist, ctx, "transfer "+offer.Id)
+	}
+	fr.removeStale()
+	fr.active[key] = true
+	_, accepted := fr.accepted[key]
+	fr.mu.Unlock()
+	defer func() {
+		fr.mu.Lock()
+		delete(fr.active, key)
+		fr.mu.Unlock()
+	}()
+
+	sender := firstShortName(senderBlessings)
+	if !accepted {
+		if err := fr.ask(ctx, FileOffer{
+			ID:              offer.Id,
+			Name:            offer.Name,
+			Size:            offer.Size,
+			Sender:          sender,
+			SenderBlessings: senderBlessings,
+			Expires:         time.Now().Add(fr.timeout),
+			decision:        make(chan bool, 1),
+		}); err != nil {
+			return err
+		}
+		fr.mu.Lock()
+		fr.accepted[key] = time.Now()
+		fr.mu.Unlock()
+	}
+
+	r := &transferReporter{transfers: fr.transfers, done: fr.done}
+	t := FileTransfer{ID: offer.Id, Name: offer.Name, Peer: sender, PeerBlessings: senderBlessings, Incoming: true, Size: offer.Size}
+	path, err := fr.receiveTo(ctx, key, offer, stream, r, &t)
+	if err != nil {
+		t.Err = err
+		r.finish(t)
+		return err
+	}
+	fr.mu.Lock()
+	delete(fr.accepted, key)
+	fr.mu.Unlock()
+	t.Path = path
+	t.Complete = true
+	r.finish(t)
+	return nil
+}
+
+// ask offers a file to the user, and returns an error unless they accept it
+// in time.
+func (fr *fileReceiver) ask(ctx *context.T, offer FileOffer) error {
+	select {
+	case fr.offers <- offer:
+	default:
+		return verror.New(verror.ErrLimitExceeded, ctx, "file offers")
+	}
+	timer := time.NewTimer(fr.timeout)
+	defer timer.Stop()
+	select {
+	case accept := <-offer.decision:
+		if !accept {
+			return verror.New(verror.ErrNoAccess, ctx, offer.Name+" rejected")
+		}
+		return nil
+	case <-timer.C:
+		// Accepting the offer from now on does nothing.
+		offer.Reject()
+		return verror.New(verror.ErrNoAccess, ctx, "offer of "+offer.Name+" expired")
+	case <-ctx.Done():
+		offer.Reject()
+		return verror.New(verror.ErrCanceled, ctx)
+	}
+}
+
+// discard removes the partial file of a transfer that cannot be resumed, and
+// forgets that the user accepted it.
+func (fr *fileReceiver) discard(key, partial string) {
+	os.Remove(partial)
+	fr.mu.Lock()
+	delete(fr.accepted, key)
+	fr.mu.Unlock()
+}
+
+// receiveTo receives the rest of a file into its partial file, and moves it
+// into the download directory once it is verified.  It returns the path of the
+// file.
+func (fr *fileReceiver) receiveTo(ctx *context.T, key string, offer vdl.FileOffer, stream vdl.ChatSendFileServerStream, r *transferReporter, t *FileTransfer) (string, error) {
+	if err := os.MkdirAll(fr.dir, 0700); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	partial := filepath.Join(fr.dir, partialPrefix+hex.EncodeToString(sum[:16]))
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > offer.Size {
+		// The partial file is not of this file after all.
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if err := stream.SendStream().Send(offset); err != nil {
+		return "", err
+	}
+	t.Done = offset
+	r.progress(*t)
+	rs := stream.RecvStream()
+	for rs.Advance() {
+		chunk := rs.Value()
+		if int64(len(chunk)) > offer.Size-t.Done {
+			fr.discard(key, partial)
+			return "", verror.New(verror.ErrBadArg, ctx, "file larger than offered")
+		}
+		if _, err := f.Write(chunk); err != nil {
+			return "", err
+		}
+		t.Done += int64(len(chunk))
+		r.progress(*t)
+	}
+	if err := rs.Err(); err != nil {
+		return "", err
+	}
+	if t.Done != offer.Size {
+		return "", verror.New(verror.ErrBadArg, ctx, "file smaller than offered")
+	}
+
+	// The file may have been received over several calls, so the whole of
+	// it is hashed again.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(h.Sum(nil), offer.Sha256) {
+		fr.discard(key, partial)
+		return "", verror.New(verror.ErrBadArg, ctx, "file does not match its hash")
+	}
+	return moveToUniqueName(partial, fr.dir, offer.Name)
+}
+
+// moveToUniqueName moves the file src into dir under the given name, numbering
+// the name if a file with it exists, e.g. "notes (1).txt", and returns its new
+// path.  The name is claimed by creating the file exclusively before src is
+// moved over it, so that files with the same name received at the same time do
+// not overwrite each other.
+func moveToUniqueName(src, dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			if err := os.Rename(src, path); err != nil {
+				os.Remove(path)
+				return "", err
+			}
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// SendFile is called by members to send us a file.
+func (cs *chatServerMethods) SendFile(ctx *context.T, call vdl.ChatSendFileServerCall, offer vdl.FileOffer) error {
+	if cs.files == nil {
+		return verror.New(verror.ErrNoExist, ctx, "file transfers")
+	}
+	remoteb, _ := security.RemoteBlessingNames(ctx, call.Security())
+	if cs.blocked != nil && cs.blocked(remoteb) {
+		// The sender cannot tell this apart from a rejection.
+		return verror.New(verror.ErrNoAccess, ctx, offer.Name+" rejected")
+	}
+	return cs.files.receive(ctx, remoteb, offer, call)
+}
+
+// FileOffers returns the channel that emits the files that members offer to
+// send us.  Files are only offered if the channel was created with
+// WithDownloadDir.  Offers that are not read are refused.
+func (cr *Channel) FileOffers() <-chan FileOffer {
+	return cr.offers
+}
+
+// FileTransfers returns the channel that emits the state of the files we are
+// sending and receiving, whenever it changes.
+func (cr *Channel) FileTransfers() <-chan FileTransfer {
+	return cr.transfers
+}
+
+// SendFile offers the file at path to the member with the given blessing name
+// or short name, and sends it in the background once they accept it.
+// Transient failures are retried, resuming the transfer where it stopped.  It
+// returns the transfer as it starts, or an error if the file cannot be read or
+// the name does not identify a member, as for Send.
+func (cr *Channel) SendFile(name, path string) (FileTransfer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileTransfer{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return FileTransfer{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return FileTransfer{}, verror.New(verror.ErrBadArg, cr.ctx, path+" is not a file")
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return FileTransfer{}, err
+	}
+	offer := vdl.FileOffer{
+		Id:     NewMessageID(),
+		Name:   filepath.Base(path),
+		Size:   fi.Size(),
+		Sha256: h.Sum(nil),
+	}
+
+	cr.mu.Lock()
+	recipients, err := cr.recipients(name)
+	cr.mu.Unlock()
+	if err != nil {
+		return FileTransfer{}, err
+	}
+	t := FileTransfer{ID: offer.Id, Name: offer.Name, Peer: recipients[0].Name, PeerBlessings: recipients[0].Blessings, Size: offer.Size}
+	go cr.sendFileTo(recipients[0], path, offer, t)
+	return t, nil
+}
+
+// sendFileTo sends a file to a member, retrying transient failures.
+func (cr *Channel) sendFileTo(member *Member, path string, offer vdl.FileOffer, t FileTransfer) {
+	r := &transferReporter{transfers: cr.transfers, done: cr.ctx.Done()}
+	backoff := initialSendBackoff
+	for attempt := 1; ; attempt++ {
+		err := cr.sendFileOnce(member, path, offer, r, &t)
+		if err == nil {
+			t.Complete = true
+			r.finish(t)
+			return
+		}
+		if attempt == maxSendAttempts || !retryFileTransfer(err) {
+			t.Err = err
+			r.finish(t)
+			return
+		}
+		select {
+		case <-cr.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryFileTransfer returns true if a transfer that failed with err may
+// succeed if it is tried again.  A rejected or expired offer is final, since
+// offering the file again would ask the user again.
+func retryFileTransfer(err error) bool {
+	return isTransient(err) && verror.ErrorID(err) != verror.ErrNoAccess.ID
+}
+
+// sendFileOnce makes a single attempt to send a file to a member, from the
+// offset that the member asks for.
+func (cr *Channel) sendFileOnce(member *Member, path string, offer vdl.FileOffer, r *transferReporter, t *FileTransfer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The call waits for the user to accept the file, and then for the
+	// file to be sent at the slowest rate we allow.
+	timeout := fileOfferTimeout + time.Duration(offer.Size/minFileRate+1)*time.Second
+	ctx, cancel := context.WithTimeout(cr.ctx, timeout)
+	defer cancel()
+	call, err := vdl.ChatClient(member.Path).SendFile(ctx, offer, callOptsFor(member.Blessings)...)
+	if err != nil {
+		return err
+	}
+	return sendFileStream(ctx, call, f, offer, r, t)
+}
+
+// sendFileStream sends a file on the stream of a SendFile call, from the offset
+// that the recipient asks for, and finishes the call.
+func sendFileStream(ctx *context.T, call vdl.ChatSendFileClientCall, f io.ReadSeeker, offer vdl.FileOffer, r *transferReporter, t *FileTransfer) error {
+	rs := call.RecvStream()
+	if !rs.Advance() {
+		if err := call.Finish(); err != nil {
+			return err
+		}
+		if err := rs.Err(); err != nil {
+			return err
+		}
+		return verror.New(verror.ErrBadProtocol, ctx, "no offset")
+	}
+	offset := rs.Value()
+	if offset < 0 || offset > offer.Size {
+		call.Finish()
+		return verror.New(verror.ErrBadProtocol, ctx, fmt.Sprintf("offset %d", offset))
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		call.Finish()
+		return err
+	}
+	t.Done = offset
+	r.progress(*t)
+
+	// The file is sent as it was offered, even if it grew since.
+	in := io.LimitReader(f, offer.Size-offset)
+	ss := call.SendStream()
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if err := ss.Send(buf[:n]); err != nil {
+				// The error the recipient returned, if any, tells
+				// why the stream broke.
+				if ferr := call.Finish(); ferr != nil {
+					return ferr
+				}
+				return err
+			}
+			t.Done += int64(n)
+			r.progress(*t)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			call.Finish()
+			return err
+		}
+	}
+	return call.Finish()
+}
@@ -0,0 +1,325 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+	"v.io/x/ref/test"
+)
+
+// fakeFileStream is the stream of a SendFile call, which sends the given
+// chunks and then fails with err, if it is set.
+type fakeFileStream struct {
+	chunks  [][]byte
+	err     error
+	offsets []int64
+	next    []byte
+}
+
+func (s *fakeFileStream) RecvStream() interface {
+	Advance() bool
+	Value() []byte
+	Err() error
+} {
+	return s
+}
+
+func (s *fakeFileStream) SendStream() interface {
+	Send(item int64) error
+} {
+	return s
+}
+
+func (s *fakeFileStream) Advance() bool {
+	if len(s.chunks) == 0 {
+		return false
+	}
+	s.next, s.chunks = s.chunks[0], s.chunks[1:]
+	return true
+}
+
+func (s *fakeFileStream) Value() []byte      { return s.next }
+func (s *fakeFileStream) Err() error         { return s.err }
+func (s *fakeFileStream) Send(o int64) error { s.offsets = append(s.offsets, o); return nil }
+
+// fakeFileCall is the client side of a SendFile call, whose recipient asks for
+// the file from offset, and then fails with err, if it is set.
+type fakeFileCall struct {
+	offset   int64
+	advanced bool
+	err      error
+	received []byte
+}
+
+func (c *fakeFileCall) RecvStream() interface {
+	Advance() bool
+	Value() int64
+	Err() error
+} {
+	return c
+}
+
+func (c *fakeFileCall) SendStream() interface {
+	Send(item []byte) error
+	Close() error
+} {
+	return c
+}
+
+func (c *fakeFileCall) Advance() bool {
+	if c.advanced {
+		return false
+	}
+	c.advanced = true
+	return true
+}
+
+func (c *fakeFileCall) Value() int64 { return c.offset }
+func (c *fakeFileCall) Err() error   { return nil }
+func (c *fakeFileCall) Close() error { return nil }
+func (c *fakeFileCall) Finish() error {
+	return c.err
+}
+
+func (c *fakeFileCall) Send(chunk []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.received = append(c.received, chunk...)
+	return nil
+}
+
+func TestReceiveFile(t *testing.T) {
+	ctx, shutdown := test.V23Init()
+	defer shutdown()
+	dir, err := ioutil.TempDir("", "chat-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	offers := make(chan FileOffer, fileQueueSize)
+	transfers := make(chan FileTransfer, 100)
+	fr := newFileReceiver(dir, offers, transfers, ctx.Done())
+	alice := []string{"dev.v.io:u:alice@example.com"}
+	contents := []byte("hello, world")
+	sum := sha256.Sum256(contents)
+	offer := vdl.FileOffer{Id: "1", Name: "notes.txt", Size: int64(len(contents)), Sha256: sum[:]}
+	decide := func(accept bool) {
+		go func() {
+			o := <-offers
+			if accept {
+				o.Accept()
+			} else {
+				o.Reject()
+			}
+		}()
+	}
+
+	for _, name := range []string{"", "../notes.txt", "a/notes.txt", ".partial-notes"} {
+		bad := offer
+		bad.Name = name
+		if err := fr.receive(ctx, alice, bad, &fakeFileStream{}); verror.ErrorID(err) != verror.ErrBadArg.ID {
+			t.Errorf("Got error %v for name %q, want ErrBadArg", err, name)
+		}
+	}
+
+	decide(false)
+	if err := fr.receive(ctx, alice, offer, &fakeFileStream{}); verror.ErrorID(err) != verror.ErrNoAccess.ID {
+		t.Errorf("Got error %v, want ErrNoAccess for a rejected file", err)
+	}
+
+	// An interrupted transfer is resumed from where it stopped, without
+	// asking the user again.
+	decide(true)
+	broken := &fakeFileStream{chunks: [][]byte{contents[:5]}, err: verror.New(verror.ErrTimeout, nil)}
+	if err := fr.receive(ctx, alice, offer, broken); err == nil {
+		t.Errorf("Got no error, want the transfer to be interrupted")
+	}
+	resumed := &fakeFileStream{chunks: [][]byte{contents[5:]}}
+	if err := fr.receive(ctx, alice, offer, resumed); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if got, want := resumed.offsets, []int64{5}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Got offsets %v, want %v", got, want)
+	}
+	var last FileTransfer
+	for len(transfers) > 0 {
+		last = <-transfers
+	}
+	if want := filepath.Join(dir, "notes.txt"); !last.Complete || last.Path != want {
+		t.Errorf("Got transfer %+v, want it complete at %s", last, want)
+	}
+	if got, err := ioutil.ReadFile(last.Path); err != nil || string(got) != string(contents) {
+		t.Errorf("Got contents %q (%v), want %q", got, err, contents)
+	}
+
+	// Files are not overwritten, and files that do not match their hash
+	// are discarded.
+	offer.Id = "2"
+	decide(true)
+	if err := fr.receive(ctx, alice, offer, &fakeFileStream{chunks: [][]byte{contents}}); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes (1).txt")); err != nil {
+		t.Errorf("Got %v, want the second file to be numbered", err)
+	}
+	offer.Id = "3"
+	decide(true)
+	if err := fr.receive(ctx, alice, offer, &fakeFileStream{chunks: [][]byte{[]byte("goodbye, all")}}); verror.ErrorID(err) != verror.ErrBadArg.ID {
+		t.Errorf("Got error %v, want ErrBadArg for a corrupted file", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, partialPrefix+"*")); len(files) > 0 {
+		t.Errorf("Got partial files %v, want none", files)
+	}
+}
+
+func TestFileOfferExpires(t *testing.T) {
+	ctx, shutdown := test.V23Init()
+	defer shutdown()
+	offers := make(chan FileOffer, 1)
+	fr := newFileReceiver(os.TempDir(), offers, make(chan FileTransfer, 1), ctx.Done())
+	fr.timeout = 10 * time.Millisecond
+	sum := sha256.Sum256(nil)
+	offer := vdl.FileOffer{Id: "1", Name: "empty", Sha256: sum[:]}
+	if err := fr.receive(ctx, nil, offer, &fakeFileStream{}); verror.ErrorID(err) != verror.ErrNoAccess.ID {
+		t.Errorf("Got error %v, want ErrNoAccess for an expired offer", err)
+	}
+	// Accepting the offer once it expired does nothing.
+	(<-offers).Accept()
+}
+
+func TestRetryFileTransfer(t *testing.T) {
+	tests := []struct {
+		err   error
+		retry bool
+	}{
+		{verror.New(verror.ErrTimeout, nil), true},
+		{verror.New(verror.ErrNoAccess, nil, "notes.txt rejected"), false},
+		{verror.New(verror.ErrNoAccess, nil, "offer of notes.txt expired"), false},
+		{verror.New(verror.ErrBadArg, nil, "file does not match its hash"), false},
+	}
+	for _, test := range tests {
+		if got := retryFileTransfer(test.err); got != test.retry {
+			t.Errorf("Got %v for %v, want %v", got, test.err, test.retry)
+		}
+	}
+}
+
+func TestSendFileStream(t *testing.T) {
+	ctx, shutdown := test.V23Init()
+	defer shutdown()
+	contents := bytes.Repeat([]byte("0123456789"), fileChunkSize/5)
+	offer := vdl.FileOffer{Id: "1", Name: "digits", Size: int64(len(contents))}
+	r := &transferReporter{transfers: make(chan FileTransfer, 100), done: ctx.Done()}
+
+	// The file is sent from the offset the recipient asks for.
+	call := &fakeFileCall{offset: 7}
+	var ft FileTransfer
+	if err := sendFileStream(ctx, call, bytes.NewReader(contents), offer, r, &ft); err != nil {
+		t.Fatalf("sendFileStream failed: %v", err)
+	}
+	if !bytes.Equal(call.received, contents[7:]) {
+		t.Errorf("Got %d bytes, want the %d bytes after the offset", len(call.received), len(contents)-7)
+	}
+	if ft.Done != offer.Size {
+		t.Errorf("Got %d bytes done, want %d", ft.Done, offer.Size)
+	}
+
+	// The error of the recipient is returned rather than that of the
+	// stream.
+	rejected := verror.New(verror.ErrNoAccess, nil, "digits rejected")
+	call = &fakeFileCall{err: rejected}
+	if err := sendFileStream(ctx, call, bytes.NewReader(contents), offer, r, &ft); err != rejected {
+		t.Errorf("Got error %v, want %v", err, rejected)
+	}
+
+	// Offsets beyond the file are refused.
+	call = &fakeFileCall{offset: offer.Size + 1}
+	if err := sendFileStream(ctx, call, bytes.NewReader(contents), offer, r, &ft); verror.ErrorID(err) != verror.ErrBadProtocol.ID {
+		t.Errorf("Got error %v, want ErrBadProtocol", err)
+	}
+}
+
+func TestMoveToUniqueName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files with the same name moved at the same time all keep their
+	// contents.
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("%s%d", partialPrefix, i))
+		if err := ioutil.WriteFile(src, []byte{byte(i)}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := moveToUniqueName(src, dir, "notes.txt"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	files, _ := filepath.Glob(filepath.Join(dir, "notes*.txt"))
+	seen := make(map[byte]bool)
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		if len(b) == 1 {
+			seen[b[0]] = true
+		}
+	}
+	if len(files) != n || len(seen) != n {
+		t.Errorf("Got files %v with %d distinct contents, want %d", files, len(seen), n)
+	}
+}
+
+func TestRemoveStalePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fr := newFileReceiver(dir, nil, nil, nil)
+	old := time.Now().Add(-maxPartialAge - time.Hour)
+	fr.accepted["old"] = old
+	fr.accepted["new"] = time.Now()
+	stale, fresh := filepath.Join(dir, partialPrefix+"old"), filepath.Join(dir, partialPrefix+"new")
+	for _, f := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	fr.removeStale()
+	if _, ok := fr.accepted["old"]; ok || len(fr.accepted) != 1 {
+		t.Errorf("Got accepted transfers %v, want only the new one", fr.accepted)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Got %v, want the stale partial file to be removed", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Got %v, want the fresh partial file to be kept", err)
+	}
+}
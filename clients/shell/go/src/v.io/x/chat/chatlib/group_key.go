@@ -0,0 +1,552 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/security"
+	"v.io/v23/verror"
+
+	"v.io/x/chat/vdl"
+	"v.io/x/lib/vlog"
+)
+
+// encryptedPlaceholder is the text sent in place of the text of encrypted
+// messages, and displayed for messages that could not be decrypted.
+const encryptedPlaceholder = "[This message is end-to-end encrypted, and cannot be decrypted.]"
+
+const (
+	// maxKeysAwaited is the number of unknown group keys that can be
+	// fetched at once for the messages that were encrypted with them.
+	// Messages encrypted with further keys are not decrypted.
+	maxKeysAwaited = 10
+	// maxMessagesPerKey is the number of messages that can wait for each
+	// key being fetched.  Further messages are not decrypted.
+	maxMessagesPerKey = 100
+)
+
+// groupKey is a symmetric key shared by the members of a channel, that the
+// text of messages is encrypted with.
+type groupKey struct {
+	id    string
+	epoch uint64
+	key   []byte
+}
+
+// newGroupKey generates a random group key with the given epoch.
+func newGroupKey(epoch uint64) (*groupKey, error) {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	return &groupKey{id: NewMessageID(), epoch: epoch, key: key}, nil
+}
+
+// newer returns true if k should be used instead of o to encrypt messages.
+// All members agree on which of two keys is newer.
+func (k *groupKey) newer(o *groupKey) bool {
+	if o == nil || k.epoch != o.epoch {
+		return o == nil || k.epoch > o.epoch
+	}
+	return k.id > o.id
+}
+
+// seal encrypts the text of a message, and replaces it with a placeholder.
+// The ID and channel of the message are authenticated along with the text, so
+// that the ciphertext cannot be moved to another message.
+func (k *groupKey) seal(m *vdl.Message) error {
+	nonce, ciphertext, err := sealBytes(k.key, []byte(m.Text), messageAuthData(m.Id, m.Channel))
+	if err != nil {
+		return err
+	}
+	m.KeyId = k.id
+	m.Nonce = nonce
+	m.Ciphertext = ciphertext
+	m.Text = encryptedPlaceholder
+	return nil
+}
+
+// open decrypts the text of a message sealed with k.
+func (k *groupKey) open(m Message) (string, error) {
+	text, err := openBytes(k.key, m.Nonce, m.Ciphertext, messageAuthData(m.ID, m.Channel))
+	return string(text), err
+}
+
+func messageAuthData(id, channel string) []byte {
+	return []byte(id + "\x00" + channel)
+}
+
+// sealBytes encrypts plaintext with AES-256-GCM, using a random nonce.
+func sealBytes(key, plaintext, authData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, authData), nil
+}
+
+// openBytes decrypts ciphertext encrypted by sealBytes.
+func openBytes(key, nonce, ciphertext, authData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, verror.New(verror.ErrBadArg, nil, "nonce")
+	}
+	return aead.Open(nil, nonce, ciphertext, authData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// groupKeys holds the group keys of a channel that we know of, and grants them
+// to other members of the channel.
+type groupKeys struct {
+	// path is the path of the channel.
+	path string
+	// isMember returns true if a principal with the given blessing names is
+	// a member of the channel.
+	isMember func(blessingNames []string) bool
+	// Mutex to protect keys, current and waiting.
+	mu   sync.Mutex
+	keys map[string]*groupKey
+	// current is the newest key we know of, which messages are encrypted
+	// with.  It is nil if we do not know of any key yet.
+	current *groupKey
+	// waiting holds the messages waiting for a key being fetched, by key
+	// ID.
+	waiting map[string][]Message
+}
+
+func newGroupKeys(path string, isMember func([]string) bool) *groupKeys {
+	return &groupKeys{
+		path:     path,
+		isMember: isMember,
+		keys:     make(map[string]*groupKey),
+		waiting:  make(map[string][]Message),
+	}
+}
+
+// await adds a message to those waiting for the key it was encrypted with.  It
+// returns false if too many keys or messages are awaited already.  It also
+// returns whether the key should be fetched, i.e. whether the message is the
+// first to wait for it.
+func (gk *groupKeys) await(m Message) (waiting, fetch bool) {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	msgs, ok := gk.waiting[m.KeyID]
+	switch {
+	case !ok && len(gk.waiting) >= maxKeysAwaited:
+		return false, false
+	case len(msgs) >= maxMessagesPerKey:
+		return false, false
+	}
+	gk.waiting[m.KeyID] = append(msgs, m)
+	return true, !ok
+}
+
+// takeWaiting removes the messages waiting for a key, and returns them.
+func (gk *groupKeys) takeWaiting(keyID string) []Message {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	msgs := gk.waiting[keyID]
+	delete(gk.waiting, keyID)
+	return msgs
+}
+
+// get returns the key with the given ID, or nil if we do not know of it.
+func (gk *groupKeys) get(id string) *groupKey {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	return gk.keys[id]
+}
+
+// currentKey returns the key that messages are encrypted with, or nil if we do
+// not know of any key yet.
+func (gk *groupKeys) currentKey() *groupKey {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	return gk.current
+}
+
+// add remembers a key.  The key becomes the current key if it is newer than
+// the current key.
+func (gk *groupKeys) add(k *groupKey) {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	gk.keys[k.id] = k
+	if k.newer(gk.current) {
+		gk.current = k
+	}
+}
+
+// rotate replaces the current key with a new one, with a higher epoch.  Keys
+// are rotated when members leave, so that they cannot read the messages sent
+// after they left.
+func (gk *groupKeys) rotate() (*groupKey, error) {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	var epoch uint64
+	if gk.current != nil {
+		epoch = gk.current.epoch
+	}
+	k, err := newGroupKey(epoch + 1)
+	if err != nil {
+		return nil, err
+	}
+	gk.keys[k.id] = k
+	gk.current = k
+	return k, nil
+}
+
+// grant encrypts a group key for the member that requested it.  The request
+// must be signed by the principal that the blessings of the requester are
+// bound to, and the grant is signed by our principal, so that neither key
+// exchange public key can be replaced by somebody else.
+func (gk *groupKeys) grant(ctx *context.T, call security.Call, req vdl.GroupKeyRequest) (vdl.GroupKeyGrant, error) {
+	remoteb, _ := security.RemoteBlessingNames(ctx, call)
+	if !gk.isMember(remoteb) {
+		return vdl.GroupKeyGrant{}, verror.New(verror.ErrNoAccess, ctx, "not a member of "+gk.path)
+	}
+	if !req.Signature.Verify(call.RemoteBlessings().PublicKey(), keyRequestBytes(gk.path, req)) {
+		return vdl.GroupKeyGrant{}, verror.New(verror.ErrNoAccess, ctx, "bad signature")
+	}
+	var k *groupKey
+	if req.KeyId == "" {
+		k = gk.currentKey()
+	} else {
+		k = gk.get(req.KeyId)
+	}
+	if k == nil {
+		return vdl.GroupKeyGrant{}, verror.New(verror.ErrNoExist, ctx, "group key")
+	}
+
+	kx, err := newKeyExchange()
+	if err != nil {
+		return vdl.GroupKeyGrant{}, err
+	}
+	shared, err := kx.sharedKey(req.PublicKey, gk.path)
+	if err != nil {
+		return vdl.GroupKeyGrant{}, verror.New(verror.ErrBadArg, ctx, err)
+	}
+	nonce, wrapped, err := sealBytes(shared, k.key, []byte(k.id))
+	if err != nil {
+		return vdl.GroupKeyGrant{}, err
+	}
+	g := vdl.GroupKeyGrant{
+		KeyId:      k.id,
+		Epoch:      k.epoch,
+		PublicKey:  kx.public,
+		Nonce:      nonce,
+		WrappedKey: wrapped,
+	}
+	if g.Signature, err = call.LocalPrincipal().Sign(keyGrantBytes(gk.path, req.PublicKey, g)); err != nil {
+		return vdl.GroupKeyGrant{}, err
+	}
+	return g, nil
+}
+
+// keyExchange is an ephemeral ECDH key pair on P-256, used to encrypt a group
+// key for a single member.  Its public key is sent in uncompressed form.
+type keyExchange struct {
+	private *ecdh.PrivateKey
+	public  []byte
+}
+
+func newKeyExchange() (*keyExchange, error) {
+	private, err := ecdh.P256().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &keyExchange{private: private, public: private.PublicKey().Bytes()}, nil
+}
+
+// sharedKey returns the symmetric key shared by kx and the key pair with the
+// given public key, for use in the given channel.
+func (kx *keyExchange) sharedKey(peerPublic []byte, path string) ([]byte, error) {
+	peer, err := ecdh.P256().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, verror.New(verror.ErrBadArg, nil, "public key")
+	}
+	secret, err := kx.private.ECDH(peer)
+	if err != nil {
+		return nil, verror.New(verror.ErrBadArg, nil, "public key")
+	}
+	h := sha256.New()
+	h.Write(secret)
+	h.Write([]byte("v.io/x/chat group key\x00" + path))
+	return h.Sum(nil), nil
+}
+
+// keyRequestBytes returns the bytes signed by the requester of a group key.
+func keyRequestBytes(path string, req vdl.GroupKeyRequest) []byte {
+	var b bytes.Buffer
+	writeField(&b, []byte("v.io/x/chat GroupKeyRequest"))
+	writeField(&b, []byte(path))
+	writeField(&b, []byte(req.KeyId))
+	writeField(&b, req.PublicKey)
+	return b.Bytes()
+}
+
+// keyGrantBytes returns the bytes signed by the granter of a group key.  The
+// public key of the request is included, so that a grant cannot be replayed
+// in answer to another request.
+func keyGrantBytes(path string, requestPublicKey []byte, g vdl.GroupKeyGrant) []byte {
+	var b bytes.Buffer
+	writeField(&b, []byte("v.io/x/chat GroupKeyGrant"))
+	writeField(&b, []byte(path))
+	writeField(&b, requestPublicKey)
+	writeField(&b, []byte(g.KeyId))
+	binary.Write(&b, binary.BigEndian, g.Epoch)
+	writeField(&b, g.PublicKey)
+	writeField(&b, g.Nonce)
+	writeField(&b, g.WrappedKey)
+	return b.Bytes()
+}
+
+// writeField writes a length-prefixed field to b.
+func writeField(b *bytes.Buffer, field []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(field)))
+	b.Write(field)
+}
+
+// openGrant decrypts the group key in a grant made in answer to a request for
+// which kx was generated.  The signature of the grant must already have been
+// verified.
+func (kx *keyExchange) openGrant(path string, g vdl.GroupKeyGrant) (*groupKey, error) {
+	shared, err := kx.sharedKey(g.PublicKey, path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openBytes(shared, g.Nonce, g.WrappedKey, []byte(g.KeyId))
+	if err != nil {
+		return nil, err
+	}
+	return &groupKey{id: g.KeyId, epoch: g.Epoch, key: key}, nil
+}
+
+// keyRotationDelay is how long members wait for the current key to be rotated
+// by another member, after a member left the channel.
+const keyRotationDelay = 2 * time.Second
+
+// isMember returns true if one of the given blessing names is the blessing of
+// a member of the channel, i.e. of a principal mounted under it.  Group keys
+// are granted to any principal that the ACL of the channel lets mount there,
+// so end-to-end encryption protects messages from the mounttable and from the
+// network, not from principals allowed to join the channel.
+func (cr *Channel) isMember(blessingNames []string) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for _, member := range cr.members {
+		for _, b := range member.Blessings {
+			for _, name := range blessingNames {
+				if b == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fetchGroupKey asks the member mounted at name for a group key, and adds it to
+// cr.keys.  If keyID is empty, the member's current key is requested.  The
+// member must have one of the given blessings.
+func (cr *Channel) fetchGroupKey(name string, blessings []string, keyID string) (*groupKey, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, cr.callTimeout)
+	defer cancel()
+
+	kx, err := newKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	req := vdl.GroupKeyRequest{KeyId: keyID, PublicKey: kx.public}
+	if req.Signature, err = v23.GetPrincipal(ctx).Sign(keyRequestBytes(cr.path, req)); err != nil {
+		return nil, err
+	}
+	call, err := v23.GetClient(ctx).StartCall(ctx, name, "GetGroupKey", []interface{}{req}, callOptsFor(blessings)...)
+	if err != nil {
+		return nil, err
+	}
+	_, serverBlessings := call.RemoteBlessings()
+	var g vdl.GroupKeyGrant
+	if err := call.Finish(&g); err != nil {
+		return nil, err
+	}
+	if !g.Signature.Verify(serverBlessings.PublicKey(), keyGrantBytes(cr.path, req.PublicKey, g)) {
+		return nil, verror.New(verror.ErrNoAccess, ctx, "bad signature on group key from "+name)
+	}
+	if keyID != "" && g.KeyId != keyID {
+		return nil, verror.New(verror.ErrNoExist, ctx, "group key "+keyID)
+	}
+	k, err := kx.openGrant(cr.path, g)
+	if err != nil {
+		return nil, err
+	}
+	cr.keys.add(k)
+	return k, nil
+}
+
+// decrypt decrypts the text of an encrypted message.  If we do not know the
+// key it was encrypted with and the message comes from the history of the
+// given member, the key is fetched from the sender of the message, or else
+// from that member.  Keys of messages sent to us are fetched in the
+// background by awaitGroupKey instead.  If the message cannot be decrypted,
+// its text is left as the placeholder, and DecryptFailed is set.
+func (cr *Channel) decrypt(m *Message, from *Member) {
+	if m.KeyID == "" {
+		return
+	}
+	k := cr.keys.get(m.KeyID)
+	if k == nil && from != nil && m.ReplyTo != "" {
+		k, _ = cr.fetchGroupKey(m.ReplyTo, m.SenderBlessings, m.KeyID)
+	}
+	if k == nil && from != nil {
+		k, _ = cr.fetchGroupKey(from.Path, from.Blessings, m.KeyID)
+	}
+	openMessage(m, k)
+}
+
+// openMessage decrypts the text of an encrypted message with k, which is nil
+// if we do not know the key.  If the message cannot be decrypted, its text is
+// left as the placeholder, and DecryptFailed is set.
+func openMessage(m *Message, k *groupKey) {
+	if k != nil {
+		if text, err := k.open(*m); err == nil {
+			m.Text = text
+			m.DecryptFailed = false
+			return
+		}
+	}
+	m.Text = encryptedPlaceholder
+	m.DecryptFailed = true
+}
+
+// awaitGroupKey holds back a message sent to us that is encrypted with a key
+// we do not know, and fetches the key from its sender in the background, so
+// that a sender who does not answer cannot hold up the messages of other
+// members.  Once the key is fetched, or cannot be, the messages waiting for it
+// are decrypted if possible and passed to deliver.  It returns false if the
+// message does not wait, and should be delivered as it is.
+func (cr *Channel) awaitGroupKey(m *Message, deliver func(Message)) bool {
+	if m.KeyID == "" || !m.DecryptFailed || m.ReplyTo == "" {
+		return false
+	}
+	if k := cr.keys.get(m.KeyID); k != nil {
+		// The key arrived since the message was prepared.
+		openMessage(m, k)
+		return false
+	}
+	waiting, fetch := cr.keys.await(*m)
+	if fetch {
+		go func() {
+			k, _ := cr.fetchGroupKey(m.ReplyTo, m.SenderBlessings, m.KeyID)
+			for _, w := range cr.keys.takeWaiting(m.KeyID) {
+				openMessage(&w, k)
+				deliver(w)
+			}
+		}()
+	}
+	return waiting
+}
+
+// encryptMessage encrypts the text of a message we send, if encryption is
+// turned on for the channel.  If no member has a group key yet, we generate
+// the first one.
+func (cr *Channel) encryptMessage(m *vdl.Message) error {
+	if !cr.encrypt {
+		return nil
+	}
+	k := cr.keys.currentKey()
+	if k == nil {
+		var err error
+		if k, err = cr.keys.rotate(); err != nil {
+			return err
+		}
+	}
+	return k.seal(m)
+}
+
+// joinGroupKey fetches the current group key from some of the members of the
+// channel, and uses the newest one.  If none of them has a key, we generate
+// the first one.
+func (cr *Channel) joinGroupKey() {
+	members, err := cr.Members()
+	if err != nil {
+		return
+	}
+	asked := 0
+	for _, i := range rand.Perm(len(members)) {
+		if asked == historySyncPeers {
+			break
+		}
+		if m := members[i]; m.Path != cr.name {
+			asked++
+			cr.fetchGroupKey(m.Path, m.Blessings, "")
+		}
+	}
+	if cr.keys.currentKey() == nil {
+		if _, err := cr.keys.rotate(); err != nil {
+			vlog.Errorf("Error generating group key for %v: %v", cr.path, err)
+		}
+	}
+}
+
+// rotateGroupKey replaces the group key after members left the channel.  The
+// key is rotated by the remaining member with the lowest path, and the other
+// members fetch the new key from it.  If that fails, they rotate the key
+// themselves.  Members that rotated the key at the same time agree on the
+// newest key once they see each other's messages.
+func (cr *Channel) rotateGroupKey(members []*Member) {
+	if len(members) == 0 {
+		return
+	}
+	old := cr.keys.currentKey()
+	leader := members[0]
+	for _, m := range members[1:] {
+		if m.Path < leader.Path {
+			leader = m
+		}
+	}
+	if leader.Path != cr.name {
+		select {
+		case <-time.After(keyRotationDelay):
+		case <-cr.ctx.Done():
+			return
+		}
+		if k, err := cr.fetchGroupKey(leader.Path, leader.Blessings, ""); err == nil && k.newer(old) {
+			return
+		}
+	}
+	if k := cr.keys.currentKey(); k != old {
+		// We already have a newer key.
+		return
+	}
+	if _, err := cr.keys.rotate(); err != nil {
+		vlog.Errorf("Error rotating group key for %v: %v", cr.path, err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"testing"
+
+	"v.io/x/chat/vdl"
+)
+
+func TestGroupKeySealOpen(t *testing.T) {
+	k, err := newGroupKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vdl.Message{Id: "1", Channel: "path/to/channel", Text: "hello"}
+	if err := k.seal(&m); err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	if m.Text != encryptedPlaceholder || m.KeyId != k.id {
+		t.Errorf("Got Text %q, KeyId %q, want %q, %q", m.Text, m.KeyId, encryptedPlaceholder, k.id)
+	}
+	if text, err := k.open(newMessage(nil, m)); err != nil || text != "hello" {
+		t.Errorf("open = %q, %v, want hello, nil", text, err)
+	}
+
+	// The ciphertext cannot be moved to another message.
+	moved := m
+	moved.Id = "2"
+	if _, err := k.open(newMessage(nil, moved)); err == nil {
+		t.Errorf("open of a message with another ID should fail")
+	}
+
+	other, _ := newGroupKey(1)
+	if _, err := other.open(newMessage(nil, m)); err == nil {
+		t.Errorf("open with another key should fail")
+	}
+}
+
+func TestGroupKeysRotate(t *testing.T) {
+	gk := newGroupKeys("path/to/channel", func([]string) bool { return true })
+	first, err := gk.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := gk.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.epoch != first.epoch+1 || gk.currentKey() != second {
+		t.Errorf("Got epochs %d, %d and current %v, want consecutive epochs and the second key", first.epoch, second.epoch, gk.currentKey().id)
+	}
+	// Old keys are kept, so that old messages can still be decrypted.
+	if gk.get(first.id) != first {
+		t.Errorf("The first key was forgotten")
+	}
+	// Older keys never replace the current key.
+	gk.add(&groupKey{id: "zzz", epoch: first.epoch})
+	if gk.currentKey() != second {
+		t.Errorf("An older key replaced the current key")
+	}
+	newest := &groupKey{id: "a", epoch: second.epoch + 1}
+	gk.add(newest)
+	if gk.currentKey() != newest {
+		t.Errorf("A newer key did not replace the current key")
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	const path = "path/to/channel"
+	requester, err := newKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	granter, err := newKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := newGroupKey(3)
+
+	shared, err := granter.sharedKey(requester.public, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, wrapped, err := sealBytes(shared, k.key, []byte(k.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := vdl.GroupKeyGrant{KeyId: k.id, Epoch: k.epoch, PublicKey: granter.public, Nonce: nonce, WrappedKey: wrapped}
+	got, err := requester.openGrant(path, g)
+	if err != nil {
+		t.Fatalf("openGrant failed: %v", err)
+	}
+	if got.id != k.id || got.epoch != k.epoch || !bytes.Equal(got.key, k.key) {
+		t.Errorf("Got key %v, want %v", got, k)
+	}
+
+	// The shared key is bound to the channel.
+	if _, err := requester.openGrant("another/channel", g); err == nil {
+		t.Errorf("openGrant for another channel should fail")
+	}
+	if _, err := requester.sharedKey([]byte("not a point"), path); err == nil {
+		t.Errorf("sharedKey with a bad public key should fail")
+	}
+}
+
+func TestGroupKeysAwait(t *testing.T) {
+	gk := newGroupKeys("path/to/channel", func([]string) bool { return true })
+	// Only the first message waiting for a key fetches it.
+	if waiting, fetch := gk.await(Message{ID: "1", KeyID: "k"}); !waiting || !fetch {
+		t.Errorf("Got waiting %v, fetch %v, want both", waiting, fetch)
+	}
+	if waiting, fetch := gk.await(Message{ID: "2", KeyID: "k"}); !waiting || fetch {
+		t.Errorf("Got waiting %v, fetch %v, want to wait without fetching", waiting, fetch)
+	}
+	for i := 2; i < maxMessagesPerKey; i++ {
+		gk.await(Message{KeyID: "k"})
+	}
+	if waiting, _ := gk.await(Message{KeyID: "k"}); waiting {
+		t.Errorf("Got more than %d messages waiting for a key", maxMessagesPerKey)
+	}
+	for i := 1; i < maxKeysAwaited; i++ {
+		gk.await(Message{KeyID: string('a' + rune(i))})
+	}
+	if waiting, _ := gk.await(Message{KeyID: "another"}); waiting {
+		t.Errorf("Got more than %d keys awaited", maxKeysAwaited)
+	}
+	if got := gk.takeWaiting("k"); len(got) != maxMessagesPerKey || got[0].ID != "1" {
+		t.Errorf("Got %d messages, want %d in order", len(got), maxMessagesPerKey)
+	}
+	// Once taken, the key can be awaited again.
+	if _, fetch := gk.await(Message{KeyID: "another"}); !fetch {
+		t.Errorf("Got no fetch, want the key to be fetched")
+	}
+}
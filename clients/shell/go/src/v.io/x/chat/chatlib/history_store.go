@@ -0,0 +1,307 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historySegmentSize is the number of messages written to a segment file
+// before a new one is started.  Retention limits are applied a whole segment
+// at a time.
+const historySegmentSize = 500
+
+// historyStore is an append-only on-disk store of the messages sent to a
+// channel.  Messages are written as JSON lines to a sequence of segment files,
+// and every write is fsync'd before append returns.  A segment whose last line
+// was only partially written when the client crashed is read up to that line.
+//
+// All retained messages are also kept in memory.
+type historyStore struct {
+	// Mutex to protect everything below.
+	mu  sync.Mutex
+	dir string
+	// Retention limits.  Zero means no limit.
+	maxMessages int
+	maxAge      time.Duration
+	// segments holds the segment files, oldest first.  The last one is
+	// the one being written to, if current is not nil.
+	segments []*historySegment
+	current  *os.File
+	// messages holds the messages in all segments, in the order they were
+	// written.
+	messages []Message
+	ids      map[string]bool
+}
+
+// historySegment is a single segment file of a historyStore.
+type historySegment struct {
+	seq   int
+	count int
+	// newest is the timestamp of the newest message in the segment.
+	newest time.Time
+}
+
+func (seg *historySegment) fileName() string {
+	return fmt.Sprintf("%010d.log", seg.seq)
+}
+
+// historyStoreDir returns the directory inside root in which the history of
+// the channel with the given path on the given mounttable is stored.
+func historyStoreDir(root, mounttable, path string) string {
+	key := sha256.Sum256([]byte(mounttable + "\x00" + path))
+	return filepath.Join(root, fmt.Sprintf("%x", key))
+}
+
+// openHistoryStore opens the history store for a channel, creating it if it
+// does not exist, and applies the retention limits to it.
+func openHistoryStore(root, mounttable, path string, maxMessages int, maxAge time.Duration) (*historyStore, error) {
+	dir := historyStoreDir(root, mounttable, path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &historyStore{
+		dir:         dir,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		ids:         make(map[string]bool),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.prune(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads all segments in the store directory.
+func (s *historyStore) load() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var seqs []int
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".log") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(info.Name(), ".log"))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		seg := &historySegment{seq: seq}
+		if err := s.loadSegment(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return nil
+}
+
+func (s *historyStore) loadSegment(seg *historySegment) error {
+	f, err := os.Open(filepath.Join(s.dir, seg.fileName()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			// The rest of the segment was not written completely.
+			break
+		}
+		s.add(seg, m)
+	}
+	return nil
+}
+
+// add records a message in memory as being part of seg.  s.mu must be held,
+// except while loading.
+func (s *historyStore) add(seg *historySegment, m Message) {
+	s.messages = append(s.messages, m)
+	s.ids[m.ID] = true
+	seg.count++
+	if m.Timestamp.After(seg.newest) {
+		seg.newest = m.Timestamp
+	}
+}
+
+// append writes a message to the store.  Messages with an ID that is already
+// in the store are ignored, and false is returned.
+func (s *historyStore) append(m Message) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[m.ID] {
+		return false, nil
+	}
+	if s.current == nil || s.segments[len(s.segments)-1].count >= historySegmentSize {
+		if err := s.startSegment(); err != nil {
+			return false, err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.current.Write(append(b, '\n')); err != nil {
+		return false, err
+	}
+	if err := s.current.Sync(); err != nil {
+		return false, err
+	}
+	s.add(s.segments[len(s.segments)-1], m)
+	return true, nil
+}
+
+// startSegment closes the current segment, if any, and starts a new one.  The
+// retention limits are applied every time a new segment is started.  s.mu must
+// be held.
+func (s *historyStore) startSegment() error {
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			return err
+		}
+		s.current = nil
+	}
+	if err := s.prune(time.Now()); err != nil {
+		return err
+	}
+	seg := &historySegment{seq: 1}
+	if n := len(s.segments); n > 0 {
+		seg.seq = s.segments[n-1].seq + 1
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, seg.fileName()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// Make sure the new file survives a crash.
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.current = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// prune deletes the oldest segments while they are not needed to keep
+// maxMessages messages, or while all of their messages are older than maxAge.
+// The segment being written to is never deleted.  s.mu must be held, except
+// while opening the store.
+func (s *historyStore) prune(now time.Time) error {
+	total := len(s.messages)
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.current != nil && len(s.segments) == 1 {
+			break
+		}
+		tooMany := s.maxMessages > 0 && total-seg.count >= s.maxMessages
+		tooOld := s.maxAge > 0 && now.Sub(seg.newest) > s.maxAge
+		if !tooMany && !tooOld {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, seg.fileName())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, m := range s.messages[:seg.count] {
+			delete(s.ids, m.ID)
+		}
+		s.messages = s.messages[seg.count:]
+		s.segments = s.segments[1:]
+		total -= seg.count
+	}
+	return nil
+}
+
+// last returns up to n of the most recently written messages, in display
+// order.
+func (s *historyStore) last(n int) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > len(s.messages) {
+		n = len(s.messages)
+	}
+	out := make([]Message, n)
+	copy(out, s.messages[len(s.messages)-n:])
+	sort.Sort(byDisplayOrder(out))
+	return out
+}
+
+// has returns true if a message with the given ID is in the store.
+func (s *historyStore) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+// since returns up to limit of the most recent messages sent after the given
+// time, in display order.
+func (s *historyStore) since(t time.Time, limit int) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Message
+	for i := len(s.messages) - 1; i >= 0 && len(out) < limit; i-- {
+		if m := s.messages[i]; m.Timestamp.After(t) {
+			out = append(out, m)
+		}
+	}
+	sort.Sort(byDisplayOrder(out))
+	return out
+}
+
+// newest returns the timestamp of the newest message in the store, or the
+// zero time if the store is empty.
+func (s *historyStore) newest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var t time.Time
+	for _, seg := range s.segments {
+		if seg.newest.After(t) {
+			t = seg.newest
+		}
+	}
+	return t
+}
+
+// close closes the segment being written to.
+func (s *historyStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+// syncDir fsyncs a directory, so that files created in it are not lost in a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
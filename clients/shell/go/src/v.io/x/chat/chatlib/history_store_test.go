@@ -0,0 +1,138 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStoreReplay(t *testing.T) {
+	root, err := ioutil.TempDir("", "chat-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := openHistoryStore(root, "/mt", "path/to/channel", 0, 0)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		m := Message{ID: fmt.Sprint(i), Text: fmt.Sprintf("message %d", i), Clock: uint64(i + 1), Timestamp: time.Now()}
+		if added, err := s.append(m); err != nil || !added {
+			t.Fatalf("s.append(%v) = %v, %v, want true, nil", m.ID, added, err)
+		}
+	}
+	// Duplicates are not written again.
+	if added, err := s.append(Message{ID: "3"}); err != nil || added {
+		t.Errorf("s.append of a duplicate = %v, %v, want false, nil", added, err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("s.close() failed: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing a message.
+	segs, _ := filepath.Glob(filepath.Join(historyStoreDir(root, "/mt", "path/to/channel"), "*.log"))
+	if len(segs) != 1 {
+		t.Fatalf("Got %d segments, want 1", len(segs))
+	}
+	f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"ID":"5","Te`))
+	f.Close()
+
+	s, err = openHistoryStore(root, "/mt", "path/to/channel", 0, 0)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	defer s.close()
+	got := s.last(3)
+	if len(got) != 3 {
+		t.Fatalf("Got %d messages, want 3", len(got))
+	}
+	for i, m := range got {
+		if want := fmt.Sprint(i + 2); m.ID != want {
+			t.Errorf("Got message %d with ID %v, want %v", i, m.ID, want)
+		}
+	}
+
+	// Other channels have their own history.
+	other, err := openHistoryStore(root, "/mt", "path/to/other", 0, 0)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	defer other.close()
+	if got := other.last(10); len(got) != 0 {
+		t.Errorf("Got %d messages in new channel, want 0", len(got))
+	}
+}
+
+func TestHistoryStoreRetention(t *testing.T) {
+	root, err := ioutil.TempDir("", "chat-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := openHistoryStore(root, "/mt", "path", historySegmentSize, time.Hour)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	// Write two full segments of old messages, then one new message.
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2*historySegmentSize; i++ {
+		if _, err := s.append(Message{ID: fmt.Sprint(i), Timestamp: old}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.append(Message{ID: "new", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	s, err = openHistoryStore(root, "/mt", "path", historySegmentSize, time.Hour)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	defer s.close()
+	got := s.last(10 * historySegmentSize)
+	if len(got) != 1 || got[0].ID != "new" {
+		t.Errorf("Got %d messages after retention, want only the new one", len(got))
+	}
+}
+
+func TestPrivateMessagesNotRecorded(t *testing.T) {
+	root, err := ioutil.TempDir("", "chat-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := openHistoryStore(root, "/mt", "path/to/channel", 0, 0)
+	if err != nil {
+		t.Fatalf("openHistoryStore failed: %v", err)
+	}
+	defer s.close()
+	cr := &Channel{store: s}
+
+	if !cr.record(Message{ID: "public", Timestamp: time.Now()}) {
+		t.Errorf("record of a new message returned false")
+	}
+	// Private messages are always displayed, but never kept in the history
+	// that is shared with other members.
+	if !cr.record(Message{ID: "private", Private: true, Timestamp: time.Now()}) {
+		t.Errorf("record of a private message returned false")
+	}
+	if !s.has("public") || s.has("private") {
+		t.Errorf("Got has(public) = %v, has(private) = %v, want true, false", s.has("public"), s.has("private"))
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/v23/context"
+	"v.io/v23/verror"
+)
+
+// Any principal allowed in a channel can call our chat server as often as it
+// likes.  To keep a single flooding member from stalling the UI, messages are
+// only accepted if they are small enough, and if their sender has not sent too
+// many messages recently.  Accepted messages wait in a bounded queue until
+// they are displayed.
+
+// QueuePolicy is what happens to messages received while the inbound queue is
+// full.
+type QueuePolicy int
+
+const (
+	// DropWhenFull drops the message, and returns an error to its sender.
+	DropWhenFull QueuePolicy = iota
+	// BlockWhenFull makes the sender wait until the queue has room, or
+	// until its call is cancelled.
+	BlockWhenFull
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case DropWhenFull:
+		return "drop"
+	case BlockWhenFull:
+		return "block"
+	}
+	return fmt.Sprintf("queuePolicy(%d)", int(p))
+}
+
+// ParseQueuePolicy parses the name of a queue policy, as returned by String.
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	for _, p := range []QueuePolicy{DropWhenFull, BlockWhenFull} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, verror.New(verror.ErrBadArg, nil, "queue policy "+s)
+}
+
+// InboundLimits are the limits on the messages we accept from other members.
+type InboundLimits struct {
+	// MaxMessageSize is the maximum size in bytes of the text of a message,
+	// or of its ciphertext if it is encrypted.  Zero means no limit.
+	MaxMessageSize int
+	// Rate is the number of messages per second that a sender may send on
+	// average, and Burst the number of messages it may send at once.  Zero
+	// Rate means no limit.
+	Rate  float64
+	Burst int
+	// QueueSize is the number of messages that can be waiting to be
+	// displayed.
+	QueueSize int
+	// Policy is what happens to messages received while QueueSize messages
+	// are waiting.
+	Policy QueuePolicy
+}
+
+// Validate returns an error if any of the limits is negative.
+func (l InboundLimits) Validate() error {
+	switch {
+	case l.MaxMessageSize < 0:
+		return verror.New(verror.ErrBadArg, nil, fmt.Sprintf("negative maximum message size %d", l.MaxMessageSize))
+	case l.Rate < 0:
+		return verror.New(verror.ErrBadArg, nil, fmt.Sprintf("negative rate %v", l.Rate))
+	case l.Burst < 0:
+		return verror.New(verror.ErrBadArg, nil, fmt.Sprintf("negative burst %d", l.Burst))
+	case l.QueueSize < 0:
+		return verror.New(verror.ErrBadArg, nil, fmt.Sprintf("negative queue size %d", l.QueueSize))
+	}
+	return nil
+}
+
+var DefaultInboundLimits = InboundLimits{
+	MaxMessageSize: 4096,
+	Rate:           5,
+	Burst:          20,
+	QueueSize:      100,
+	Policy:         DropWhenFull,
+}
+
+const (
+	// maxRateBuckets is the number of senders whose recent messages are
+	// counted before the buckets of senders that are not being limited are
+	// forgotten.
+	maxRateBuckets = 1000
+	// noticeQueueSize is the number of notices that can be waiting to be
+	// shown.  Further notices are dropped.
+	noticeQueueSize = 10
+)
+
+// tokenBucket counts the recent messages of a sender.  It holds up to burst
+// tokens, and is refilled at rate tokens per second.  Each message takes a
+// token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// throttled is true if the last message of the sender was refused.
+	throttled bool
+}
+
+// rateLimiter limits the rate of the messages of each sender.
+type rateLimiter struct {
+	rate  float64
+	burst int
+	// Mutex to protect buckets.
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns true if sender may send a message at time now.  If it may not,
+// started is true if the previous message of the sender was allowed, i.e. if
+// the sender has just started being throttled.
+func (rl *rateLimiter) allow(sender string, now time.Time) (allowed, started bool) {
+	if rl.rate <= 0 {
+		return true, false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.buckets[sender]
+	if !ok {
+		if len(rl.buckets) >= maxRateBuckets {
+			rl.forgetFull(now)
+		}
+		b = &tokenBucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[sender] = b
+	}
+	rl.refill(b, now)
+	if b.tokens < 1 {
+		started = !b.throttled
+		b.throttled = true
+		return false, started
+	}
+	b.tokens--
+	b.throttled = false
+	return true, false
+}
+
+// refill adds the tokens earned by a bucket since it was last refilled.
+// rl.mu must be held.
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rl.rate
+		if b.tokens > float64(rl.burst) {
+			b.tokens = float64(rl.burst)
+		}
+	}
+	b.last = now
+}
+
+// forgetFull drops the buckets that are full again.  Their senders are not
+// being limited, and would get a full bucket anyway.  rl.mu must be held.
+func (rl *rateLimiter) forgetFull(now time.Time) {
+	for sender, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= float64(rl.burst) {
+			delete(rl.buckets, sender)
+		}
+	}
+}
+
+// messageSize returns the size of a message, as limited by MaxMessageSize.
+func messageSize(m Message) int {
+	size := len(m.Text)
+	if len(m.Ciphertext) > size {
+		size = len(m.Ciphertext)
+	}
+	return size + len(m.OnBehalfOf) + len(m.Target) + len(m.Parent)
+}
+
+// checkLimits returns an error if a message from the principal with the given
+// blessings is too large, or comes too soon after its previous messages.  It
+// is called before the message is verified or decrypted, since those are the
+// expensive parts of receiving a message.  Our own messages are not rate
+// limited, since they were already limited by the user typing them.
+func (cs *chatServerMethods) checkLimits(ctx *context.T, localBlessings, remoteBlessings []string, m Message) error {
+	sender := firstShortName(remoteBlessings)
+	if max := cs.limits.MaxMessageSize; max > 0 && messageSize(m) > max {
+		cs.notify(fmt.Sprintf("Dropped a message of %d bytes from %s.", messageSize(m), sender))
+		return verror.New(verror.ErrBadArg, ctx, fmt.Sprintf("message larger than %d bytes", max))
+	}
+	if cs.fromSelf(localBlessings, remoteBlessings, m) {
+		return nil
+	}
+	allowed, started := cs.limiter.allow(strings.Join(remoteBlessings, ","), time.Now())
+	if !allowed {
+		if started {
+			cs.notify(fmt.Sprintf("%s is sending too many messages.  Some of them are dropped.", sender))
+		}
+		return verror.New(verror.ErrLimitExceeded, ctx, "too many messages")
+	}
+	return nil
+}
+
+// fromSelf returns true if a message was sent by our own client: it names our
+// server in ReplyTo, and the caller has one of our blessings, so that another
+// member cannot escape the limits by naming our server.
+func (cs *chatServerMethods) fromSelf(localBlessings, remoteBlessings []string, m Message) bool {
+	if cs.ownName == "" || m.ReplyTo != cs.ownName {
+		return false
+	}
+	for _, b := range remoteBlessings {
+		if HasBlessing(localBlessings, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue adds an accepted message to the inbound queue, following the queue
+// policy if the queue is full.
+func (cs *chatServerMethods) enqueue(ctx *context.T, m Message) error {
+	if cs.limits.Policy == BlockWhenFull {
+		select {
+		case cs.messages <- m:
+			return nil
+		case <-ctx.Done():
+			return verror.New(verror.ErrLimitExceeded, ctx, "inbound queue full")
+		}
+	}
+	select {
+	case cs.messages <- m:
+		return nil
+	default:
+		cs.notify(fmt.Sprintf("Dropped a message from %s: too many messages are waiting to be displayed.", m.SenderName))
+		return verror.New(verror.ErrLimitExceeded, ctx, "inbound queue full")
+	}
+}
+
+// notify sends a notice to be shown to the user.  Notices are dropped rather
+// than waited for, so that showing them cannot stall the server either.
+func (cs *chatServerMethods) notify(text string) {
+	if cs.notices == nil {
+		return
+	}
+	select {
+	case cs.notices <- text:
+	default:
+	}
+}
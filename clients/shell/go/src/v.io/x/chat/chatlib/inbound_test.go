@@ -0,0 +1,124 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3)
+	now := time.Unix(1445000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := rl.allow("alice", now); !allowed {
+			t.Fatalf("Message %d of the burst was refused", i)
+		}
+	}
+	if allowed, started := rl.allow("alice", now); allowed || !started {
+		t.Errorf("allow after the burst = %v, %v, want false, true", allowed, started)
+	}
+	if allowed, started := rl.allow("alice", now); allowed || started {
+		t.Errorf("allow while throttled = %v, %v, want false, false", allowed, started)
+	}
+	// Other senders are limited separately.
+	if allowed, _ := rl.allow("bob", now); !allowed {
+		t.Errorf("bob was refused because of alice")
+	}
+	// Tokens are earned at the rate.
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := rl.allow("alice", now); !allowed {
+		t.Errorf("alice was refused after earning a token")
+	}
+	if allowed, started := rl.allow("alice", now); allowed || !started {
+		t.Errorf("allow after spending the earned token = %v, %v, want false, true", allowed, started)
+	}
+	// But no more than the burst are saved up.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		rl.allow("alice", now)
+	}
+	if allowed, _ := rl.allow("alice", now); allowed {
+		t.Errorf("alice was allowed more than the burst")
+	}
+
+	if allowed, _ := newRateLimiter(0, 0).allow("alice", now); !allowed {
+		t.Errorf("A zero rate should not limit")
+	}
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	for _, p := range []QueuePolicy{DropWhenFull, BlockWhenFull} {
+		if got, err := ParseQueuePolicy(p.String()); got != p || err != nil {
+			t.Errorf("parseQueuePolicy(%q) = %v, %v, want %v, nil", p.String(), got, err, p)
+		}
+	}
+	if _, err := ParseQueuePolicy("wait"); err == nil {
+		t.Errorf("parseQueuePolicy of an unknown policy should fail")
+	}
+}
+
+func TestInboundLimits(t *testing.T) {
+	incoming := make(chan Message, 1)
+	notices := make(chan string, noticeQueueSize)
+	cs := newChatServerMethods(incoming, nil)
+	cs.limits = InboundLimits{MaxMessageSize: 10, Rate: 1, Burst: 1, QueueSize: 1, Policy: DropWhenFull}
+	cs.limiter = newRateLimiter(1, 1)
+	cs.notices = notices
+	alice := []string{"dev.v.io:u:alice@example.com"}
+
+	large := newMessage(alice, vdl.Message{Id: "1", Text: strings.Repeat("x", 11)})
+	if err := cs.checkLimits(nil, nil, alice, large); verror.ErrorID(err) != verror.ErrBadArg.ID {
+		t.Errorf("checkLimits of a large message = %v, want ErrBadArg", err)
+	}
+	m := newMessage(alice, vdl.Message{Id: "2", Text: "hello"})
+	if err := cs.checkLimits(nil, nil, alice, m); err != nil {
+		t.Errorf("checkLimits = %v, want nil", err)
+	}
+	if err := cs.checkLimits(nil, nil, alice, m); verror.ErrorID(err) != verror.ErrLimitExceeded.ID {
+		t.Errorf("checkLimits of a message too soon = %v, want ErrLimitExceeded", err)
+	}
+
+	if err := cs.enqueue(nil, m); err != nil {
+		t.Errorf("enqueue = %v, want nil", err)
+	}
+	if err := cs.enqueue(nil, m); verror.ErrorID(err) != verror.ErrLimitExceeded.ID {
+		t.Errorf("enqueue to a full queue = %v, want ErrLimitExceeded", err)
+	}
+
+	// Our own messages are not rate limited, but messages that only claim
+	// to be from our server are.
+	cs.ownName = "path/to/channel/alice"
+	own := newMessage(alice, vdl.Message{Id: "3", Text: "hello", ReplyTo: cs.ownName})
+	if err := cs.checkLimits(nil, alice, alice, own); err != nil {
+		t.Errorf("checkLimits of our own message = %v, want nil", err)
+	}
+	bob := []string{"dev.v.io:u:bob@example.com"}
+	cs.limiter.allow(strings.Join(bob, ","), time.Now())
+	if err := cs.checkLimits(nil, alice, bob, own); verror.ErrorID(err) != verror.ErrLimitExceeded.ID {
+		t.Errorf("checkLimits of a message claiming to be ours = %v, want ErrLimitExceeded", err)
+	}
+
+	// The large message, the throttling and the full queue were noticed.
+	if got := len(notices); got != 4 {
+		t.Errorf("Got %d notices, want 4", got)
+	}
+}
+
+func TestInboundLimitsValidate(t *testing.T) {
+	if err := DefaultInboundLimits.Validate(); err != nil {
+		t.Errorf("Validate of the default limits = %v, want nil", err)
+	}
+	l := DefaultInboundLimits
+	l.QueueSize = -1
+	if err := l.Validate(); verror.ErrorID(err) != verror.ErrBadArg.ID {
+		t.Errorf("Validate of a negative queue size = %v, want ErrBadArg", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/naming"
+	"v.io/v23/security"
+	mt "v.io/v23/services/mounttable"
+	"v.io/v23/verror"
+)
+
+const (
+	// janitorInterval is how often the janitor looks for names to delete.
+	janitorInterval = 5 * time.Minute
+	// gcSweepDelay is how long CollectGarbage waits between its two
+	// sweeps.  A live client mounts on the name it locked, or refreshes a
+	// mount that lapsed, well within it.
+	gcSweepDelay = mountTTL
+)
+
+// emptyOwnedNames returns the names under the channel path that have no
+// server mounted on them, and that we administer.  These are left behind by
+// clients that locked a name with getLockedName, but crashed before they could
+// delete it in leave.  Our own name is never returned.
+func (cr *Channel) emptyOwnedNames() ([]string, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, 30*time.Second)
+	defer cancel()
+
+	ns := v23.GetNamespace(ctx)
+	globChan, err := ns.Glob(ctx, cr.path+"/*")
+	if err != nil {
+		return nil, err
+	}
+
+	p := v23.GetPrincipal(ctx)
+	userBlessings, _ := p.BlessingStore().Default()
+	myNames := security.BlessingNames(p, userBlessings)
+
+	var names []string
+	for reply := range globChan {
+		v, ok := reply.(*naming.GlobReplyEntry)
+		if !ok || len(v.Value.Servers) > 0 || v.Value.Name == cr.name {
+			continue
+		}
+		perms, _, err := ns.GetPermissions(ctx, v.Value.Name)
+		if err != nil {
+			continue
+		}
+		if acl, ok := perms[string(mt.Admin)]; ok && acl.Includes(myNames...) {
+			names = append(names, v.Value.Name)
+		}
+	}
+	return names, nil
+}
+
+// deleteNames deletes the given names from the mounttable.  It returns the
+// number of names that were deleted.
+func (cr *Channel) deleteNames(names []string) int {
+	ctx, cancel := context.WithTimeout(cr.ctx, 30*time.Second)
+	defer cancel()
+
+	ns := v23.GetNamespace(ctx)
+	deleted := 0
+	for _, name := range names {
+		if err := ns.Delete(ctx, name, false); err == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// CollectGarbage deletes the empty names under the channel path that we
+// administer.  Like the janitor, it only deletes names that are still empty
+// when it looks again after gcSweepDelay.  It returns the number of names that
+// were deleted.
+func (cr *Channel) CollectGarbage() (int, error) {
+	j := newJanitor(cr)
+	if _, err := j.sweep(); err != nil {
+		return 0, err
+	}
+	if len(j.candidates) == 0 {
+		return 0, nil
+	}
+	select {
+	case <-time.After(gcSweepDelay):
+	case <-cr.ctx.Done():
+		return 0, verror.New(verror.ErrCanceled, cr.ctx, "garbage collection of "+cr.path)
+	}
+	return j.sweep()
+}
+
+// janitor periodically deletes the empty names under the channel path that we
+// administer.  Another of our own clients may have just locked a name that it
+// has not mounted on yet, so a name is only deleted if it was found empty by
+// two consecutive sweeps.
+type janitor struct {
+	cr *Channel
+	// candidates holds the names that were empty in the previous sweep.
+	candidates map[string]bool
+}
+
+func newJanitor(cr *Channel) *janitor {
+	return &janitor{
+		cr:         cr,
+		candidates: make(map[string]bool),
+	}
+}
+
+// sweep deletes the names that were empty in this and the previous sweep.  It
+// returns the number of names that were deleted.
+func (j *janitor) sweep() (int, error) {
+	names, err := j.cr.emptyOwnedNames()
+	if err != nil {
+		return 0, err
+	}
+	var toDelete []string
+	candidates := make(map[string]bool)
+	for _, name := range names {
+		if j.candidates[name] {
+			toDelete = append(toDelete, name)
+		} else {
+			candidates[name] = true
+		}
+	}
+	j.candidates = candidates
+	return j.cr.deleteNames(toDelete), nil
+}
+
+// run sweeps every janitorInterval until the channel's context is cancelled.
+func (j *janitor) run() {
+	for {
+		j.sweep()
+		select {
+		case <-time.After(janitorInterval):
+		case <-j.cr.ctx.Done():
+			return
+		}
+	}
+}
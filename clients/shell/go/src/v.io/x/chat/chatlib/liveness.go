@@ -0,0 +1,102 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"sync"
+	"time"
+
+	"v.io/v23/context"
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+const (
+	// pingTimeout is how long we wait for a member to answer a ping.
+	pingTimeout = 2 * time.Second
+	// staleAfterFailures is the number of consecutive pings a member must
+	// fail before it is considered stale.
+	staleAfterFailures = 3
+)
+
+// livenessTracker keeps track of members that did not answer our pings.  A
+// member whose client crashed stays mounted in the mounttable until its mount
+// expires, which can take minutes.  Such stale members are hidden from the
+// member list and are not sent messages.
+type livenessTracker struct {
+	// Mutex to protect failures.
+	mu sync.Mutex
+	// failures holds the number of consecutive failed pings of each
+	// member, keyed by member path.
+	failures map[string]int
+}
+
+func newLivenessTracker() *livenessTracker {
+	return &livenessTracker{
+		failures: make(map[string]int),
+	}
+}
+
+// record records the result of pinging the member at path.
+func (lt *livenessTracker) record(path string, alive bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if alive {
+		delete(lt.failures, path)
+	} else {
+		lt.failures[path]++
+	}
+}
+
+// isStale returns true if the member at path failed too many pings in a row.
+func (lt *livenessTracker) isStale(path string) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.failures[path] >= staleAfterFailures
+}
+
+// forget drops the state of all members whose path is not in paths.
+func (lt *livenessTracker) forget(paths map[string]bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for path := range lt.failures {
+		if !paths[path] {
+			delete(lt.failures, path)
+		}
+	}
+}
+
+// pingMembers pings all members mounted in the channel in parallel, including
+// stale ones, and records which of them answered.
+func (cr *Channel) pingMembers() {
+	cr.mu.Lock()
+	members := cr.mounted
+	cr.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		if m.Path == cr.name {
+			continue
+		}
+		wg.Add(1)
+		go func(m *Member) {
+			defer wg.Done()
+			cr.liveness.record(m.Path, cr.ping(m) == nil)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// ping checks that a member is reachable.
+func (cr *Channel) ping(member *Member) error {
+	ctx, cancel := context.WithTimeout(cr.ctx, pingTimeout)
+	defer cancel()
+	err := vdl.ChatClient(member.Path).Ping(ctx, callOptsFor(member.Blessings)...)
+	if verror.ErrorID(err) == verror.ErrUnknownMethod.ID {
+		// Older clients do not implement Ping, but they answered.
+		return nil
+	}
+	return err
+}
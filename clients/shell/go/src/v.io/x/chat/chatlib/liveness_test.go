@@ -0,0 +1,34 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import "testing"
+
+func TestLivenessTracker(t *testing.T) {
+	lt := newLivenessTracker()
+	for i := 0; i < staleAfterFailures-1; i++ {
+		lt.record("a", false)
+	}
+	if lt.isStale("a") {
+		t.Errorf("Member is stale after %d failures, want %d", staleAfterFailures-1, staleAfterFailures)
+	}
+	lt.record("a", false)
+	if !lt.isStale("a") {
+		t.Errorf("Member is not stale after %d failures", staleAfterFailures)
+	}
+	// A single answer makes a member live again.
+	lt.record("a", true)
+	if lt.isStale("a") {
+		t.Errorf("Member is stale after answering a ping")
+	}
+
+	for i := 0; i < staleAfterFailures; i++ {
+		lt.record("b", false)
+	}
+	lt.forget(map[string]bool{"a": true})
+	if lt.isStale("b") {
+		t.Errorf("Member is stale after being forgotten")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"math/rand"
+	"time"
+
+	"v.io/x/lib/vlog"
+)
+
+// MembershipEventKind is the kind of a MembershipEvent.
+type MembershipEventKind int
+
+const (
+	MemberJoined MembershipEventKind = iota
+	MemberLeft
+)
+
+// MembershipEvent reports that a member joined or left the channel.
+type MembershipEvent struct {
+	Kind   MembershipEventKind
+	Member *Member
+}
+
+// MembershipUpdate is sent by watchMembers whenever the members of the
+// channel change.
+type MembershipUpdate struct {
+	// Members is the current list of members, sorted by name.
+	Members []*Member
+	// Events holds the changes since the previous update.  It is empty for
+	// the first update.
+	Events []MembershipEvent
+}
+
+// diffMembers returns the events that turn the list of members old into the
+// list new.  Members are identified by the path they are mounted at.
+func diffMembers(old, new []*Member) []MembershipEvent {
+	oldPaths := make(map[string]bool, len(old))
+	for _, m := range old {
+		oldPaths[m.Path] = true
+	}
+	newPaths := make(map[string]bool, len(new))
+	for _, m := range new {
+		newPaths[m.Path] = true
+	}
+	var events []MembershipEvent
+	for _, m := range old {
+		if !newPaths[m.Path] {
+			events = append(events, MembershipEvent{Kind: MemberLeft, Member: m})
+		}
+	}
+	for _, m := range new {
+		if !oldPaths[m.Path] {
+			events = append(events, MembershipEvent{Kind: MemberJoined, Member: m})
+		}
+	}
+	return events
+}
+
+// WatchMembers polls the members of the channel and sends an update on the
+// returned channel whenever they change.  The time between polls is interval,
+// plus or minus a random amount up to jitter, so that clients started at the
+// same time do not all glob the mounttable at once.  Polls are at least
+// minPollInterval apart.  The mounttable has no way to watch a name for
+// changes, so polling is the best we can do.
+//
+// Watching stops when the channel's context is cancelled.
+func (cr *Channel) WatchMembers(interval, jitter time.Duration) <-chan MembershipUpdate {
+	updates := make(chan MembershipUpdate)
+	go func() {
+		defer close(updates)
+		var last []*Member
+		first := true
+		for {
+			members, err := cr.Members()
+			if err == nil {
+				// Ping the members, and drop the ones that
+				// have just become stale.
+				cr.pingMembers()
+				members = cr.liveMembers(members)
+			}
+			if err != nil {
+				vlog.Errorf("Error getting members of %v: %v", cr.path, err)
+			} else if events := diffMembers(last, members); first || len(events) > 0 {
+				if first {
+					events = nil
+				}
+				if cr.encrypt && anyLeft(events) {
+					go cr.rotateGroupKey(members)
+				}
+				select {
+				case updates <- MembershipUpdate{Members: members, Events: events}:
+				case <-cr.ctx.Done():
+					return
+				}
+				last = members
+				first = false
+			}
+			select {
+			case <-time.After(jitterDuration(interval, jitter)):
+			case <-cr.ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// liveMembers returns the members that are not stale.
+func (cr *Channel) liveMembers(members []*Member) []*Member {
+	var live []*Member
+	for _, m := range members {
+		if !cr.liveness.isStale(m.Path) {
+			live = append(live, m)
+		}
+	}
+	return live
+}
+
+// minPollInterval is the shortest time between two polls of the members,
+// whatever interval and jitter WatchMembers is given, so that a bad interval
+// cannot make us glob the mounttable in a loop.
+const minPollInterval = 100 * time.Millisecond
+
+// jitterDuration returns d plus or minus a random duration up to jitter, and at
+// least minPollInterval.
+func jitterDuration(d, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		d = d - jitter + time.Duration(rand.Int63n(int64(2*jitter)))
+	}
+	if d < minPollInterval {
+		return minPollInterval
+	}
+	return d
+}
+
+// anyLeft returns true if any of the events is a member leaving.
+func anyLeft(events []MembershipEvent) bool {
+	for _, e := range events {
+		if e.Kind == MemberLeft {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffMembers(t *testing.T) {
+	alice := &Member{Name: "alice", Path: "channel/a"}
+	bob := &Member{Name: "bob", Path: "channel/b"}
+	carol := &Member{Name: "carol", Path: "channel/c"}
+	// Same name as alice, but a different client.
+	alice2 := &Member{Name: "alice", Path: "channel/a2"}
+
+	events := diffMembers([]*Member{alice, bob}, []*Member{alice, alice2, carol})
+	want := []MembershipEvent{
+		{Kind: MemberLeft, Member: bob},
+		{Kind: MemberJoined, Member: alice2},
+		{Kind: MemberJoined, Member: carol},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Got %d events, want %d", len(events), len(want))
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Got event %d = %v, want %v", i, events[i], want[i])
+		}
+	}
+
+	if events := diffMembers([]*Member{alice}, []*Member{alice}); len(events) != 0 {
+		t.Errorf("Got %d events for unchanged members, want 0", len(events))
+	}
+}
+
+func TestJitterDuration(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitterDuration(time.Second, 100*time.Millisecond)
+		if d < 900*time.Millisecond || d >= 1100*time.Millisecond {
+			t.Errorf("Got jitterDuration(1s, 100ms) = %v, want between 900ms and 1.1s", d)
+		}
+	}
+	if got, want := jitterDuration(time.Second, 0), time.Second; got != want {
+		t.Errorf("Got jitterDuration(1s, 0) = %v, want %v", got, want)
+	}
+	// Polls never happen back to back, whatever the interval and jitter.
+	for _, d := range []time.Duration{0, -time.Second} {
+		if got := jitterDuration(d, 0); got != minPollInterval {
+			t.Errorf("Got jitterDuration(%v, 0) = %v, want %v", d, got, minPollInterval)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if got := jitterDuration(time.Second, 2*time.Second); got < minPollInterval {
+			t.Errorf("Got jitterDuration(1s, 2s) = %v, want at least %v", got, minPollInterval)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/rpc"
+	"v.io/x/lib/vlog"
+)
+
+// We mount our server in the channel ourselves rather than letting the server
+// publish it, so that the mount expires soon after our client crashes.  Until
+// it expires, a crashed client is only hidden by the liveness pings.
+
+const (
+	// mountTTL is how long our mount in the channel lasts unless it is
+	// refreshed.
+	mountTTL = 2 * time.Minute
+	// mountRefreshInterval is how often we refresh our mount, well before
+	// it expires.
+	mountRefreshInterval = mountTTL / 3
+	// endpointWaitInterval is how often we check for the endpoints of our
+	// server while it has none, e.g. while it connects to its proxy.
+	endpointWaitInterval = time.Second
+)
+
+// mount mounts the endpoints of our server on name, for mountTTL.  It returns
+// the number of endpoints mounted, and an error only if none of them could be.
+func (cr *Channel) mount(ctx *context.T, server rpc.Server, name string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, cr.mounttableTimeout)
+	defer cancel()
+	ns := v23.GetNamespace(ctx)
+	n := 0
+	var err error
+	for _, ep := range server.Status().Endpoints {
+		if e := ns.Mount(ctx, name, ep.Name(), mountTTL); e != nil {
+			err = e
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// refreshMount mounts our server on name again every mountRefreshInterval, so
+// that the mount does not expire while we are in the channel.  Endpoints that
+// the server got since it was last mounted, e.g. from its proxy, are mounted
+// too.  It returns when ctx is done.
+func (cr *Channel) refreshMount(ctx *context.T, server rpc.Server, name string, mounted int) {
+	for {
+		wait := mountRefreshInterval
+		if mounted == 0 {
+			wait = endpointWaitInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		var err error
+		if mounted, err = cr.mount(ctx, server, name); err != nil {
+			vlog.Errorf("Failed to refresh the mount of %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"time"
+
+	"v.io/v23/security"
+)
+
+const (
+	// defaultCallTimeout is how long we wait for other members to answer
+	// our calls, unless WithCallTimeout is given.
+	defaultCallTimeout = 5 * time.Second
+	// defaultMounttableTimeout is how long we wait for the mounttable to
+	// answer our calls, unless WithMounttableTimeout is given.
+	defaultMounttableTimeout = 10 * time.Second
+)
+
+// channelOptions holds the configuration of a Channel.
+type channelOptions struct {
+	mounttable         string
+	proxy              string
+	callTimeout        time.Duration
+	mounttableTimeout  time.Duration
+	authorizer         security.Authorizer
+	historyDir         string
+	historyMaxMessages int
+	historyMaxAge      time.Duration
+	serveHistory       bool
+	encrypt            bool
+	blocked            func(blessings []string) bool
+	limits             InboundLimits
+	downloadDir        string
+	trustedBridges     []security.BlessingPattern
+}
+
+// Option configures a Channel created with New.
+type Option func(*channelOptions)
+
+// WithMounttable sets the mounttable where the channel is mounted.  By default
+// the namespace roots of the context are used.
+func WithMounttable(mounttable string) Option {
+	return func(o *channelOptions) {
+		o.mounttable = mounttable
+	}
+}
+
+// WithProxy sets the proxy that our chat server listens on.
+func WithProxy(proxy string) Option {
+	return func(o *channelOptions) {
+		o.proxy = proxy
+	}
+}
+
+// WithCallTimeout sets how long we wait for other members to answer our calls,
+// e.g. to deliver a message.
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(o *channelOptions) {
+		o.callTimeout = timeout
+	}
+}
+
+// WithMounttableTimeout sets how long we wait for the mounttable to answer our
+// calls, e.g. to list the members of the channel.
+func WithMounttableTimeout(timeout time.Duration) Option {
+	return func(o *channelOptions) {
+		o.mounttableTimeout = timeout
+	}
+}
+
+// WithAuthorizer sets the authorizer of calls to our chat server.  By default
+// only principals in the ACL of the channel are allowed.
+func WithAuthorizer(authorizer security.Authorizer) Option {
+	return func(o *channelOptions) {
+		o.authorizer = authorizer
+	}
+}
+
+// WithHistory keeps the history of the channel in a store under dir, so that
+// it survives restarts.  Messages beyond maxMessages, or older than maxAge,
+// are pruned.  Zero means no limit.  Encrypted messages are stored with their
+// decrypted text, so the store is only as private as dir.
+func WithHistory(dir string, maxMessages int, maxAge time.Duration) Option {
+	return func(o *channelOptions) {
+		o.historyDir = dir
+		o.historyMaxMessages = maxMessages
+		o.historyMaxAge = maxAge
+	}
+}
+
+// WithServeHistory sets whether our history is shared with members who join
+// the channel.  It only applies if history is kept.
+func WithServeHistory(serve bool) Option {
+	return func(o *channelOptions) {
+		o.serveHistory = serve
+	}
+}
+
+// WithEncryption sets whether the messages we send are encrypted end-to-end
+// with the group key of the channel.  Encrypted messages we receive are
+// decrypted either way.
+func WithEncryption(encrypt bool) Option {
+	return func(o *channelOptions) {
+		o.encrypt = encrypt
+	}
+}
+
+// WithBlocked drops the messages from the principals for whose blessings
+// blocked returns true.
+func WithBlocked(blocked func(blessings []string) bool) Option {
+	return func(o *channelOptions) {
+		o.blocked = blocked
+	}
+}
+
+// WithInboundLimits sets the limits on the messages we accept from other
+// members.  By default DefaultInboundLimits are used.  New fails if any of the
+// limits is negative.
+func WithInboundLimits(limits InboundLimits) Option {
+	return func(o *channelOptions) {
+		o.limits = limits
+	}
+}
+
+// WithDownloadDir receives the files that members send us into dir, once the
+// user accepts them on Channel.FileOffers.  By default files are refused.
+func WithDownloadDir(dir string) Option {
+	return func(o *channelOptions) {
+		o.downloadDir = dir
+	}
+}
+
+// WithTrustedBridges trusts the principals matching the given patterns to
+// relay messages on behalf of other users, e.g. bridges to other chat systems.
+// Messages relayed by other principals do not have Message.RelayTrusted set.
+// Our own relayed messages are always trusted.
+func WithTrustedBridges(patterns []security.BlessingPattern) Option {
+	return func(o *channelOptions) {
+		o.trustedBridges = patterns
+	}
+}
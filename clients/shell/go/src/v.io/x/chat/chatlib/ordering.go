@@ -0,0 +1,90 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lamportClock is a logical clock used to order messages consistently across
+// all members of a channel.  The clock is advanced before every message we
+// send, and is moved forward past the clock of every message we receive, so a
+// reply is always ordered after the message it replies to.
+type lamportClock struct {
+	mu   sync.Mutex
+	time uint64
+}
+
+// tick advances the clock and returns the new time.  It should be called once
+// for every outgoing message.
+func (c *lamportClock) tick() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.time++
+	return c.time
+}
+
+// witness moves the clock forward to t, if t is ahead of the clock.  It should
+// be called for every incoming message.
+func (c *lamportClock) witness(t uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t > c.time {
+		c.time = t
+	}
+}
+
+// holdbackMessage is a message waiting in the holdbackQueue.
+type holdbackMessage struct {
+	m   Message
+	due time.Time
+}
+
+// holdbackQueue holds incoming messages back for a short delay and releases
+// them in (Clock, ID) order.  This fixes up messages that were reordered in
+// transit, as long as they arrive within delay of each other.  Messages that
+// arrive later than that must be inserted in place by the historyWriter.
+type holdbackQueue struct {
+	delay   time.Duration
+	pending []holdbackMessage
+}
+
+func newHoldbackQueue(delay time.Duration) *holdbackQueue {
+	return &holdbackQueue{
+		delay: delay,
+	}
+}
+
+// push adds a message that arrived at the given time to the queue.
+func (q *holdbackQueue) push(m Message, now time.Time) {
+	i := sort.Search(len(q.pending), func(i int) bool {
+		return m.Before(q.pending[i].m)
+	})
+	q.pending = append(q.pending, holdbackMessage{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = holdbackMessage{m: m, due: now.Add(q.delay)}
+}
+
+// popDue removes and returns, in order, the messages at the head of the queue
+// that have been held back for long enough.
+func (q *holdbackQueue) popDue(now time.Time) []Message {
+	var out []Message
+	for len(q.pending) > 0 && !q.pending[0].due.After(now) {
+		out = append(out, q.pending[0].m)
+		q.pending = q.pending[1:]
+	}
+	return out
+}
+
+// nextDue returns the time at which the message at the head of the queue can
+// be released.  It returns false if the queue is empty.
+func (q *holdbackQueue) nextDue() (time.Time, bool) {
+	if len(q.pending) == 0 {
+		return time.Time{}, false
+	}
+	return q.pending[0].due, true
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLamportClock(t *testing.T) {
+	var c lamportClock
+	if got, want := c.tick(), uint64(1); got != want {
+		t.Errorf("Got c.tick() = %v, want %v", got, want)
+	}
+	c.witness(10)
+	if got, want := c.tick(), uint64(11); got != want {
+		t.Errorf("Got c.tick() = %v, want %v", got, want)
+	}
+	// Witnessing an old time must not move the clock backwards.
+	c.witness(3)
+	if got, want := c.tick(), uint64(12); got != want {
+		t.Errorf("Got c.tick() = %v, want %v", got, want)
+	}
+}
+
+func TestHoldbackQueue(t *testing.T) {
+	start := time.Now()
+	q := newHoldbackQueue(time.Second)
+
+	q.push(Message{ID: "c", Clock: 2}, start)
+	q.push(Message{ID: "b", Clock: 1}, start.Add(100*time.Millisecond))
+	q.push(Message{ID: "a", Clock: 2}, start.Add(200*time.Millisecond))
+
+	if got := q.popDue(start.Add(500 * time.Millisecond)); len(got) != 0 {
+		t.Errorf("Expected no messages before the delay, got %v", got)
+	}
+	if due, ok := q.nextDue(); !ok || !due.Equal(start.Add(1100*time.Millisecond)) {
+		t.Errorf("Got q.nextDue() = %v, %v, want %v, true", due, ok, start.Add(1100*time.Millisecond))
+	}
+
+	var ids []string
+	for _, m := range q.popDue(start.Add(2 * time.Second)) {
+		ids = append(ids, m.ID)
+	}
+	if got, want := len(ids), 3; got != want {
+		t.Fatalf("Got %d messages, want %d", got, want)
+	}
+	for i, want := range []string{"b", "a", "c"} {
+		if ids[i] != want {
+			t.Errorf("Got message %d = %v, want %v", i, ids[i], want)
+		}
+	}
+	if _, ok := q.nextDue(); ok {
+		t.Errorf("Expected queue to be empty")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"regexp"
+
+	"v.io/x/chat/vdl"
+)
+
+// reactionCodeRegexp matches the short codes of emojis that members react
+// with, e.g. "thumbsup".
+var reactionCodeRegexp = regexp.MustCompile(`^[a-z0-9_+-]{1,32}$`)
+
+// ValidReactionCode returns true if code can be used in a reaction.  Codes
+// that are valid but unknown to a client are shown as ":code:".
+func ValidReactionCode(code string) bool {
+	return reactionCodeRegexp.MatchString(code)
+}
+
+// IsReaction returns true if m adds or removes a reaction to an earlier
+// message.
+func (m Message) IsReaction() bool {
+	return m.Kind == vdl.MessageKindReact || m.Kind == vdl.MessageKindUnreact
+}
+
+// Reaction is an emoji that members reacted to a message with.
+type Reaction struct {
+	// Code is the short code of the emoji.
+	Code string
+	// Senders identify the members who reacted with it, in the order they
+	// reacted, by the first blessing name their reaction was signed with.
+	// Short names are not used, since they are not unique.
+	Senders []string
+}
+
+// Reactions are the reactions to a message, in the order they were first
+// made.  They are updated by applying reaction messages with Apply.
+type Reactions []Reaction
+
+// reactionSender returns the name that a reaction is counted under, or an
+// empty string if the reaction has no signer.  Users of a bridge are named
+// after the bridge too, since the bridge could relay for any name.
+func reactionSender(m Message) string {
+	if m.Unverified || len(m.SenderBlessings) == 0 {
+		return ""
+	}
+	if m.OnBehalfOf != "" {
+		return m.OnBehalfOf + " via " + m.SenderBlessings[0]
+	}
+	return m.SenderBlessings[0]
+}
+
+// Apply returns the reactions after the reaction message m, which must target
+// the message they are for, and whether they changed.  The reactions it is
+// applied to are not modified, so that they can be shared.  Reactions whose
+// sender is unverified are ignored, since they could be counted under any
+// name.
+func (rs Reactions) Apply(m Message) (Reactions, bool) {
+	sender := reactionSender(m)
+	if !m.IsReaction() || sender == "" || !ValidReactionCode(m.Text) {
+		return rs, false
+	}
+	i := rs.index(m.Text)
+	reacted := i >= 0 && rs[i].hasSender(sender)
+	if m.Kind == vdl.MessageKindReact {
+		if reacted {
+			return rs, false
+		}
+		out := append(Reactions(nil), rs...)
+		if i < 0 {
+			return append(out, Reaction{Code: m.Text, Senders: []string{sender}}), true
+		}
+		out[i].Senders = append(append([]string(nil), rs[i].Senders...), sender)
+		return out, true
+	}
+	if !reacted {
+		return rs, false
+	}
+	var senders []string
+	for _, s := range rs[i].Senders {
+		if s != sender {
+			senders = append(senders, s)
+		}
+	}
+	out := append(Reactions(nil), rs[:i]...)
+	if len(senders) > 0 {
+		out = append(out, Reaction{Code: m.Text, Senders: senders})
+	}
+	return append(out, rs[i+1:]...), true
+}
+
+// HasReacted returns true if the member with one of the given blessing names
+// reacted with code.
+func (rs Reactions) HasReacted(code string, blessings []string) bool {
+	i := rs.index(code)
+	if i < 0 {
+		return false
+	}
+	for _, b := range blessings {
+		if rs[i].hasSender(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs Reactions) index(code string) int {
+	for i, r := range rs {
+		if r.Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r Reaction) hasSender(name string) bool {
+	for _, s := range r.Senders {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"fmt"
+	"testing"
+
+	"v.io/x/chat/vdl"
+)
+
+func TestReactions(t *testing.T) {
+	react := func(kind vdl.MessageKind, sender, code string) Message {
+		return Message{Kind: kind, SenderName: sender, SenderBlessings: []string{sender}, Text: code}
+	}
+	var rs Reactions
+	tests := []struct {
+		m       Message
+		changed bool
+		want    string
+	}{
+		{react(vdl.MessageKindReact, "alice", "thumbsup"), true, "[{thumbsup [alice]}]"},
+		{react(vdl.MessageKindReact, "bob", "tada"), true, "[{thumbsup [alice]} {tada [bob]}]"},
+		{react(vdl.MessageKindReact, "bob", "thumbsup"), true, "[{thumbsup [alice bob]} {tada [bob]}]"},
+		// Reacting twice counts once.
+		{react(vdl.MessageKindReact, "alice", "thumbsup"), false, "[{thumbsup [alice bob]} {tada [bob]}]"},
+		{react(vdl.MessageKindUnreact, "alice", "tada"), false, "[{thumbsup [alice bob]} {tada [bob]}]"},
+		{react(vdl.MessageKindUnreact, "bob", "tada"), true, "[{thumbsup [alice bob]}]"},
+		{Message{Kind: vdl.MessageKindReact, SenderName: "bob", SenderBlessings: []string{"bob"}, Text: "tada", Unverified: true}, false, "[{thumbsup [alice bob]}]"},
+		// Reactions are counted by blessing name, not by short name.
+		{Message{Kind: vdl.MessageKindReact, SenderName: "alice", SenderBlessings: []string{"other:alice"}, Text: "thumbsup"}, true, "[{thumbsup [alice bob other:alice]}]"},
+		{Message{Kind: vdl.MessageKindUnreact, SenderName: "alice", SenderBlessings: []string{"other:alice"}, Text: "thumbsup"}, true, "[{thumbsup [alice bob]}]"},
+		{react(vdl.MessageKindReact, "bob", "Not a code!"), false, "[{thumbsup [alice bob]}]"},
+		{react(vdl.MessageKindText, "bob", "tada"), false, "[{thumbsup [alice bob]}]"},
+	}
+	for _, test := range tests {
+		prev := fmt.Sprint(rs)
+		next, changed := rs.Apply(test.m)
+		if changed != test.changed {
+			t.Errorf("Applying %+v: got changed %v, want %v", test.m, changed, test.changed)
+		}
+		if got := fmt.Sprint(next); got != test.want {
+			t.Errorf("Applying %+v: got %s, want %s", test.m, got, test.want)
+		}
+		if got := fmt.Sprint(rs); got != prev {
+			t.Errorf("Applying %+v modified the reactions it was applied to: got %s, want %s", test.m, got, prev)
+		}
+		rs = next
+	}
+	if !rs.HasReacted("thumbsup", []string{"alice"}) || rs.HasReacted("tada", []string{"bob"}) {
+		t.Errorf("Got reactions %v, want alice to have reacted with thumbsup only", rs)
+	}
+}
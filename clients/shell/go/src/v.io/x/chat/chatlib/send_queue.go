@@ -0,0 +1,122 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+const (
+	// sendQueueSize is the number of messages that can be waiting to be
+	// sent to a single member.
+	sendQueueSize = 100
+	// maxSendAttempts is the number of times we try to send a message to a
+	// member before giving up.
+	maxSendAttempts = 5
+	// initialSendBackoff is how long we wait before the first retry.  The
+	// wait doubles after every failed attempt.
+	initialSendBackoff = 250 * time.Millisecond
+)
+
+// sendFailure reports that a message could not be delivered to a member.
+type sendFailure struct {
+	MessageID string
+	Member    *Member
+	Err       error
+}
+
+// sendQueue delivers messages to a single member, one at a time and in the
+// order they were queued.  Transient failures are retried with exponential
+// backoff.  Once a message has failed maxSendAttempts times it is reported to
+// the fail function and the queue moves on to the next message.
+type sendQueue struct {
+	member *Member
+	// send makes a single attempt to deliver a message to the member.
+	send func(vdl.Message) error
+	// fail is called for every message that could not be delivered.
+	fail func(sendFailure)
+	// backoff is how long to wait before the first retry.
+	backoff time.Duration
+	pending chan vdl.Message
+	done    chan struct{}
+}
+
+func newSendQueue(member *Member, send func(vdl.Message) error, fail func(sendFailure)) *sendQueue {
+	q := &sendQueue{
+		member:  member,
+		send:    send,
+		fail:    fail,
+		backoff: initialSendBackoff,
+		pending: make(chan vdl.Message, sendQueueSize),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// enqueue adds a message to the end of the queue.  It returns an error if the
+// queue is full.
+func (q *sendQueue) enqueue(m vdl.Message) error {
+	select {
+	case q.pending <- m:
+		return nil
+	default:
+		return verror.New(verror.ErrLimitExceeded, nil, "send queue for "+q.member.Name)
+	}
+}
+
+// close stops the queue.  Any messages that have not been sent yet are
+// dropped.
+func (q *sendQueue) close() {
+	close(q.done)
+}
+
+func (q *sendQueue) run() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case m := <-q.pending:
+			q.deliver(m)
+		}
+	}
+}
+
+// deliver sends a message to the member, retrying transient failures.
+func (q *sendQueue) deliver(m vdl.Message) {
+	backoff := q.backoff
+	for attempt := 1; ; attempt++ {
+		err := q.send(m)
+		if err == nil {
+			return
+		}
+		if attempt == maxSendAttempts || !isTransient(err) {
+			q.fail(sendFailure{MessageID: m.Id, Member: q.member, Err: err})
+			return
+		}
+		select {
+		case <-q.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient returns true if the RPC that returned err may succeed if it is
+// tried again: the connection failed, the call timed out, or the member's
+// server could not be reached.  Other errors, including those that only
+// suggest refetching the name, such as ErrNoAccess and ErrNotTrusted, are
+// permanent.
+func isTransient(err error) bool {
+	switch verror.ErrorID(err) {
+	case verror.ErrTimeout.ID, verror.ErrNoServers.ID:
+		return true
+	}
+	return verror.Action(err) == verror.RetryConnection
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+func TestSendQueueRetriesInOrder(t *testing.T) {
+	sent := make(chan string, 10)
+	attempts := map[string]int{}
+	send := func(m vdl.Message) error {
+		attempts[m.Id]++
+		// Fail the first message twice with a transient error.
+		if m.Id == "1" && attempts[m.Id] <= 2 {
+			return verror.New(verror.ErrNoServers, nil)
+		}
+		sent <- m.Id
+		return nil
+	}
+	fail := func(f sendFailure) {
+		t.Errorf("Unexpected failure sending message %v: %v", f.MessageID, f.Err)
+	}
+	q := newSendQueue(&Member{Name: "alice"}, send, fail)
+	q.backoff = time.Millisecond
+	defer q.close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.enqueue(vdl.Message{Id: id}); err != nil {
+			t.Fatalf("q.enqueue(%v) failed: %v", id, err)
+		}
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Errorf("Got message %v, want %v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timeout waiting for message %v", want)
+		}
+	}
+}
+
+func TestSendQueueReportsPermanentFailure(t *testing.T) {
+	failures := make(chan sendFailure, 10)
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	send := func(m vdl.Message) error {
+		mu.Lock()
+		attempts[m.Id]++
+		mu.Unlock()
+		if m.Id == "transient" {
+			return verror.New(verror.ErrNoServers, nil)
+		}
+		return verror.New(verror.ErrBadArg, nil)
+	}
+	fail := func(f sendFailure) {
+		failures <- f
+	}
+	q := newSendQueue(&Member{Name: "alice"}, send, fail)
+	q.backoff = time.Millisecond
+	defer q.close()
+
+	for _, id := range []string{"permanent", "transient"} {
+		if err := q.enqueue(vdl.Message{Id: id}); err != nil {
+			t.Fatalf("q.enqueue(%v) failed: %v", id, err)
+		}
+		select {
+		case f := <-failures:
+			if f.MessageID != id {
+				t.Errorf("Got failure for message %v, want %v", f.MessageID, id)
+			}
+			if got, want := f.Member.Name, "alice"; got != want {
+				t.Errorf("Got f.Member.Name = %v, want %v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timeout waiting for failure of message %v", id)
+		}
+	}
+	// Permanent failures are not retried.
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := attempts["permanent"], 1; got != want {
+		t.Errorf("Got %d attempts for the permanent failure, want %d", got, want)
+	}
+	if got, want := attempts["transient"], maxSendAttempts; got != want {
+		t.Errorf("Got %d attempts for the transient failure, want %d", got, want)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	connection := verror.IDAction{ID: "v.io/x/chat/chatlib.testConnection", Action: verror.RetryConnection}
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{verror.New(verror.ErrTimeout, nil), true},
+		{verror.New(verror.ErrNoServers, nil), true},
+		{verror.New(connection, nil), true},
+		// Errors that suggest refetching the name are not transient.
+		{verror.New(verror.ErrNoAccess, nil), false},
+		{verror.New(verror.ErrNotTrusted, nil), false},
+		{verror.New(verror.ErrBadArg, nil), false},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.transient {
+			t.Errorf("isTransient(%v) = %v, want %v", test.err, got, test.transient)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"v.io/v23"
+	"v.io/v23/security"
+	"v.io/v23/vom"
+
+	"v.io/x/chat/vdl"
+)
+
+// messageSignatureBytes returns the bytes of a message that are signed by its
+// sender.  Encrypted messages are signed as they are sent, i.e. the ciphertext
+// is signed rather than the text.
+func messageSignatureBytes(m vdl.Message) []byte {
+	var b bytes.Buffer
+	writeField(&b, []byte("v.io/x/chat Message"))
+	writeField(&b, []byte(m.Id))
+	binary.Write(&b, binary.BigEndian, m.Timestamp.UnixNano())
+	writeField(&b, []byte(m.Channel))
+	writeField(&b, []byte(m.Kind.String()))
+	writeField(&b, []byte(m.Text))
+	binary.Write(&b, binary.BigEndian, m.Clock)
+	writeField(&b, []byte(m.ReplyTo))
+	binary.Write(&b, binary.BigEndian, m.Private)
+	writeField(&b, []byte(m.KeyId))
+	writeField(&b, m.Nonce)
+	writeField(&b, m.Ciphertext)
+	writeField(&b, []byte(m.OnBehalfOf))
+	writeField(&b, []byte(m.Target))
+	writeField(&b, []byte(m.Parent))
+	return b.Bytes()
+}
+
+// signMessage signs a message we send with our principal and default
+// blessings.
+func (cr *Channel) signMessage(m *vdl.Message) error {
+	p := v23.GetPrincipal(cr.ctx)
+	m.Signer, _ = p.BlessingStore().Default()
+	var err error
+	m.Signature, err = p.Sign(messageSignatureBytes(*m))
+	return err
+}
+
+// verifyMessage checks the signature of a message.  If the signature is valid,
+// the sender of the message is set to the blessing names that the message was
+// signed with, since those do not depend on how the message reached us.
+// Otherwise the message is marked as unverified, and keeps the sender it was
+// given by whoever passed it to us.
+func (cr *Channel) verifyMessage(m *Message) {
+	m.Unverified = true
+	if len(m.Signer) == 0 {
+		// Older clients do not sign their messages.
+		return
+	}
+	var signer security.Blessings
+	if err := vom.Decode(m.Signer, &signer); err != nil {
+		return
+	}
+	if !m.Signature.Verify(signer.PublicKey(), messageSignatureBytes(m.vdlMessage())) {
+		return
+	}
+	names, _ := security.SigningBlessingNames(cr.ctx, v23.GetPrincipal(cr.ctx), signer)
+	if len(names) == 0 {
+		return
+	}
+	m.SenderBlessings = names
+	m.SenderName = firstShortName(names)
+	m.Unverified = false
+	m.RelayTrusted = m.OnBehalfOf != "" && cr.isTrustedBridge(names)
+}
+
+// isTrustedBridge returns true if the principal with the given blessings is
+// trusted to relay messages on behalf of other users.
+func (cr *Channel) isTrustedBridge(blessings []string) bool {
+	if cr.hasOwnBlessings(blessings) {
+		return true
+	}
+	for _, p := range cr.trustedBridges {
+		if p.MatchedBy(blessings...) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOwnBlessings returns true if the given blessings include one of our
+// default blessings.
+func (cr *Channel) hasOwnBlessings(blessings []string) bool {
+	for _, p := range security.DefaultBlessingPatterns(v23.GetPrincipal(cr.ctx)) {
+		if p.MatchedBy(blessings...) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareMessage verifies and decrypts a message we received, from its sender
+// or from the history of the given member.
+func (cr *Channel) prepareMessage(m *Message, from *Member) {
+	cr.verifyMessage(m)
+	cr.decrypt(m, from)
+}
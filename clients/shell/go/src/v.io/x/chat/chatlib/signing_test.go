@@ -0,0 +1,56 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"v.io/x/chat/vdl"
+)
+
+func TestMessageSignatureBytes(t *testing.T) {
+	m := vdl.Message{
+		Id:        "1",
+		Timestamp: time.Unix(1445000000, 123),
+		Channel:   "path/to/channel",
+		Kind:      vdl.MessageKindText,
+		Text:      "hello",
+		Clock:     7,
+		ReplyTo:   "path/to/channel/me",
+	}
+	signed := messageSignatureBytes(m)
+
+	// A message received and stored is signed the same way it was sent.
+	if got := messageSignatureBytes(newMessage(nil, m).vdlMessage()); !bytes.Equal(got, signed) {
+		t.Errorf("Signature bytes changed after a round trip through message")
+	}
+
+	changes := map[string]func(*vdl.Message){
+		"Id":         func(m *vdl.Message) { m.Id = "2" },
+		"Timestamp":  func(m *vdl.Message) { m.Timestamp = m.Timestamp.Add(time.Nanosecond) },
+		"Channel":    func(m *vdl.Message) { m.Channel = "another/channel" },
+		"Kind":       func(m *vdl.Message) { m.Kind = vdl.MessageKindAction },
+		"Text":       func(m *vdl.Message) { m.Text = "hellO" },
+		"Clock":      func(m *vdl.Message) { m.Clock = 8 },
+		"ReplyTo":    func(m *vdl.Message) { m.ReplyTo = "somebody/else" },
+		"Private":    func(m *vdl.Message) { m.Private = true },
+		"KeyId":      func(m *vdl.Message) { m.KeyId = "key" },
+		"Ciphertext": func(m *vdl.Message) { m.Ciphertext = []byte("x") },
+		"OnBehalfOf": func(m *vdl.Message) { m.OnBehalfOf = "bob" },
+		"Target":     func(m *vdl.Message) { m.Target = "0" },
+		"Parent":     func(m *vdl.Message) { m.Parent = "0" },
+		// Moving bytes between fields changes the signed bytes too.
+		"Channel and Text": func(m *vdl.Message) { m.Channel, m.Text = m.Channel+"h", "ello" },
+	}
+	for field, change := range changes {
+		changed := m
+		change(&changed)
+		if bytes.Equal(messageSignatureBytes(changed), signed) {
+			t.Errorf("Changing %s does not change the signed bytes", field)
+		}
+	}
+}
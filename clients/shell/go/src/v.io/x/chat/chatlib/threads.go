@@ -0,0 +1,27 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"v.io/x/chat/vdl"
+)
+
+// WithParent makes a message we send a reply to the message with the given
+// ID, which should start a thread.  Use ThreadID to find it.
+func WithParent(id string) MessageOption {
+	return func(m *vdl.Message) {
+		m.Parent = id
+	}
+}
+
+// ThreadID returns the ID of the thread that m belongs to, which is the ID of
+// the message that started it.  Messages that are not replies start threads of
+// their own.
+func (m Message) ThreadID() string {
+	if m.Parent != "" {
+		return m.Parent
+	}
+	return m.ID
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"v.io/v23/security"
+	"v.io/x/chat/vdl"
+)
+
+// Note, shortName and firstShortName are duplicated between JS and Go.
+func shortName(fullName string) string {
+	// Split into components and see if any is an email address. A very
+	// sophisticated technique is used to determine if the component is an email
+	// address: presence of an "@" character.
+	parts := strings.Split(string(fullName), security.ChainSeparator)
+	for _, p := range parts {
+		if strings.Count(p, "@") == 1 {
+			return p
+		}
+	}
+
+	// If no email address is found, use the fullName. Useful for testing.
+	return fullName
+}
+
+// ShortName returns the name we display for a principal with the given
+// blessings.
+func ShortName(blessings []string) string {
+	return firstShortName(blessings)
+}
+
+func firstShortName(blessings []string) string {
+	if len(blessings) == 0 {
+		return "unknown"
+	}
+	for _, blessing := range blessings {
+		if sn := shortName(blessing); sn != "" {
+			return sn
+		}
+	}
+	return string(blessings[0])
+}
+
+// NewMessageID returns a random identifier for a message.  It is long enough
+// that collisions between messages are not a concern.
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithID sets the ID of a message, which must have been returned by
+// NewMessageID.  It lets the caller recognize the message if it comes back
+// before the call that sends it returns.
+func WithID(id string) MessageOption {
+	return func(m *vdl.Message) {
+		m.Id = id
+	}
+}
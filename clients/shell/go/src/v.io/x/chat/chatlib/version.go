@@ -0,0 +1,84 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"sync"
+
+	"v.io/v23/context"
+	"v.io/v23/verror"
+	"v.io/x/chat/vdl"
+)
+
+// versionTracker caches the protocol version of members, so that messages
+// that older clients cannot decode are not sent to them.
+type versionTracker struct {
+	// Mutex to protect versions.
+	mu sync.Mutex
+	// versions holds the protocol version of each member, keyed by member
+	// path.
+	versions map[string]int32
+}
+
+func newVersionTracker() *versionTracker {
+	return &versionTracker{
+		versions: make(map[string]int32),
+	}
+}
+
+// lookup returns the cached version of the member at path, if any.
+func (vt *versionTracker) lookup(path string) (int32, bool) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	v, ok := vt.versions[path]
+	return v, ok
+}
+
+// record records the version of the member at path.
+func (vt *versionTracker) record(path string, version int32) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	vt.versions[path] = version
+}
+
+// forget drops the versions of all members whose path is not in paths.  A
+// member that is mounted again at the same path may run another client.
+func (vt *versionTracker) forget(paths map[string]bool) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	for path := range vt.versions {
+		if !paths[path] {
+			delete(vt.versions, path)
+		}
+	}
+}
+
+// requiredVersion returns the protocol version a member must implement to
+// decode messages of the given kind.
+func requiredVersion(kind vdl.MessageKind) int32 {
+	switch kind {
+	case vdl.MessageKindText, vdl.MessageKindAction:
+		return 1
+	}
+	return 2
+}
+
+// peerVersion returns the protocol version of a member.  ctx must carry the
+// deadline of the call.
+func (cr *Channel) peerVersion(ctx *context.T, member *Member) (int32, error) {
+	if v, ok := cr.versions.lookup(member.Path); ok {
+		return v, nil
+	}
+	v, err := vdl.ChatClient(member.Path).Version(ctx, callOptsFor(member.Blessings)...)
+	if verror.ErrorID(err) == verror.ErrUnknownMethod.ID {
+		// Clients that do not implement Version implement version 1.
+		v, err = 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cr.versions.record(member.Path, v)
+	return v, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chatlib
+
+import (
+	"testing"
+
+	"v.io/x/chat/vdl"
+)
+
+func TestRequiredVersion(t *testing.T) {
+	for _, kind := range vdl.MessageKindAll {
+		got := requiredVersion(kind)
+		want := vdl.ProtocolVersion
+		if kind == vdl.MessageKindText || kind == vdl.MessageKindAction {
+			want = 1
+		}
+		if got != want {
+			t.Errorf("requiredVersion(%v) = %d, want %d", kind, got, want)
+		}
+	}
+}
+
+func TestVersionTracker(t *testing.T) {
+	vt := newVersionTracker()
+	if _, ok := vt.lookup("a"); ok {
+		t.Errorf("Unknown member has a version")
+	}
+	vt.record("a", 1)
+	vt.record("b", 2)
+	if v, ok := vt.lookup("a"); !ok || v != 1 {
+		t.Errorf("lookup(a) = %d, %v, want 1, true", v, ok)
+	}
+	vt.forget(map[string]bool{"b": true})
+	if _, ok := vt.lookup("a"); ok {
+		t.Errorf("Member has a version after being forgotten")
+	}
+	if v, ok := vt.lookup("b"); !ok || v != 2 {
+		t.Errorf("lookup(b) = %d, %v, want 2, true", v, ok)
+	}
+}
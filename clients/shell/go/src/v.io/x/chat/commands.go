@@ -0,0 +1,176 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// command is a command that can be typed in the message input, prefixed with
+// a "/", e.g. "/join <channel>".
+type command struct {
+	// name is the name of the command, without the "/".
+	name string
+	// args describes the arguments of the command, e.g. "<name> <text>".
+	args string
+	// help is a one-line description of the command.
+	help string
+	// minArgs and maxArgs are the allowed number of arguments.  If rest is
+	// true, the last argument is the rest of the line, and may contain
+	// spaces.
+	minArgs, maxArgs int
+	rest             bool
+	// run runs the command with the given arguments.  It is only called
+	// with an allowed number of arguments.
+	run func(args []string) error
+	// complete, if set, returns the possible values of the argument at the
+	// given index, for tab completion.
+	complete func(arg int) []string
+}
+
+// usage returns the usage line of the command, e.g. "/join <channel>".
+func (c *command) usage() string {
+	if c.args == "" {
+		return "/" + c.name
+	}
+	return "/" + c.name + " " + c.args
+}
+
+// commandError is an error caused by a command typed by the user.  Its text is
+// shown in the history view.
+type commandError string
+
+func (e commandError) Error() string {
+	return string(e)
+}
+
+// commandRegistry holds the commands that can be typed in the message input.
+// Commands are registered by the subsystems that implement them.
+type commandRegistry struct {
+	// Mutex to protect commands.
+	mu       sync.Mutex
+	commands map[string]*command
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{
+		commands: make(map[string]*command),
+	}
+}
+
+// register adds a command to the registry.  It returns an error if a command
+// with the same name is already registered.
+func (r *commandRegistry) register(c *command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.commands[c.name]; ok {
+		return fmt.Errorf("command /%s is already registered", c.name)
+	}
+	r.commands[c.name] = c
+	return nil
+}
+
+// lookup returns the command with the given name, or nil if there is none.
+func (r *commandRegistry) lookup(name string) *command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commands[name]
+}
+
+// list returns all registered commands, sorted by name.
+func (r *commandRegistry) list() []*command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cmds := make([]*command, 0, len(r.commands))
+	for _, c := range r.commands {
+		cmds = append(cmds, c)
+	}
+	sort.Sort(byCommandName(cmds))
+	return cmds
+}
+
+type byCommandName []*command
+
+func (b byCommandName) Len() int           { return len(b) }
+func (b byCommandName) Less(i, j int) bool { return b[i].name < b[j].name }
+func (b byCommandName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// isCommand returns true if the line typed in the message input is a command.
+// A line starting with "//" is a message starting with "/".
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//")
+}
+
+// parse finds the command for a line typed in the message input, and splits
+// the arguments of the command.  The line must start with "/".
+func (r *commandRegistry) parse(line string) (*command, []string, error) {
+	name, rest := splitWord(strings.TrimPrefix(line, "/"))
+	c := r.lookup(name)
+	if c == nil {
+		return nil, nil, commandError(fmt.Sprintf("Unknown command /%s.  Type /help for a list of commands.", name))
+	}
+	var args []string
+	for rest != "" && (!c.rest || len(args) < c.maxArgs-1) {
+		var arg string
+		arg, rest = splitWord(rest)
+		args = append(args, arg)
+	}
+	if rest != "" {
+		args = append(args, rest)
+	}
+	if len(args) < c.minArgs || len(args) > c.maxArgs {
+		return nil, nil, commandError("Usage: " + c.usage())
+	}
+	return c, args, nil
+}
+
+// run parses and runs a command.
+func (r *commandRegistry) run(line string) error {
+	c, args, err := r.parse(line)
+	if err != nil {
+		return err
+	}
+	return c.run(args)
+}
+
+// completions returns the possible completions of the last word of a line
+// typed in the message input, which must be a command.
+func (r *commandRegistry) completions(line string) []string {
+	name, rest := splitWord(strings.TrimPrefix(line, "/"))
+	if rest == "" && !strings.HasSuffix(line, " ") {
+		// Complete the command name.
+		var names []string
+		for _, c := range r.list() {
+			if strings.HasPrefix(c.name, name) {
+				names = append(names, "/"+c.name)
+			}
+		}
+		return names
+	}
+	c := r.lookup(name)
+	if c == nil || c.complete == nil {
+		return nil
+	}
+	arg := len(strings.Fields(rest))
+	if !strings.HasSuffix(line, " ") {
+		arg--
+	}
+	return c.complete(arg)
+}
+
+// splitWord splits the first word off s, and returns it and the rest of s
+// with leading spaces removed.
+func splitWord(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, got *[]string) *commandRegistry {
+	r := newCommandRegistry()
+	record := func(args []string) error {
+		*got = args
+		return nil
+	}
+	cmds := []*command{
+		{name: "join", args: "<channel>", minArgs: 1, maxArgs: 1, run: record,
+			complete: func(arg int) []string {
+				if arg != 0 {
+					return nil
+				}
+				return []string{"public", "private"}
+			}},
+		{name: "msg", args: "<name> <text>", minArgs: 2, maxArgs: 2, rest: true, run: record},
+		{name: "me", args: "<text>", minArgs: 1, maxArgs: 1, rest: true, run: record},
+		{name: "quit", run: record},
+	}
+	for _, c := range cmds {
+		if err := r.register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestRunCommand(t *testing.T) {
+	var got []string
+	r := newTestRegistry(t, &got)
+
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"/join public", []string{"public"}},
+		{"/msg  alice   hi  there", []string{"alice", "hi  there"}},
+		{"/me waves", []string{"waves"}},
+		{"/quit", nil},
+	}
+	for _, test := range tests {
+		got = nil
+		if err := r.run(test.line); err != nil {
+			t.Errorf("run(%q) failed: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("run(%q) got args %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{"/join", "/join a b", "/msg alice", "/quit now", "/nope"} {
+		if _, ok := r.run(line).(commandError); !ok {
+			t.Errorf("run(%q) did not return a commandError", line)
+		}
+	}
+
+	if err := r.register(&command{name: "join"}); err == nil {
+		t.Errorf("Registering /join twice should fail")
+	}
+}
+
+func TestCommandCompletions(t *testing.T) {
+	r := newTestRegistry(t, new([]string))
+
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"/", []string{"/join", "/me", "/msg", "/quit"}},
+		{"/m", []string{"/me", "/msg"}},
+		{"/join p", []string{"public", "private"}},
+		{"/join public p", nil},
+		{"/msg a", nil},
+	}
+	for _, test := range tests {
+		got := r.completions(test.line)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("completions(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	if !isCommand("/join public") {
+		t.Errorf("/join public should be a command")
+	}
+	if isCommand("//join public") || isCommand("hello /join") {
+		t.Errorf("Only lines starting with a single / should be commands")
+	}
+}
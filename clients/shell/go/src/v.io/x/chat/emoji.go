@@ -0,0 +1,99 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"v.io/x/chat/chatlib"
+)
+
+// emojis maps the short codes that can be used in reactions to the emojis
+// they stand for.  Reactions are sent as short codes, so that clients can show
+// them however they can.
+var emojis = map[string]string{
+	"thumbsup":   "👍",
+	"thumbsdown": "👎",
+	"heart":      "❤️",
+	"smile":      "😄",
+	"laughing":   "😆",
+	"joy":        "😂",
+	"wink":       "😉",
+	"confused":   "😕",
+	"cry":        "😢",
+	"scream":     "😱",
+	"thinking":   "🤔",
+	"eyes":       "👀",
+	"tada":       "🎉",
+	"clap":       "👏",
+	"pray":       "🙏",
+	"wave":       "👋",
+	"ok_hand":    "👌",
+	"muscle":     "💪",
+	"fire":       "🔥",
+	"rocket":     "🚀",
+	"star":       "⭐",
+	"100":        "💯",
+	"check":      "✅",
+	"x":          "❌",
+	"warning":    "⚠️",
+	"question":   "❓",
+	"coffee":     "☕",
+	"beer":       "🍺",
+	"bug":        "🐛",
+	"ship":       "🚢",
+}
+
+// emojiAliases maps other common names of emojis to their short codes.
+var emojiAliases = map[string]string{
+	"+1":    "thumbsup",
+	"-1":    "thumbsdown",
+	"like":  "thumbsup",
+	"love":  "heart",
+	"lol":   "laughing",
+	"party": "tada",
+	"ok":    "ok_hand",
+	"yes":   "check",
+	"no":    "x",
+}
+
+// emojiForCode returns the emoji for a short code, or the code between colons
+// if it is not in the table, e.g. because it was sent by a newer client.
+func emojiForCode(code string) string {
+	if e, ok := emojis[code]; ok {
+		return e
+	}
+	return ":" + code + ":"
+}
+
+// parseEmoji returns the short code for an emoji typed by the user, as a
+// short code with or without colons, an alias, or the emoji itself.
+func parseEmoji(s string) (string, bool) {
+	code := strings.ToLower(strings.Trim(s, ":"))
+	if c, ok := emojiAliases[code]; ok {
+		code = c
+	}
+	if _, ok := emojis[code]; ok {
+		return code, chatlib.ValidReactionCode(code)
+	}
+	for c, e := range emojis {
+		if e == s {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// emojiCompletions returns the short codes of the emojis, between colons, for
+// tab completion.
+func emojiCompletions() []string {
+	var codes []string
+	for code := range emojis {
+		codes = append(codes, ":"+code+":")
+	}
+	sort.Strings(codes)
+	return codes
+}
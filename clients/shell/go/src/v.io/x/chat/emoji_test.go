@@ -0,0 +1,25 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseEmoji(t *testing.T) {
+	tests := map[string]string{
+		":thumbsup:": "thumbsup",
+		"thumbsup":   "thumbsup",
+		":+1:":       "thumbsup",
+		"👍":          "thumbsup",
+		":TADA:":     "tada",
+		":nope:":     "",
+	}
+	for s, want := range tests {
+		if got, _ := parseEmoji(s); got != want {
+			t.Errorf("parseEmoji(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"v.io/v23/verror"
+	"v.io/x/chat/chatlib"
+)
+
+// registerFileCommands registers the commands that send files and answer the
+// files offered to us.
+func (a *app) registerFileCommands() error {
+	commands := []*command{
+		{
+			name:     "send",
+			args:     "<name> <path>",
+			help:     "Send a file to a member of the current channel, once they accept it.",
+			minArgs:  2,
+			maxArgs:  2,
+			rest:     true,
+			run:      a.sendCommand,
+			complete: a.completeSend,
+		},
+		{
+			name: "accept",
+			help: "Accept the oldest file offered to you in the current private conversation.",
+			run:  a.acceptCommand,
+		},
+		{
+			name: "reject",
+			help: "Reject the oldest file offered to you in the current private conversation.",
+			run:  a.rejectCommand,
+		},
+	}
+	for _, c := range commands {
+		if err := a.commands.register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *app) sendCommand(args []string) error {
+	cr := a.currentTab().cr
+	peer, err := a.resolveMember(cr, args[0])
+	if err != nil {
+		return err
+	}
+	ft, err := cr.SendFile(peer, expandHome(args[1]))
+	if verror.ErrorID(err) == verror.ErrNoExist.ID {
+		return commandError(fmt.Sprintf("'%s' is no longer in '%s'.", args[0], cr.Path()))
+	}
+	if err != nil {
+		return commandError(fmt.Sprintf("Could not send '%s': %v", args[1], err))
+	}
+	t := a.privateTab(cr, []string{peer})
+	a.switchTab(a.tabIndex(t))
+	t.hw.setTransfer(ft)
+	return nil
+}
+
+// expandHome replaces a leading ~ in a path with the home directory.
+func expandHome(path string) string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return path
+	}
+	if path == "~" {
+		return home
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
+
+func (a *app) acceptCommand(args []string) error {
+	o, ok := a.conversationTab(a.currentTab()).takeOffer()
+	if !ok {
+		return commandError("No file is waiting to be accepted here.")
+	}
+	o.Accept()
+	a.print(yellow(fmt.Sprintf("Receiving %s from %s into %s.", o.Name, o.Sender, *downloadDir)))
+	return nil
+}
+
+func (a *app) rejectCommand(args []string) error {
+	o, ok := a.conversationTab(a.currentTab()).takeOffer()
+	if !ok {
+		return commandError("No file is waiting to be rejected here.")
+	}
+	o.Reject()
+	a.print(yellow(fmt.Sprintf("Rejected %s from %s.", o.Name, o.Sender)))
+	return nil
+}
+
+// completeSend completes the member names that /send takes.
+func (a *app) completeSend(arg int) []string {
+	if arg != 0 {
+		return nil
+	}
+	return a.completeMember(arg)
+}
+
+// offerFile shows a file that a member offered to send us in the tab of the
+// private conversation with them, where it can be accepted.
+func (a *app) offerFile(cr *chatlib.Channel, o chatlib.FileOffer) *chatTab {
+	t := a.privateTab(cr, o.SenderBlessings)
+	t.addOffer(o)
+	t.hw.writeWordWrap([]byte(yellow(fmt.Sprintf(
+		"%s wants to send you %s (%s).  Type /accept to receive it, or /reject.", o.Sender, o.Name, formatSize(o.Size))) + "\n"))
+	return t
+}
+
+// formatTransfer formats the state of a file transfer, with a progress bar
+// until it is finished.
+func formatTransfer(t chatlib.FileTransfer) string {
+	size := formatSize(t.Size)
+	switch {
+	case t.Complete && t.Incoming:
+		return green(fmt.Sprintf("Received %s (%s) from %s, saved as %s.", t.Name, size, t.Peer, t.Path))
+	case t.Complete:
+		return green(fmt.Sprintf("Sent %s (%s) to %s.", t.Name, size, t.Peer))
+	case t.Incoming && t.Err != nil:
+		return red(fmt.Sprintf("Receiving %s from %s stopped: %v", t.Name, t.Peer, t.Err))
+	case verror.ErrorID(t.Err) == verror.ErrNoAccess.ID:
+		return red(fmt.Sprintf("%s did not accept %s.", t.Peer, t.Name))
+	case t.Err != nil:
+		return red(fmt.Sprintf("Could not send %s to %s: %v", t.Name, t.Peer, t.Err))
+	}
+	verb, dir := "Sending", "to"
+	if t.Incoming {
+		verb, dir = "Receiving", "from"
+	}
+	f := fmt.Sprintf("%s %s (%s) %s %s ", verb, t.Name, size, dir, t.Peer)
+	if t.Done == 0 && !t.Incoming {
+		return yellow(f + "waiting for it to be accepted...")
+	}
+	return yellow(f + progressBar(t.Done, t.Size))
+}
+
+// progressBarWidth is the number of characters in a progress bar, not
+// counting its brackets.
+const progressBarWidth = 20
+
+// progressBar draws how much of a total is done, e.g. "[=====     ] 50%".
+func progressBar(done, total int64) string {
+	percent := int64(100)
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	filled := int(percent * progressBarWidth / 100)
+	return fmt.Sprintf("[%s%s] %d%%", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), percent)
+}
+
+// formatSize formats a number of bytes in the largest unit it has at least
+// one of, e.g. "1.5 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// addOffer adds a file offered to us in the private conversation of the tab.
+func (t *chatTab) addOffer(o chatlib.FileOffer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.offers = append(t.offers, o)
+}
+
+// takeOffer removes the oldest file offered to us in the tab that has not
+// expired, and returns it.
+func (t *chatTab) takeOffer() (chatlib.FileOffer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for len(t.offers) > 0 {
+		o := t.offers[0]
+		t.offers = t.offers[1:]
+		if now.Before(o.Expires) {
+			return o, true
+		}
+	}
+	return chatlib.FileOffer{}, false
+}
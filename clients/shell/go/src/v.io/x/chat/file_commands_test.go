@@ -0,0 +1,24 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestFormatSize(t *testing.T) {
+	for _, test := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{1 << 30, "1.0 GiB"},
+	} {
+		if got := formatSize(test.n); got != test.want {
+			t.Errorf("formatSize(%d): got %q, want %q", test.n, got, test.want)
+		}
+	}
+}
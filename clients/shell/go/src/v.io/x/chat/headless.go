@@ -0,0 +1,414 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// In headless mode the chat client has no UI.  It reads commands from stdin
+// and writes events to stdout, one JSON object per line, so that it can be
+// driven by scripts, bots and tests.
+//
+// Commands have a "cmd" field, and may have an "id" field, which is copied to
+// the events the command causes:
+//
+//  {"cmd": "send", "channel": "path/to/channel", "text": "hello"}
+//  {"cmd": "send", "text": "waves", "kind": "action"}
+//  {"cmd": "send", "text": "me too", "parent": "<message id>"}
+//  {"cmd": "dm", "to": "alice", "text": "hello"}
+//  {"cmd": "edit", "target": "<message id>", "text": "hello, world"}
+//  {"cmd": "delete", "target": "<message id>"}
+//  {"cmd": "react", "target": "<message id>", "text": "thumbsup"}
+//  {"cmd": "unreact", "target": "<message id>", "text": "thumbsup"}
+//  {"cmd": "join", "channel": "path/to/channel"}
+//  {"cmd": "leave", "channel": "path/to/channel"}
+//  {"cmd": "members", "channel": "path/to/channel", "id": "1"}
+//
+// The channel defaults to the first channel joined.  Events have an "event"
+// field, which is one of "message", "join", "leave", "members" or "error":
+//
+//  {"event": "message", "channel": "...", "message_id": "...", "sender": "alice", "blessings": [...], "text": "hello", "kind": "text", "timestamp": "..."}
+//  {"event": "join", "channel": "...", "member": "alice"}
+//  {"event": "leave", "channel": "...", "member": "alice"}
+//  {"event": "members", "channel": "...", "members": ["alice", "bob"], "id": "1"}
+//  {"event": "error", "error": "...", "id": "..."}
+//
+// Join and leave events are sent when other members join or leave, and when
+// we join or leave a channel ourselves.  Messages relayed by a bridge have an
+// "on_behalf_of" field, with the name of the user the bridge relayed the
+// message for.
+//
+// Replies to a message have a "parent" field with the ID of the message that
+// started their thread.  Replying to a reply should name the parent of that
+// reply, so that threads stay one level deep.
+//
+// Edits and deletions of messages are sent as message events with a kind of
+// "edit" or "delete", and a "target" field with the ID of the message they
+// apply to.  Only the sender of a message can edit or delete it, so clients
+// should check that the blessings of the event match those of its target.
+// Edits and deletions of private messages are sent with a "to" field.
+//
+// Reactions are sent and received like edits, with a kind of "react" or
+// "unreact", and the short code of an emoji as their text.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/verror"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+)
+
+// maxCommandSize is the maximum length of a command line in headless mode.
+const maxCommandSize = 1 << 20
+
+// headlessCommand is a command read from stdin in headless mode.
+type headlessCommand struct {
+	ID      string `json:"id,omitempty"`
+	Cmd     string `json:"cmd"`
+	Channel string `json:"channel,omitempty"`
+	To      string `json:"to,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Parent  string `json:"parent,omitempty"`
+}
+
+// headlessEvent is an event written to stdout in headless mode.  Only the
+// fields that apply to the kind of event are set.
+type headlessEvent struct {
+	Event      string   `json:"event"`
+	ID         string   `json:"id,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+	MessageID  string   `json:"message_id,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	OnBehalfOf string   `json:"on_behalf_of,omitempty"`
+	Blessings  []string `json:"blessings,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	Kind       string   `json:"kind,omitempty"`
+	Target     string   `json:"target,omitempty"`
+	Parent     string   `json:"parent,omitempty"`
+	Timestamp  string   `json:"timestamp,omitempty"`
+	Private    bool     `json:"private,omitempty"`
+	Unverified bool     `json:"unverified,omitempty"`
+	Member     string   `json:"member,omitempty"`
+	Members    []string `json:"members,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// messageEvent returns the event for a message received in a channel.
+func messageEvent(path string, m chatlib.Message) headlessEvent {
+	return headlessEvent{
+		Event:      "message",
+		Channel:    path,
+		MessageID:  m.ID,
+		Sender:     m.SenderName,
+		OnBehalfOf: m.RelayedFor(),
+		Blessings:  m.SenderBlessings,
+		Text:       m.Text,
+		Kind:       strings.ToLower(m.Kind.String()),
+		Target:     m.Target,
+		Parent:     m.Parent,
+		Timestamp:  m.Timestamp.Format(time.RFC3339Nano),
+		Private:    m.Private,
+		Unverified: m.Unverified,
+	}
+}
+
+// headlessClient runs the chat client without a UI.
+type headlessClient struct {
+	ctx       *context.T
+	blocklist *blocklist
+	limits    chatlib.InboundLimits
+	// Mutex to protect out.
+	outMu sync.Mutex
+	out   *json.Encoder
+	// Mutex to protect channels.
+	mu sync.Mutex
+	// Joined channels, in the order they were joined.
+	channels []*chatlib.Channel
+}
+
+// runHeadless joins the channels given by the flags, and runs the commands
+// read from in until it is closed.  Events are written to out.  Errors are
+// reported as error events, including the error returned if the client cannot
+// start.
+func runHeadless(in io.Reader, out io.Writer) error {
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	h := &headlessClient{
+		ctx: ctx,
+		out: json.NewEncoder(out),
+	}
+	err := h.start()
+	if err == nil {
+		err = h.run(in)
+	}
+	h.leaveAll()
+	if err != nil {
+		h.emitError("", err)
+	}
+	return err
+}
+
+// start loads the configuration, and joins the channels given by the flags.
+func (h *headlessClient) start() error {
+	var err error
+	if h.limits, err = inboundLimitsFromFlags(); err != nil {
+		return err
+	}
+	if h.blocklist, err = loadBlocklist(*configFile); err != nil {
+		return err
+	}
+	for _, name := range strings.Split(*channelNames, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := h.join("", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run runs the commands read from in, until in is closed.
+func (h *headlessClient) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 4096), maxCommandSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var cmd headlessCommand
+		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+			h.emitError("", verror.New(verror.ErrBadArg, h.ctx, "command "+line))
+			continue
+		}
+		if err := h.runCommand(cmd); err != nil {
+			h.emitError(cmd.ID, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// runCommand runs a single command.
+func (h *headlessClient) runCommand(cmd headlessCommand) error {
+	if cmd.Cmd == "join" {
+		if cmd.Channel == "" {
+			return verror.New(verror.ErrBadArg, h.ctx, "join needs a channel")
+		}
+		return h.join(cmd.ID, cmd.Channel)
+	}
+	cr, err := h.channel(cmd.Channel)
+	if err != nil {
+		return err
+	}
+	kind, ok := parseTextKind(cmd.Kind)
+	if !ok {
+		return verror.New(verror.ErrBadArg, h.ctx, "kind "+cmd.Kind)
+	}
+	var opts []chatlib.MessageOption
+	if cmd.Parent != "" {
+		opts = append(opts, chatlib.WithParent(cmd.Parent))
+	}
+	switch cmd.Cmd {
+	case "send":
+		return cr.Broadcast(kind, cmd.Text, opts...)
+	case "dm":
+		if cmd.To == "" {
+			return verror.New(verror.ErrBadArg, h.ctx, "dm needs a member to send to")
+		}
+		_, err := cr.Send(cmd.To, kind, cmd.Text, opts...)
+		return err
+	case "edit", "delete":
+		if cmd.Target == "" {
+			return verror.New(verror.ErrBadArg, h.ctx, cmd.Cmd+" needs a target message")
+		}
+		kind, text := vdl.MessageKindEdit, cmd.Text
+		if cmd.Cmd == "delete" {
+			kind, text = vdl.MessageKindDelete, ""
+		}
+		return sendOp(cr, cmd.To, kind, text, cmd.Target)
+	case "react", "unreact":
+		if cmd.Target == "" {
+			return verror.New(verror.ErrBadArg, h.ctx, cmd.Cmd+" needs a target message")
+		}
+		if !chatlib.ValidReactionCode(cmd.Text) {
+			return verror.New(verror.ErrBadArg, h.ctx, "emoji code "+cmd.Text)
+		}
+		kind := vdl.MessageKindReact
+		if cmd.Cmd == "unreact" {
+			kind = vdl.MessageKindUnreact
+		}
+		return sendOp(cr, cmd.To, kind, cmd.Text, cmd.Target)
+	case "leave":
+		return h.leave(cmd.ID, cr)
+	case "members":
+		members, err := cr.Members()
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, member := range members {
+			names = append(names, member.Name)
+		}
+		h.emit(headlessEvent{Event: "members", ID: cmd.ID, Channel: cr.Path(), Members: names})
+		return nil
+	}
+	return verror.New(verror.ErrBadArg, h.ctx, "unknown command "+cmd.Cmd)
+}
+
+// sendOp sends an edit, deletion or reaction of the message with the ID target
+// to a channel, or privately to the member named to if it is not empty.
+func sendOp(cr *chatlib.Channel, to string, kind vdl.MessageKind, text, target string) error {
+	if to != "" {
+		_, err := cr.Send(to, kind, text, chatlib.WithTarget(target))
+		return err
+	}
+	return cr.Broadcast(kind, text, chatlib.WithTarget(target))
+}
+
+// parseTextKind parses the kind of a message sent with text, which defaults to
+// a text message.  Edits and deletions have their own commands.
+func parseTextKind(s string) (vdl.MessageKind, bool) {
+	if s == "" {
+		return vdl.MessageKindText, true
+	}
+	kind, err := vdl.MessageKindFromString(s)
+	if err != nil || (kind != vdl.MessageKindText && kind != vdl.MessageKindAction) {
+		return kind, false
+	}
+	return kind, true
+}
+
+// channel returns the joined channel at path, or the first channel joined if
+// path is empty.
+func (h *headlessClient) channel(path string) (*chatlib.Channel, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, cr := range h.channels {
+		if path == "" || cr.Path() == path {
+			return cr, nil
+		}
+	}
+	if path == "" {
+		return nil, verror.New(verror.ErrNoExist, h.ctx, "no channel joined")
+	}
+	return nil, verror.New(verror.ErrNoExist, h.ctx, "channel "+path+" not joined")
+}
+
+// join joins the channel at path, and starts writing its events.  Joining a
+// channel we are already in does nothing.
+func (h *headlessClient) join(id, path string) error {
+	if _, err := h.channel(path); err == nil {
+		return nil
+	}
+	cr, err := openChannel(h.ctx, path, h.blocklist, h.limits)
+	if err != nil {
+		return err
+	}
+	if err := cr.Join(); err != nil {
+		cr.Close()
+		return err
+	}
+	h.mu.Lock()
+	h.channels = append(h.channels, cr)
+	h.mu.Unlock()
+
+	go h.watchMembers(cr)
+	go h.writeEvents(cr)
+	go cr.SyncHistory(*historySync)
+
+	h.emit(headlessEvent{Event: "join", ID: id, Channel: path, Member: cr.UserName()})
+	return nil
+}
+
+// leave leaves a channel.  The leave event is only emitted if we left it;
+// otherwise the error is returned, to be reported as an error event.
+func (h *headlessClient) leave(id string, cr *chatlib.Channel) error {
+	h.mu.Lock()
+	for i, c := range h.channels {
+		if c == cr {
+			h.channels = append(h.channels[:i], h.channels[i+1:]...)
+			break
+		}
+	}
+	h.mu.Unlock()
+	err := cr.Leave()
+	cr.Close()
+	if err != nil {
+		return err
+	}
+	h.emit(headlessEvent{Event: "leave", ID: id, Channel: cr.Path(), Member: cr.UserName()})
+	return nil
+}
+
+// leaveAll leaves all the channels we are in.
+func (h *headlessClient) leaveAll() {
+	h.mu.Lock()
+	channels := append([]*chatlib.Channel(nil), h.channels...)
+	h.mu.Unlock()
+	for _, cr := range channels {
+		if err := h.leave("", cr); err != nil {
+			h.emitError("", err)
+		}
+	}
+}
+
+// watchMembers writes join and leave events when other members join or leave
+// a channel.
+func (h *headlessClient) watchMembers(cr *chatlib.Channel) {
+	for update := range cr.WatchMembers(*membersPollInterval, *membersPollJitter) {
+		for _, e := range update.Events {
+			if cr.IsSelf(e.Member) {
+				continue
+			}
+			event := "join"
+			if e.Kind == chatlib.MemberLeft {
+				event = "leave"
+			}
+			h.emit(headlessEvent{Event: event, Channel: cr.Path(), Member: e.Member.Name})
+		}
+	}
+}
+
+// writeEvents writes the messages received in a channel, and the notices
+// about refused messages, until the channel is closed.  Messages from muted
+// principals are not written.
+func (h *headlessClient) writeEvents(cr *chatlib.Channel) {
+	for {
+		select {
+		case m := <-cr.Messages():
+			if h.blocklist.isMuted(m.SenderBlessings) {
+				continue
+			}
+			h.emit(messageEvent(cr.Path(), m))
+		case notice := <-cr.Notices():
+			h.emit(headlessEvent{Event: "error", Channel: cr.Path(), Error: notice})
+		case <-cr.Receipts():
+			// Delivery receipts are not reported.
+		case <-cr.Done():
+			return
+		}
+	}
+}
+
+// emit writes an event.
+func (h *headlessClient) emit(e headlessEvent) {
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	h.out.Encode(e)
+}
+
+// emitError writes an error event.
+func (h *headlessClient) emitError(id string, err error) {
+	h.emit(headlessEvent{Event: "error", ID: id, Error: err.Error()})
+}
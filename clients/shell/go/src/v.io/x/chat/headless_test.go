@@ -0,0 +1,66 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+)
+
+func TestMessageEvent(t *testing.T) {
+	m := chatlib.Message{
+		ID:              "1",
+		SenderName:      "alice@example.com",
+		SenderBlessings: []string{"dev.v.io:u:alice@example.com"},
+		Timestamp:       time.Unix(1445000000, 0).UTC(),
+		Kind:            vdl.MessageKindAction,
+		Text:            "waves",
+	}
+	b, err := json.Marshal(messageEvent("path/to/channel", m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"event":"message","channel":"path/to/channel","message_id":"1","sender":"alice@example.com","blessings":["dev.v.io:u:alice@example.com"],"text":"waves","kind":"action","timestamp":"2015-10-16T12:53:20Z"}`
+	if string(b) != want {
+		t.Errorf("Got %s, want %s", b, want)
+	}
+}
+
+func TestHeadlessErrors(t *testing.T) {
+	var out bytes.Buffer
+	h := &headlessClient{out: json.NewEncoder(&out)}
+	in := strings.Join([]string{
+		`not json`,
+		``,
+		`{"cmd": "join", "id": "1"}`,
+		`{"cmd": "send", "text": "hello", "id": "2"}`,
+	}, "\n")
+	if err := h.run(strings.NewReader(in)); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	dec := json.NewDecoder(&out)
+	var ids []string
+	for dec.More() {
+		var e headlessEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Event != "error" || e.Error == "" {
+			t.Errorf("Got event %+v, want an error", e)
+		}
+		ids = append(ids, e.ID)
+	}
+	// Errors are matched with the commands that caused them.
+	if got, want := strings.Join(ids, ","), ",1,2"; got != want {
+		t.Errorf("Got error IDs %q, want %q", got, want)
+	}
+}
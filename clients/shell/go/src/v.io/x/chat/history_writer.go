@@ -5,62 +5,245 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/fatih/color"
 	"github.com/kr/text"
 	"github.com/nlacasse/gocui"
+
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
 )
 
 var yellow = color.New(color.FgYellow).SprintFunc()
 var cyan = color.New(color.FgCyan).SprintFunc()
+var red = color.New(color.FgRed).SprintFunc()
+var green = color.New(color.FgGreen).SprintFunc()
 
 // historyWriter wraps the history view.  All text written to the history view
 // UI component is written though a history writer, which has methods to word
 // wrap text to the view, highlight the users name, and format messages.  When
 // messages are received, they are sent to the view through the "writeMessage"
 // method.
+//
+// The historyWriter remembers everything written to the view, so that a
+// message that arrives late can be inserted at its correct position, and so
+// that it can be detached from the view while another channel is displayed,
+// and attached to it again later.
 type historyWriter struct {
 	// Mutex to prevent concurrent  writes to the view buffer.
 	mu             sync.Mutex
 	userName       string
 	userNameRegexp *regexp.Regexp
-	view           *gocui.View
+	// view is the view written to, or nil if the historyWriter is
+	// detached.
+	view *gocui.View
+	// entries holds everything written to the view, in display order.
+	entries []historyEntry
+	// deliveries holds the delivery state of messages we sent, keyed by
+	// message ID.
+	deliveries map[string]chatlib.DeliveryStatus
+	// onDisplay, if set, is called once for every message that is
+	// displayed in the view.  It is not called for historical messages.
+	onDisplay func(chatlib.Message)
+	// pendingOps holds the edits, deletions and reactions to messages that
+	// have not been written yet, keyed by the ID of the message they apply
+	// to.
+	pendingOps map[string][]chatlib.Message
+	// replies holds the number of replies to each message, not counting
+	// the replies that were deleted.
+	replies map[string]int
+	// thread is the ID of the message that started the thread shown in the
+	// view, or empty if the view shows a whole conversation.  Replies are
+	// summarized under the messages they reply to in a whole conversation,
+	// and indented in a thread.
+	thread string
+	// selected is the ID of the selected message, or empty if there is no
+	// selection.
+	selected string
+}
+
+// historyEntry is a single piece of text, message or file transfer written to
+// the history view.
+type historyEntry struct {
+	// text is the text of the entry.  It is ignored if msg or transfer is
+	// set.
+	text []byte
+	// wrap is true if the text should be word wrapped to the width of the
+	// view.
+	wrap bool
+	// msg is the message displayed by the entry, or nil if the entry is
+	// plain text.
+	msg *chatlib.Message
+	// displayed is true if msg has been scrolled into view.
+	displayed bool
+	// edited is true if the text of msg was changed by its sender.
+	edited bool
+	// deleted is true if msg was deleted by its sender.
+	deleted bool
+	// reactions are the reactions to msg.
+	reactions chatlib.Reactions
+	// quote is the start of the message that msg replies to, as it was when
+	// msg was written, or empty if it is unknown.
+	quote string
+	// transfer is the latest state of the file transfer displayed by the
+	// entry, or nil if the entry does not display one.
+	transfer *chatlib.FileTransfer
 }
 
 var _ io.Writer = (*historyWriter)(nil)
 
 // newHistoryWriter creates a new historyWriter for the given view and
-// username.  The username will be highlighted in message text.
+// username.  The username will be highlighted in message text.  The view may be
+// nil, in which case the historyWriter starts detached.
 func newHistoryWriter(view *gocui.View, userName string) *historyWriter {
 	return &historyWriter{
 		userName:       userName,
 		userNameRegexp: regexp.MustCompile("(?i)" + userName),
 		view:           view,
+		deliveries:     make(map[string]chatlib.DeliveryStatus),
+		pendingOps:     make(map[string][]chatlib.Message),
+		replies:        make(map[string]int),
 	}
 }
 
 // Write wraps the view.Write method.  It is exported so that historyWriter
 // satisfies the Writer interface.
 func (hw *historyWriter) Write(b []byte) (int, error) {
-	return hw.view.Write(b)
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.appendEntry(historyEntry{text: append([]byte(nil), b...)})
+	return len(b), nil
 }
 
 // writeWordWrap wraps the text to the width of the view and writes it to the
 // buffer.  It also scrolls the text up if the buffer is longer than the height
 // of the view.
 func (hw *historyWriter) writeWordWrap(b []byte) {
-	width, height := hw.view.Size()
 	hw.mu.Lock()
 	defer hw.mu.Unlock()
-	hw.Write(text.WrapBytes(b, width))
+	hw.appendEntry(historyEntry{text: b, wrap: true})
+}
+
+// appendEntry writes an entry to the end of the view.  hw.mu must be held.
+func (hw *historyWriter) appendEntry(e historyEntry) {
+	hw.entries = append(hw.entries, e)
+	if hw.view != nil {
+		hw.writeEntry(e)
+		hw.scrollToBottom()
+	}
+}
+
+// attach starts writing to the given view, and draws everything written so
+// far to it.
+func (hw *historyWriter) attach(view *gocui.View) {
+	hw.mu.Lock()
+	hw.view = view
+	hw.redraw()
+	displayed := hw.markDisplayed()
+	hw.mu.Unlock()
+	hw.notifyDisplayed(displayed)
+}
+
+// detach stops writing to the view.  Everything written while detached is
+// drawn when the historyWriter is attached again.
+func (hw *historyWriter) detach() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.view = nil
+}
+
+// clear removes everything written so far, and clears the view.
+func (hw *historyWriter) clear() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.entries = nil
+	hw.selected = ""
+	if hw.view != nil {
+		hw.view.Clear()
+		hw.view.SetOrigin(0, 0)
+	}
+}
+
+// insertEntry inserts an entry at position i, and redraws the view.  hw.mu
+// must be held.
+func (hw *historyWriter) insertEntry(i int, e historyEntry) {
+	if i == len(hw.entries) {
+		hw.appendEntry(e)
+		return
+	}
+	hw.entries = append(hw.entries, historyEntry{})
+	copy(hw.entries[i+1:], hw.entries[i:])
+	hw.entries[i] = e
+	hw.redraw()
+}
+
+// redraw clears the view and writes all entries to it again.  hw.mu must be
+// held.
+func (hw *historyWriter) redraw() {
+	if hw.view == nil {
+		return
+	}
+	hw.view.Clear()
+	for _, e := range hw.entries {
+		hw.writeEntry(e)
+	}
+	hw.scrollToBottom()
+}
+
+func (hw *historyWriter) writeEntry(e historyEntry) {
+	hw.view.Write(hw.renderEntry(e))
+}
+
+// renderEntry returns the text of an entry, as it is written to the view.
+// hw.mu must be held.
+func (hw *historyWriter) renderEntry(e historyEntry) []byte {
+	b := e.text
+	if e.msg != nil {
+		b = []byte(hw.formatEntry(e))
+	} else if e.transfer != nil {
+		b = []byte(formatTransfer(*e.transfer) + "\n")
+	}
+	if e.wrap {
+		width, _ := hw.view.Size()
+		b = text.WrapBytes(b, width)
+	}
+	return b
+}
+
+// scrollToBottom scrolls the view to its last lines, or only as far as the
+// selected message if it would be scrolled out of view.  hw.mu must be held.
+func (hw *historyWriter) scrollToBottom() {
+	_, height := hw.view.Size()
 	numLines := hw.view.NumberOfLines()
 	if numLines > height {
-		hw.view.SetOrigin(0, numLines-height)
+		origin := numLines - height
+		if line, ok := hw.selectedLine(); ok && line < origin {
+			origin = line
+		}
+		hw.view.SetOrigin(0, origin)
+	}
+}
+
+// selectedLine returns the line of the view that the selected message starts
+// on.  hw.mu must be held.
+func (hw *historyWriter) selectedLine() (int, bool) {
+	if hw.selected == "" {
+		return 0, false
+	}
+	line := 0
+	for _, e := range hw.entries {
+		if e.msg != nil && e.msg.ID == hw.selected {
+			return line, true
+		}
+		line += bytes.Count(hw.renderEntry(e), []byte("\n"))
 	}
+	return 0, false
 }
 
 func (hw *historyWriter) highlightUserName(st string) string {
@@ -68,15 +251,451 @@ func (hw *historyWriter) highlightUserName(st string) string {
 }
 
 // TODO(nlacasse): Consider coloring each sender name with a unique color.
-func (hw *historyWriter) formatMessage(m message) string {
+func (hw *historyWriter) formatMessage(m chatlib.Message) string {
 	const timeFormat = "Jan 2 at 3:04pm"
 	t := m.Timestamp.Format(timeFormat)
 
-	return fmt.Sprintf("%s %s: %s\n", yellow(t), cyan(m.SenderName), hw.highlightUserName(m.Text))
+	sender := cyan(m.SenderName)
+	if m.RelayTrusted {
+		// The message was relayed by a bridge we trust, which vouches
+		// for the user's name.
+		sender = cyan(m.OnBehalfOf) + yellow(" [via bridge "+m.SenderName+"]")
+	} else if m.OnBehalfOf != "" {
+		// Anyone can claim to relay for anyone, so the name is only
+		// shown as a claim of the sender.
+		sender += yellow(" [relaying for " + m.OnBehalfOf + ", not a trusted bridge]")
+	}
+	if m.Unverified {
+		// The sender could not be checked against the signature of
+		// the message.
+		sender = red("[unverified] ") + sender
+	}
+
+	if m.DecryptFailed {
+		return fmt.Sprintf("%s %s: %s\n", yellow(t), sender, red(m.Text))
+	}
+
+	switch m.Kind {
+	case vdl.MessageKindAction:
+		return fmt.Sprintf("%s * %s %s\n", yellow(t), sender, hw.highlightUserName(m.Text))
+	default:
+		return fmt.Sprintf("%s %s: %s\n", yellow(t), sender, hw.highlightUserName(m.Text))
+	}
+}
+
+// formatEntry formats a message entry, with the selection and threads it is
+// part of.  In a whole conversation, replies are preceded by a quote of the
+// message they reply to, and messages with replies are followed by the number
+// of replies.  hw.mu must be held.
+func (hw *historyWriter) formatEntry(e historyEntry) string {
+	f := hw.formatEntryMessage(e)
+	if hw.thread != "" && e.msg.Parent != "" {
+		f = "  " + f
+	}
+	if e.msg.ID == hw.selected {
+		f = green("> ") + f
+	}
+	if r := formatReactions(e); r != "" {
+		indent := "    "
+		if hw.thread != "" && e.msg.Parent != "" {
+			indent += "  "
+		}
+		f += indent + r + "\n"
+	}
+	if hw.thread != "" {
+		return f
+	}
+	if e.quote != "" {
+		f = yellow("  ┆ "+e.quote) + "\n" + f
+	}
+	if n := hw.replies[e.msg.ID]; n == 1 {
+		f += yellow("    ↳ 1 reply") + "\n"
+	} else if n > 1 {
+		f += yellow(fmt.Sprintf("    ↳ %d replies", n)) + "\n"
+	}
+	return f
+}
+
+// formatReactions formats the reactions to the message of an entry, as each
+// emoji followed by the number of members who reacted with it.
+func formatReactions(e historyEntry) string {
+	if e.deleted {
+		return ""
+	}
+	var parts []string
+	for _, r := range e.reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", emojiForCode(r.Code), len(r.Senders)))
+	}
+	return strings.Join(parts, "  ")
 }
 
-// writeMessage formats a message and writes.
-func (hw *historyWriter) writeMessage(m message) {
-	f := hw.formatMessage(m)
-	hw.writeWordWrap([]byte(f))
+// formatEntryMessage formats the message of an entry.  Deleted messages are
+// replaced by a tombstone, and edited messages are marked as such.  Messages
+// we sent are followed by their delivery state.  hw.mu must be held.
+func (hw *historyWriter) formatEntryMessage(e historyEntry) string {
+	if e.deleted {
+		m := *e.msg
+		m.Kind = vdl.MessageKindText
+		m.Text = ""
+		return strings.TrimSuffix(hw.formatMessage(m), "\n") + red("[message deleted]") + "\n"
+	}
+	f := hw.formatMessage(*e.msg)
+	if e.edited {
+		f = strings.TrimSuffix(f, "\n") + " " + yellow("(edited)") + "\n"
+	}
+	ds, ok := hw.deliveries[e.msg.ID]
+	if !ok {
+		return f
+	}
+	status := ds.String()
+	if status == "" {
+		return f
+	}
+	if len(ds.Members(chatlib.DeliveryFailed)) > 0 {
+		status = red("(" + status + ")")
+	} else {
+		status = green("(" + status + ")")
+	}
+	return strings.TrimSuffix(f, "\n") + " " + status + "\n"
+}
+
+// writeMessage formats a message and writes it to the view.  Messages are
+// kept in (Clock, ID) order, so a message that sorts before messages already
+// in the view is inserted above them.  Edits, deletions and reactions are
+// applied to the message they target instead of being written.
+func (hw *historyWriter) writeMessage(m chatlib.Message) {
+	if m.IsOp() {
+		hw.applyOp(m)
+		return
+	}
+	hw.mu.Lock()
+	e := historyEntry{wrap: true, msg: &m}
+	for _, op := range hw.pendingOps[m.ID] {
+		applyEntryOp(&e, op)
+	}
+	delete(hw.pendingOps, m.ID)
+	if m.Parent != "" {
+		if parent := hw.findEntry(m.Parent); parent != nil {
+			e.quote = quoteEntry(*parent)
+		}
+		if !e.deleted {
+			hw.replies[m.Parent]++
+		}
+	}
+	hw.insertEntry(hw.messagePosition(m), e)
+	displayed := hw.markDisplayed()
+	hw.mu.Unlock()
+	hw.notifyDisplayed(displayed)
+}
+
+// applyOp applies an edit, deletion or reaction to the message it targets,
+// and redraws the view.  If the message has not been written yet, for example
+// because it is still being fetched from the history of another member, the
+// operation is applied when it is.
+func (hw *historyWriter) applyOp(op chatlib.Message) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if e := hw.findEntry(op.Target); e != nil {
+		if applyEntryOp(e, op) {
+			if e.deleted && e.msg.Parent != "" {
+				hw.replies[e.msg.Parent]--
+			}
+			hw.redraw()
+		}
+		return
+	}
+	if len(hw.pendingOps) < maxPendingOps {
+		hw.pendingOps[op.Target] = append(hw.pendingOps[op.Target], op)
+	}
+}
+
+// findEntry returns the entry of the message with the given ID, or nil if it
+// has not been written.  hw.mu must be held.
+func (hw *historyWriter) findEntry(id string) *historyEntry {
+	for i := len(hw.entries) - 1; i >= 0; i-- {
+		if e := &hw.entries[i]; e.msg != nil && e.msg.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// maxQuoteLength is the number of characters of a message that are quoted
+// above the replies to it.
+const maxQuoteLength = 60
+
+// quoteEntry returns a one line quote of the message of an entry.
+func quoteEntry(e historyEntry) string {
+	sender := e.msg.SenderName
+	if user := e.msg.RelayedFor(); user != "" {
+		sender = user
+	}
+	if e.deleted {
+		return sender + ": [message deleted]"
+	}
+	text := []rune(strings.Join(strings.Fields(e.msg.Text), " "))
+	if len(text) > maxQuoteLength {
+		text = append(text[:maxQuoteLength-1], '…')
+	}
+	return sender + ": " + string(text)
+}
+
+// maxPendingOps is the maximum number of messages that operations can be
+// waiting for, so that operations on messages that never arrive do not pile
+// up.
+const maxPendingOps = 1000
+
+// applyEntryOp applies an edit, deletion or reaction to a message entry, and
+// returns true if the entry changed.
+func applyEntryOp(e *historyEntry, op chatlib.Message) bool {
+	if !op.IsReaction() {
+		return editEntry(e, op)
+	}
+	if e.deleted {
+		return false
+	}
+	var changed bool
+	e.reactions, changed = e.reactions.Apply(op)
+	return changed
+}
+
+// editEntry applies an edit or deletion to a message entry, and returns true
+// if the entry changed.  Edits that were not sent by the sender of the message
+// are ignored, and so are edits of deleted messages.
+func editEntry(e *historyEntry, op chatlib.Message) bool {
+	if e.deleted || !op.Modifies(*e.msg) {
+		return false
+	}
+	if op.Kind == vdl.MessageKindDelete {
+		e.deleted = true
+		return true
+	}
+	m := *e.msg
+	m.Text = op.Text
+	e.msg = &m
+	e.edited = true
+	return true
+}
+
+// lastMessage returns the most recent message for which match returns true,
+// and that has not been deleted.
+func (hw *historyWriter) lastMessage(match func(chatlib.Message) bool) (chatlib.Message, bool) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	for i := len(hw.entries) - 1; i >= 0; i-- {
+		if e := hw.entries[i]; e.msg != nil && !e.deleted && match(*e.msg) {
+			return *e.msg, true
+		}
+	}
+	return chatlib.Message{}, false
+}
+
+// reactions returns the reactions to the message with the given ID.
+func (hw *historyWriter) reactions(id string) chatlib.Reactions {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if e := hw.findEntry(id); e != nil {
+		return e.reactions
+	}
+	return nil
+}
+
+// moveSelection moves the selection up by -delta messages if delta is
+// negative, or down by delta messages, and returns the selected message.  With
+// no selection, moving up starts from the last message.  Moving down past the
+// last message clears the selection.  Messages scrolled into view by the move
+// are reported to onDisplay.
+func (hw *historyWriter) moveSelection(delta int) (chatlib.Message, bool) {
+	m, ok, displayed := hw.moveAndMarkSelection(delta)
+	hw.notifyDisplayed(displayed)
+	return m, ok
+}
+
+// moveAndMarkSelection moves the selection like moveSelection, and also
+// returns the messages that were scrolled into view.
+func (hw *historyWriter) moveAndMarkSelection(delta int) (chatlib.Message, bool, []chatlib.Message) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	var selectable []*historyEntry
+	current := -1
+	for i := range hw.entries {
+		e := &hw.entries[i]
+		if e.msg == nil || e.deleted {
+			continue
+		}
+		if e.msg.ID == hw.selected {
+			current = len(selectable)
+		}
+		selectable = append(selectable, e)
+	}
+	if current < 0 {
+		current = len(selectable)
+	}
+	next := current + delta
+	if next < 0 {
+		next = 0
+	}
+	hw.selected = ""
+	if next < len(selectable) {
+		hw.selected = selectable[next].msg.ID
+	}
+	hw.redraw()
+	displayed := hw.markDisplayed()
+	if hw.selected == "" {
+		return chatlib.Message{}, false, displayed
+	}
+	return *selectable[next].msg, true, displayed
+}
+
+// selectedMessage returns the selected message, if it was not deleted since it
+// was selected.
+func (hw *historyWriter) selectedMessage() (chatlib.Message, bool) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.selected == "" {
+		return chatlib.Message{}, false
+	}
+	if e := hw.findEntry(hw.selected); e != nil && !e.deleted {
+		return *e.msg, true
+	}
+	return chatlib.Message{}, false
+}
+
+// clearSelection clears the selection, and scrolls the view back to the bottom.
+func (hw *historyWriter) clearSelection() {
+	hw.mu.Lock()
+	if hw.selected == "" {
+		hw.mu.Unlock()
+		return
+	}
+	hw.selected = ""
+	hw.redraw()
+	displayed := hw.markDisplayed()
+	hw.mu.Unlock()
+	hw.notifyDisplayed(displayed)
+}
+
+// threadWriter returns a new historyWriter, which starts detached, for the
+// thread started by the message with the given ID.  It starts with the given
+// text, followed by the messages of the thread written to hw so far.
+func (hw *historyWriter) threadWriter(id string, header []byte) *historyWriter {
+	tw := newHistoryWriter(nil, hw.userName)
+	tw.thread = id
+	tw.entries = append(tw.entries, historyEntry{text: header})
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	for _, e := range hw.entries {
+		if e.msg == nil || e.msg.ThreadID() != id {
+			continue
+		}
+		tw.entries = append(tw.entries, e)
+		if ds, ok := hw.deliveries[e.msg.ID]; ok {
+			tw.deliveries[e.msg.ID] = ds
+		}
+	}
+	return tw
+}
+
+// message returns the message with the given ID, if it was written.
+func (hw *historyWriter) message(id string) (chatlib.Message, bool) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if e := hw.findEntry(id); e != nil {
+		return *e.msg, true
+	}
+	return chatlib.Message{}, false
+}
+
+// setDeliveryStatus updates the delivery state shown next to a message we
+// sent.  The message does not need to have been written yet.
+func (hw *historyWriter) setDeliveryStatus(ds chatlib.DeliveryStatus) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.deliveries[ds.MessageID] = ds
+	if hw.findEntry(ds.MessageID) != nil {
+		hw.redraw()
+	}
+}
+
+// setTransfer writes the state of a file transfer to the view, in place of
+// the entry of the transfer if it was written before.
+func (hw *historyWriter) setTransfer(t chatlib.FileTransfer) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	for i := range hw.entries {
+		e := &hw.entries[i]
+		if e.transfer != nil && e.transfer.ID == t.ID && e.transfer.Incoming == t.Incoming {
+			e.transfer = &t
+			hw.redraw()
+			return
+		}
+	}
+	hw.appendEntry(historyEntry{transfer: &t, wrap: true})
+}
+
+// markDisplayed marks the messages that are scrolled into view as displayed,
+// and returns the ones that were not displayed before.  The view is scrolled
+// up from the bottom when a message is selected, so the lines in view are
+// counted from the bottom of the view.  hw.mu must be held.
+func (hw *historyWriter) markDisplayed() []chatlib.Message {
+	if hw.view == nil {
+		return nil
+	}
+	_, height := hw.view.Size()
+	_, origin := hw.view.Origin()
+	// below is the number of lines under the bottom of the view.
+	below := hw.view.NumberOfLines() - origin - height
+	if below < 0 {
+		below = 0
+	}
+	var displayed []chatlib.Message
+	lines := 0
+	for i := len(hw.entries) - 1; i >= 0; i-- {
+		e := &hw.entries[i]
+		n := bytes.Count(hw.renderEntry(*e), []byte("\n"))
+		lines += n
+		if lines <= below {
+			continue
+		}
+		if lines-n >= below+height {
+			break
+		}
+		if e.msg != nil && !e.displayed {
+			e.displayed = true
+			if !e.msg.Historical {
+				displayed = append(displayed, *e.msg)
+			}
+		}
+	}
+	return displayed
+}
+
+// notifyDisplayed calls onDisplay for the given messages.  hw.mu must not be
+// held.
+func (hw *historyWriter) notifyDisplayed(displayed []chatlib.Message) {
+	if hw.onDisplay == nil {
+		return
+	}
+	for _, m := range displayed {
+		hw.onDisplay(m)
+	}
+}
+
+// messagePosition returns the index in entries at which m should be inserted.
+// It looks back from the end of the view for messages that should come after
+// m, and stops at the first message that should come before it.  hw.mu must
+// be held.
+func (hw *historyWriter) messagePosition(m chatlib.Message) int {
+	pos := len(hw.entries)
+	for i := len(hw.entries) - 1; i >= 0; i-- {
+		e := hw.entries[i]
+		if e.msg == nil {
+			continue
+		}
+		if !m.Before(*e.msg) {
+			break
+		}
+		pos = i
+	}
+	return pos
 }
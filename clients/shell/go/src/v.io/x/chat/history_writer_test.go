@@ -0,0 +1,201 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+)
+
+// testAlice are the blessings of the sender of test messages.
+var testAlice = []string{"dev.v.io:u:alice@example.com"}
+
+// testMessage returns a text message sent by alice.  It replies to parent,
+// unless parent is empty.
+func testMessage(id string, clock uint64, parent, text string) chatlib.Message {
+	return chatlib.Message{
+		ID:              id,
+		Clock:           clock,
+		Parent:          parent,
+		Text:            text,
+		SenderName:      "alice@example.com",
+		SenderBlessings: testAlice,
+	}
+}
+
+// testOp returns an edit, deletion or reaction of the given kind sent by
+// alice, which targets the message with ID target.
+func testOp(id string, clock uint64, kind vdl.MessageKind, target, text string) chatlib.Message {
+	m := testMessage(id, clock, "", text)
+	m.Kind, m.Target = kind, target
+	return m
+}
+
+// formatTestEntry returns the entry of the message with the given ID as it is
+// displayed, or an empty string if the message was not written.
+func formatTestEntry(hw *historyWriter, id string) string {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if e := hw.findEntry(id); e != nil {
+		return hw.formatEntry(*e)
+	}
+	return ""
+}
+
+// formatTestTransfers returns the file transfers written to hw as they are
+// displayed, one per line.
+func formatTestTransfers(hw *historyWriter) string {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	var lines []string
+	for _, e := range hw.entries {
+		if e.transfer != nil {
+			lines = append(lines, formatTransfer(*e.transfer))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestHistoryWriterEdits(t *testing.T) {
+	hw := newHistoryWriter(nil, "bob")
+	hw.writeMessage(testMessage("1", 1, "", "helo"))
+	hw.writeMessage(testOp("2", 2, vdl.MessageKindEdit, "1", "hello"))
+	if got := formatTestEntry(hw, "1"); !strings.Contains(got, "hello") || !strings.Contains(got, "(edited)") {
+		t.Errorf("Got %q, want the edited text", got)
+	}
+	// Only the sender of a message can edit it.
+	forged := testOp("3", 3, vdl.MessageKindEdit, "1", "goodbye")
+	forged.SenderBlessings = []string{"dev.v.io:u:mallory@example.com"}
+	hw.writeMessage(forged)
+	if got := formatTestEntry(hw, "1"); strings.Contains(got, "goodbye") {
+		t.Errorf("Got %q, want the edit from another sender to be ignored", got)
+	}
+	hw.writeMessage(testOp("4", 4, vdl.MessageKindDelete, "1", ""))
+	if got := formatTestEntry(hw, "1"); strings.Contains(got, "hello") || !strings.Contains(got, "[message deleted]") {
+		t.Errorf("Got %q, want a tombstone", got)
+	}
+	if _, ok := hw.lastMessage(func(chatlib.Message) bool { return true }); ok {
+		t.Errorf("Got a last message, want none since it was deleted")
+	}
+
+	// An edit that arrives before its message is applied when the message
+	// is written.
+	hw.writeMessage(testOp("6", 6, vdl.MessageKindEdit, "5", "late"))
+	hw.writeMessage(testMessage("5", 5, "", "early"))
+	if got := formatTestEntry(hw, "5"); !strings.Contains(got, "late") {
+		t.Errorf("Got %q, want the pending edit to be applied", got)
+	}
+	if got, want := len(hw.entries), 2; got != want {
+		t.Errorf("Got %d entries, want %d", got, want)
+	}
+}
+
+func TestHistoryWriterThreads(t *testing.T) {
+	hw := newHistoryWriter(nil, "bob")
+	hw.writeMessage(testMessage("1", 1, "", "lunch?"))
+	hw.writeMessage(testMessage("2", 2, "", "unrelated"))
+	hw.writeMessage(testMessage("3", 3, "1", "yes"))
+	hw.writeMessage(testMessage("4", 4, "1", "where?"))
+	if got := formatTestEntry(hw, "1"); !strings.Contains(got, "↳ 2 replies") {
+		t.Errorf("Got %q, want a summary of the replies", got)
+	}
+	if got := formatTestEntry(hw, "3"); !strings.Contains(got, "┆ alice@example.com: lunch?") {
+		t.Errorf("Got %q, want a quote of the parent", got)
+	}
+
+	// Deleted replies are not counted.
+	hw.writeMessage(testOp("5", 5, vdl.MessageKindDelete, "4", ""))
+	if got := formatTestEntry(hw, "1"); !strings.Contains(got, "↳ 1 reply") {
+		t.Errorf("Got %q, want a summary of the remaining reply", got)
+	}
+
+	// The thread has the message that started it and its replies, which
+	// are not quoted.
+	tw := hw.threadWriter("1", []byte("thread\n"))
+	var ids []string
+	for _, e := range tw.entries {
+		if e.msg != nil {
+			ids = append(ids, e.msg.ID)
+		}
+	}
+	if got, want := strings.Join(ids, ","), "1,3,4"; got != want {
+		t.Errorf("Got thread %q, want %q", got, want)
+	}
+	if got := formatTestEntry(tw, "3"); strings.Contains(got, "┆") || !strings.HasPrefix(got, "  ") {
+		t.Errorf("Got %q, want an indented reply", got)
+	}
+
+	// The selection moves over the messages that were not deleted.
+	for _, test := range []struct {
+		delta int
+		want  string
+	}{{-1, "3"}, {-1, "2"}, {-5, "1"}, {2, "3"}, {1, ""}} {
+		m, _ := hw.moveSelection(test.delta)
+		if m.ID != test.want {
+			t.Errorf("Moving by %d selected %q, want %q", test.delta, m.ID, test.want)
+		}
+	}
+}
+
+func TestHistoryWriterReactions(t *testing.T) {
+	bob := []string{"dev.v.io:u:bob@example.com"}
+	react := func(id string, kind vdl.MessageKind, code string) chatlib.Message {
+		return testOp(id, 0, kind, "1", code)
+	}
+	hw := newHistoryWriter(nil, "bob")
+	// Reactions that arrive before their message are applied when it is
+	// written.
+	fromBob := react("2", vdl.MessageKindReact, "thumbsup")
+	fromBob.SenderBlessings = bob
+	hw.writeMessage(fromBob)
+	hw.writeMessage(testMessage("1", 0, "", "lunch?"))
+	hw.writeMessage(react("3", vdl.MessageKindReact, "thumbsup"))
+	hw.writeMessage(react("4", vdl.MessageKindReact, "somethingnew"))
+	if got, want := formatTestEntry(hw, "1"), "👍 2  :somethingnew: 1"; !strings.Contains(got, want) {
+		t.Errorf("Got %q, want it to contain %q", got, want)
+	}
+	hw.writeMessage(react("5", vdl.MessageKindUnreact, "somethingnew"))
+	if got := formatTestEntry(hw, "1"); strings.Contains(got, "somethingnew") {
+		t.Errorf("Got %q, want the reaction to be taken back", got)
+	}
+	if !hw.reactions("1").HasReacted("thumbsup", bob) {
+		t.Errorf("Got reactions %v, want bob to have reacted", hw.reactions("1"))
+	}
+}
+
+func TestHistoryWriterTransfers(t *testing.T) {
+	hw := newHistoryWriter(nil, "bob")
+	transfer := chatlib.FileTransfer{ID: "1", Name: "notes.txt", Peer: "alice", Incoming: true, Size: 2048}
+	hw.setTransfer(transfer)
+	transfer.Done = 1024
+	hw.setTransfer(transfer)
+	if got, want := formatTestTransfers(hw), "Receiving notes.txt (2.0 KiB) from alice [==========          ] 50%"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	// A transfer is displayed once, in its latest state.
+	transfer.Done = 2048
+	transfer.Complete = true
+	transfer.Path = "/downloads/notes.txt"
+	hw.setTransfer(transfer)
+	if got, want := formatTestTransfers(hw), "Received notes.txt (2.0 KiB) from alice, saved as /downloads/notes.txt."; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestFormatRelayedMessage(t *testing.T) {
+	hw := newHistoryWriter(nil, "bob")
+	m := chatlib.Message{Text: "hi", SenderName: "mallory", OnBehalfOf: "alice"}
+	// Members who are not trusted bridges cannot speak as someone else.
+	if got := hw.formatMessage(m); !strings.Contains(got, "mallory") || !strings.Contains(got, "not a trusted bridge") {
+		t.Errorf("Got %q, want the message to be shown as mallory's", got)
+	}
+	m.SenderName, m.RelayTrusted = "ircbridge", true
+	if got := hw.formatMessage(m); !strings.Contains(got, "alice") || !strings.Contains(got, "via bridge ircbridge") {
+		t.Errorf("Got %q, want the message to be shown as alice's", got)
+	}
+}
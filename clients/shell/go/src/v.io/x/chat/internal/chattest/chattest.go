@@ -0,0 +1,51 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chattest contains helpers shared by the tests of the chat packages.
+package chattest
+
+import (
+	"fmt"
+	"os"
+
+	"v.io/v23"
+	"v.io/v23/options"
+	"v.io/x/lib/gosh"
+	"v.io/x/ref/lib/signals"
+	"v.io/x/ref/services/mounttable/mounttablelib"
+	"v.io/x/ref/test"
+	"v.io/x/ref/test/v23test"
+)
+
+// RootMT runs a root mounttable until it is signalled to shut down.  It prints
+// its PID and then its name, as PID= and MT_NAME= variables.
+var RootMT = gosh.RegisterFunc("rootMT", func() error {
+	ctx, shutdown := test.V23Init()
+	defer shutdown()
+
+	mt, err := mounttablelib.NewMountTableDispatcher(ctx, "", "", "mounttable")
+	if err != nil {
+		return fmt.Errorf("mounttable.NewMountTableDispatcher failed: %s", err)
+	}
+	_, server, err := v23.WithNewDispatchingServer(ctx, "", mt, options.ServesMountTable(true))
+	if err != nil {
+		return fmt.Errorf("root failed: %v", err)
+	}
+	fmt.Printf("PID=%d\n", os.Getpid())
+	for _, ep := range server.Status().Endpoints {
+		fmt.Printf("MT_NAME=%s\n", ep.Name())
+	}
+	<-signals.ShutdownOnSignals(ctx)
+	return nil
+})
+
+// StartRootMT starts RootMT in the shell, listening on localhost, and returns
+// the name of the mounttable.
+func StartRootMT(sh *v23test.Shell) string {
+	c := sh.FuncCmd(RootMT)
+	c.Args = append(c.Args, "--v23.tcp.address=127.0.0.1:0")
+	c.Start()
+	c.S.ExpectVar("PID")
+	return c.S.ExpectVar("MT_NAME")
+}
@@ -0,0 +1,801 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The IRC gateway lets IRC clients take part in channels.  It speaks enough of
+// the IRC protocol for common clients: NICK, USER, JOIN, PART, PRIVMSG, NAMES,
+// WHO, MODE, PING and QUIT.
+//
+// The IRC channel "#path/to/channel" is the channel at path/to/channel, or at
+// <root>/path/to/channel if -channel-root is given.  The gateway joins each
+// channel once, as its own principal, however many IRC users are in it.
+// Messages from IRC users are sent on behalf of their nick, like messages
+// posted to a bridge, and messages from members are delivered as PRIVMSG
+// lines.  Private messages are not supported.  The gateway does not
+// authenticate IRC users, so it only listens on localhost by default.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+	"v.io/x/lib/vlog"
+	"v.io/x/ref/lib/signals"
+)
+
+const (
+	// ircServerName is the name the gateway gives itself in IRC replies.
+	ircServerName = "chat.v.io"
+	// maxIRCLine is the maximum length of a line read from an IRC client.
+	maxIRCLine = 8192
+	// maxIRCText is the maximum length of the text of a PRIVMSG line we
+	// send.  Longer messages are split, so that lines stay within the 512
+	// bytes allowed by the protocol.
+	maxIRCText = 400
+	// ircOutboxSize is the number of lines that can be waiting to be
+	// written to an IRC client.  Clients that fall further behind are
+	// disconnected, so that they do not hold up the channels they are in.
+	ircOutboxSize = 512
+	// ircWriteTimeout is how long we wait for an IRC client to read a line
+	// before disconnecting it.
+	ircWriteTimeout = 30 * time.Second
+	// maxRelayedIDs is the number of messages relayed for an IRC user that
+	// are remembered until they come back from the channel.
+	maxRelayedIDs = 1000
+)
+
+// ircNickRegexp matches valid nicks.
+var ircNickRegexp = regexp.MustCompile("^[A-Za-z\\[\\]\\\\`_^{|}][A-Za-z0-9\\[\\]\\\\`_^{|}-]{0,29}$")
+
+// ircNick returns the nick of a member, with the characters that are not
+// allowed in nicks replaced by underscores, e.g. "alice_example.com" for
+// "alice@example.com".
+func ircNick(name string) string {
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("-.[]\\`_^{|}", r):
+			return r
+		}
+		return '_'
+	}, name)
+	if nick == "" {
+		return "_"
+	}
+	return nick
+}
+
+// ircMessage is a line of the IRC protocol.
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// parseIRCLine parses a line of the IRC protocol, without its line ending.
+// The last parameter may contain spaces if it is preceded by a colon.
+func parseIRCLine(line string) ircMessage {
+	var m ircMessage
+	if strings.HasPrefix(line, ":") {
+		m.Prefix, line = splitWord(line[1:])
+	}
+	m.Command, line = splitWord(strings.TrimLeft(line, " "))
+	m.Command = strings.ToUpper(m.Command)
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var param string
+		param, line = splitWord(line)
+		m.Params = append(m.Params, param)
+	}
+	return m
+}
+
+// ircChannelPath returns the path of the channel for an IRC channel name.
+func ircChannelPath(root, name string) (string, bool) {
+	if !strings.HasPrefix(name, "#") || len(name) == 1 || strings.ContainsAny(name, " ,\x07") {
+		return "", false
+	}
+	path := name[1:]
+	if root != "" {
+		path = strings.TrimSuffix(root, "/") + "/" + path
+	}
+	return path, true
+}
+
+// splitIRCText splits the text of a message into pieces that fit on a PRIVMSG
+// line, at line breaks and otherwise every maxIRCText bytes.
+func splitIRCText(text string) []string {
+	var pieces []string
+	for _, line := range strings.Split(strings.Replace(text, "\r", "", -1), "\n") {
+		for len(line) > maxIRCText {
+			n := maxIRCText
+			// Do not split runes.
+			for n > 0 && !utf8.RuneStart(line[n]) {
+				n--
+			}
+			pieces = append(pieces, line[:n])
+			line = line[n:]
+		}
+		pieces = append(pieces, line)
+	}
+	return pieces
+}
+
+// ircChannel is a channel that IRC users of the gateway are in.
+type ircChannel struct {
+	name string
+	cr   *chatlib.Channel
+	// The IRC users in the channel.  ircServer.mu must be held to use it.
+	conns map[*ircConn]bool
+}
+
+// ircServer is the IRC gateway.
+type ircServer struct {
+	ctx       *context.T
+	blocklist *blocklist
+	limits    chatlib.InboundLimits
+	root      string
+	// Mutex to serialize joining and leaving channels, which may be slow.
+	joinMu sync.Mutex
+	// Mutex to protect channels and nicks.
+	mu sync.Mutex
+	// Channels that IRC users are in, by IRC channel name.
+	channels map[string]*ircChannel
+	// IRC users, by nick.
+	nicks map[string]*ircConn
+}
+
+func newIRCServer(ctx *context.T, bl *blocklist, limits chatlib.InboundLimits, root string) *ircServer {
+	return &ircServer{
+		ctx:       ctx,
+		blocklist: bl,
+		limits:    limits,
+		root:      root,
+		channels:  make(map[string]*ircChannel),
+		nicks:     make(map[string]*ircConn),
+	}
+}
+
+// serve accepts IRC clients until the listener is closed.
+func (s *ircServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go newIRCConn(s, conn).run()
+	}
+}
+
+// join adds an IRC user to a channel, and joins the channel if no IRC user was
+// in it yet.
+func (s *ircServer) join(c *ircConn, name, path string) (*ircChannel, error) {
+	s.joinMu.Lock()
+	defer s.joinMu.Unlock()
+	s.mu.Lock()
+	ch := s.channels[name]
+	s.mu.Unlock()
+	if ch == nil {
+		cr, err := openChannel(s.ctx, path, s.blocklist, s.limits)
+		if err != nil {
+			return nil, err
+		}
+		if err := cr.Join(); err != nil {
+			cr.Close()
+			return nil, err
+		}
+		ch = &ircChannel{name: name, cr: cr, conns: make(map[*ircConn]bool)}
+		go s.relayEvents(ch)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[name] = ch
+	ch.conns[c] = true
+	return ch, nil
+}
+
+// part removes an IRC user from a channel, and leaves the channel if no IRC
+// user is left in it.
+func (s *ircServer) part(c *ircConn, ch *ircChannel) {
+	s.joinMu.Lock()
+	defer s.joinMu.Unlock()
+	s.mu.Lock()
+	delete(ch.conns, c)
+	empty := len(ch.conns) == 0
+	if empty {
+		delete(s.channels, ch.name)
+	}
+	s.mu.Unlock()
+	if empty {
+		if err := ch.cr.Leave(); err != nil {
+			vlog.Errorf("Error leaving %v: %v", ch.cr.Path(), err)
+		}
+		ch.cr.Close()
+	}
+}
+
+// setNick reserves a nick for an IRC user, and releases its previous nick.  It
+// returns false if the nick is taken.
+func (s *ircServer) setNick(c *ircConn, nick string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if other := s.nicks[strings.ToLower(nick)]; other != nil && other != c {
+		return false
+	}
+	delete(s.nicks, strings.ToLower(c.nick))
+	s.nicks[strings.ToLower(nick)] = c
+	return true
+}
+
+// conns returns the IRC users in a channel.
+func (s *ircServer) conns(ch *ircChannel) []*ircConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []*ircConn
+	for c := range ch.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// relayEvents delivers the messages received in a channel, and the members who
+// join or leave it, to the IRC users in it, until the channel is closed.
+func (s *ircServer) relayEvents(ch *ircChannel) {
+	go func() {
+		for update := range ch.cr.WatchMembers(*membersPollInterval, *membersPollJitter) {
+			for _, e := range update.Events {
+				if ch.cr.IsSelf(e.Member) {
+					continue
+				}
+				command := "JOIN"
+				if e.Kind == chatlib.MemberLeft {
+					command = "PART"
+				}
+				for _, c := range s.conns(ch) {
+					c.send(":%s %s %s", ircPrefix(ircNick(e.Member.Name), "vanadium"), command, ch.name)
+				}
+			}
+		}
+	}()
+	for {
+		select {
+		case m := <-ch.cr.Messages():
+			if m.Private || m.Historical || s.blocklist.isMuted(m.SenderBlessings) {
+				continue
+			}
+			if m.IsOp() {
+				// IRC has no way to change lines that were
+				// already sent, or to react to them.
+				continue
+			}
+			nick, host := ircNick(m.SenderName), "vanadium"
+			if user := m.RelayedFor(); user != "" {
+				nick, host = ircNick(user), "via-bridge-"+nick
+			}
+			for _, c := range s.conns(ch) {
+				if c.relayedBack(m.ID) {
+					// IRC servers do not echo messages to
+					// their sender.
+					continue
+				}
+				c.sendMessage(ircPrefix(nick, host), ch.name, m)
+			}
+		case notice := <-ch.cr.Notices():
+			for _, c := range s.conns(ch) {
+				c.send(":%s NOTICE %s :%s", ircServerName, ch.name, notice)
+			}
+		case <-ch.cr.Receipts():
+			// Delivery receipts are not reported.
+		case <-ch.cr.Done():
+			return
+		}
+	}
+}
+
+// ircPrefix returns the prefix of a line sent on behalf of a user.
+func ircPrefix(nick, host string) string {
+	return nick + "!" + nick + "@" + host
+}
+
+// ircConn is a connection from an IRC client.
+type ircConn struct {
+	s    *ircServer
+	conn net.Conn
+	// out holds the lines waiting to be written to the client.
+	out chan string
+	// closing is closed when the connection is closed.  The lines still
+	// waiting in out are written first.
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Mutex to protect nick, user, realname and relayed.
+	mu       sync.Mutex
+	nick     string
+	user     string
+	realname string
+	// relayed holds the IDs of the messages relayed for the user, until
+	// they come back from the channel.
+	relayed map[string]bool
+	// The channels the user is in, by IRC channel name.  Only used by the
+	// goroutine that runs the connection.
+	channels map[string]*ircChannel
+}
+
+func newIRCConn(s *ircServer, conn net.Conn) *ircConn {
+	return &ircConn{
+		s:        s,
+		conn:     conn,
+		out:      make(chan string, ircOutboxSize),
+		closing:  make(chan struct{}),
+		relayed:  make(map[string]bool),
+		channels: make(map[string]*ircChannel),
+	}
+}
+
+// addRelayed remembers the ID of a message relayed for the user.
+func (c *ircConn) addRelayed(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.relayed) >= maxRelayedIDs {
+		// The messages never came back, e.g. because they were
+		// dropped.
+		c.relayed = make(map[string]bool)
+	}
+	c.relayed[id] = true
+}
+
+// relayedBack returns true if a message received in a channel is one that was
+// relayed for the user, and forgets it.
+func (c *ircConn) relayedBack(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.relayed[id] {
+		return false
+	}
+	delete(c.relayed, id)
+	return true
+}
+
+func (c *ircConn) getNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// registered returns true once the client has sent both NICK and USER.
+func (c *ircConn) registered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick != "" && c.user != ""
+}
+
+// send queues a line to be written to the client.  Clients that fall too far
+// behind are disconnected.
+func (c *ircConn) send(format string, args ...interface{}) {
+	select {
+	case c.out <- fmt.Sprintf(format+"\r\n", args...):
+	case <-c.closing:
+	default:
+		vlog.Infof("Disconnecting IRC client %v: too many lines are waiting to be sent", c.conn.RemoteAddr())
+		c.shutdown()
+		c.conn.Close()
+	}
+}
+
+// write writes the lines queued by send to the client, until the connection is
+// closed.  Clients that do not read a line within ircWriteTimeout are
+// disconnected.
+func (c *ircConn) write() {
+	defer c.conn.Close()
+	w := bufio.NewWriter(c.conn)
+	writeLine := func(line string) error {
+		c.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+		if len(c.out) > 0 {
+			// More lines are flushed with this one.
+			return nil
+		}
+		return w.Flush()
+	}
+	for {
+		select {
+		case line := <-c.out:
+			if err := writeLine(line); err != nil {
+				c.shutdown()
+				return
+			}
+		case <-c.closing:
+			// Write what was sent before the connection was
+			// closed, e.g. the reply to QUIT.
+			for len(c.out) > 0 {
+				if err := writeLine(<-c.out); err != nil {
+					return
+				}
+			}
+			w.Flush()
+			return
+		}
+	}
+}
+
+// shutdown starts closing the connection.  The goroutine that writes to the
+// client closes it once the lines waiting to be written are written.
+func (c *ircConn) shutdown() {
+	c.closeOnce.Do(func() { close(c.closing) })
+}
+
+// reply sends a numeric reply to the client.  The last parameter may contain
+// spaces.
+func (c *ircConn) reply(code string, params ...string) {
+	nick := c.getNick()
+	if nick == "" {
+		nick = "*"
+	}
+	line := ":" + ircServerName + " " + code + " " + nick
+	for i, p := range params {
+		if i == len(params)-1 {
+			p = ":" + p
+		}
+		line += " " + p
+	}
+	c.send("%s", line)
+}
+
+// sendMessage sends a message to the client as PRIVMSG lines.  Actions are
+// sent as CTCP ACTIONs.
+func (c *ircConn) sendMessage(prefix, target string, m chatlib.Message) {
+	for _, text := range splitIRCText(m.Text) {
+		if m.Kind == vdl.MessageKindAction {
+			text = "\x01ACTION " + text + "\x01"
+		}
+		c.send(":%s PRIVMSG %s :%s", prefix, target, text)
+	}
+}
+
+// run handles the commands of the client until it quits or goes away.
+func (c *ircConn) run() {
+	go c.write()
+	defer c.close()
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 512), maxIRCLine)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if !c.handle(parseIRCLine(line)) {
+			return
+		}
+	}
+}
+
+// close leaves the channels the user is in, and closes the connection.
+func (c *ircConn) close() {
+	for _, ch := range c.channels {
+		c.s.part(c, ch)
+	}
+	nick := strings.ToLower(c.getNick())
+	c.s.mu.Lock()
+	if c.s.nicks[nick] == c {
+		delete(c.s.nicks, nick)
+	}
+	c.s.mu.Unlock()
+	c.shutdown()
+}
+
+// handle runs a command from the client.  It returns false if the connection
+// should be closed.
+func (c *ircConn) handle(m ircMessage) bool {
+	switch m.Command {
+	case "PING":
+		c.send(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(m.Params, " "))
+		return true
+	case "QUIT":
+		c.send("ERROR :Closing link")
+		return false
+	case "CAP", "PONG":
+		// Capabilities are not supported, which clients take to mean
+		// that there are none.
+		return true
+	case "NICK":
+		c.handleNick(m.Params)
+		return true
+	case "USER":
+		c.handleUser(m.Params)
+		return true
+	}
+	if !c.registered() {
+		c.reply("451", "You have not registered")
+		return true
+	}
+	switch m.Command {
+	case "JOIN":
+		c.handleJoin(m.Params)
+	case "PART":
+		c.handlePart(m.Params)
+	case "PRIVMSG", "NOTICE":
+		c.handlePrivmsg(m.Params)
+	case "NAMES":
+		c.handleNames(m.Params)
+	case "WHO":
+		c.handleWho(m.Params)
+	case "MODE":
+		c.handleMode(m.Params)
+	default:
+		c.reply("421", m.Command, "Unknown command")
+	}
+	return true
+}
+
+func (c *ircConn) handleNick(params []string) {
+	if len(params) == 0 {
+		c.reply("431", "No nickname given")
+		return
+	}
+	nick := params[0]
+	if !ircNickRegexp.MatchString(nick) {
+		c.reply("432", nick, "Erroneous nickname")
+		return
+	}
+	if !c.s.setNick(c, nick) {
+		c.reply("433", nick, "Nickname is already in use")
+		return
+	}
+	wasRegistered := c.registered()
+	c.mu.Lock()
+	old := c.nick
+	c.nick = nick
+	c.mu.Unlock()
+	if wasRegistered {
+		c.send(":%s NICK :%s", ircPrefix(old, "irc"), nick)
+	} else {
+		c.welcome()
+	}
+}
+
+func (c *ircConn) handleUser(params []string) {
+	if len(params) < 4 {
+		c.reply("461", "USER", "Not enough parameters")
+		return
+	}
+	if c.registered() {
+		c.reply("462", "You may not reregister")
+		return
+	}
+	c.mu.Lock()
+	c.user, c.realname = params[0], params[3]
+	c.mu.Unlock()
+	c.welcome()
+}
+
+// welcome sends the welcome replies once the client has registered.
+func (c *ircConn) welcome() {
+	if !c.registered() {
+		return
+	}
+	c.reply("001", "Welcome to Vanadium Chat, "+c.getNick())
+	c.reply("002", "Your host is "+ircServerName)
+	c.reply("003", "This server relays Vanadium chat channels")
+	c.reply("004", ircServerName, "vanadium", "i", "n")
+	c.reply("422", "MOTD File is missing")
+}
+
+func (c *ircConn) handleJoin(params []string) {
+	if len(params) == 0 {
+		c.reply("461", "JOIN", "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(params[0], ",") {
+		if c.channels[name] != nil {
+			continue
+		}
+		path, ok := ircChannelPath(c.s.root, name)
+		if !ok {
+			c.reply("403", name, "No such channel")
+			continue
+		}
+		ch, err := c.s.join(c, name, path)
+		if err != nil {
+			c.reply("403", name, fmt.Sprintf("Cannot join '%s': %v", path, err))
+			continue
+		}
+		c.channels[name] = ch
+		c.send(":%s JOIN %s", ircPrefix(c.getNick(), "irc"), name)
+		c.reply("331", name, "No topic is set")
+		c.names(ch)
+	}
+}
+
+func (c *ircConn) handlePart(params []string) {
+	if len(params) == 0 {
+		c.reply("461", "PART", "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(params[0], ",") {
+		ch := c.channels[name]
+		if ch == nil {
+			c.reply("442", name, "You're not on that channel")
+			continue
+		}
+		delete(c.channels, name)
+		c.send(":%s PART %s", ircPrefix(c.getNick(), "irc"), name)
+		c.s.part(c, ch)
+	}
+}
+
+func (c *ircConn) handlePrivmsg(params []string) {
+	if len(params) < 2 || params[1] == "" {
+		c.reply("412", "No text to send")
+		return
+	}
+	target, text := params[0], params[1]
+	ch := c.channels[target]
+	if ch == nil {
+		if strings.HasPrefix(target, "#") {
+			c.reply("404", target, "Cannot send to channel")
+		} else {
+			c.reply("401", target, "Private messages are not supported")
+		}
+		return
+	}
+	kind := vdl.MessageKindText
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		kind, text = vdl.MessageKindAction, strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+	}
+	// The message is remembered before it is relayed, since it can come
+	// back from our own server before Relay returns.
+	id := chatlib.NewMessageID()
+	c.addRelayed(id)
+	if _, err := ch.cr.Relay(c.getNick(), kind, text, chatlib.WithID(id)); err != nil {
+		c.relayedBack(id)
+		c.send(":%s NOTICE %s :Could not send: %v", ircServerName, target, err)
+		return
+	}
+	// Other IRC users in the channel get the message when it comes back
+	// from the channel, like members do.
+}
+
+func (c *ircConn) handleNames(params []string) {
+	if len(params) == 0 {
+		for _, ch := range c.channels {
+			c.names(ch)
+		}
+		return
+	}
+	for _, name := range strings.Split(params[0], ",") {
+		if ch := c.channels[name]; ch != nil {
+			c.names(ch)
+		} else {
+			c.reply("366", name, "End of /NAMES list")
+		}
+	}
+}
+
+// nicks returns the nicks of the members of a channel, and of the IRC users in
+// it.
+func (c *ircConn) nicks(ch *ircChannel) []string {
+	var nicks []string
+	if members, err := ch.cr.Members(); err == nil {
+		for _, member := range members {
+			if !ch.cr.IsSelf(member) {
+				nicks = append(nicks, ircNick(member.Name))
+			}
+		}
+	} else {
+		vlog.Errorf("Error getting members of %v: %v", ch.cr.Path(), err)
+	}
+	for _, other := range c.s.conns(ch) {
+		nicks = append(nicks, other.getNick())
+	}
+	sort.Strings(nicks)
+	return uniqStrings(nicks)
+}
+
+// names sends the NAMES replies for a channel.
+func (c *ircConn) names(ch *ircChannel) {
+	nicks := c.nicks(ch)
+	// Send a few nicks per line, to keep lines short.
+	for len(nicks) > 0 {
+		n := len(nicks)
+		if n > 20 {
+			n = 20
+		}
+		c.reply("353", "=", ch.name, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	c.reply("366", ch.name, "End of /NAMES list")
+}
+
+func (c *ircConn) handleWho(params []string) {
+	if len(params) == 0 {
+		c.reply("315", "*", "End of /WHO list")
+		return
+	}
+	name := params[0]
+	if ch := c.channels[name]; ch != nil {
+		for _, nick := range c.nicks(ch) {
+			c.reply("352", name, nick, "vanadium", ircServerName, nick, "H", "0 "+nick)
+		}
+	}
+	c.reply("315", name, "End of /WHO list")
+}
+
+func (c *ircConn) handleMode(params []string) {
+	if len(params) == 0 {
+		c.reply("461", "MODE", "Not enough parameters")
+		return
+	}
+	if strings.HasPrefix(params[0], "#") {
+		if c.channels[params[0]] == nil {
+			c.reply("442", params[0], "You're not on that channel")
+			return
+		}
+		c.reply("324", params[0], "+n")
+		return
+	}
+	// Modes cannot be changed.
+	c.reply("221", "+")
+}
+
+// runIRCD serves the IRC gateway until it is interrupted.
+func runIRCD(args []string) error {
+	fs := flag.NewFlagSet("ircd", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	addr := fs.String("listen", "localhost:6667", "Address to accept IRC clients on.")
+	root := fs.String("channel-root", "", "Path that IRC channel names are relative to.  If empty, IRC channel names are full channel paths.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	limits, err := inboundLimitsFromFlags()
+	if err != nil {
+		return err
+	}
+	bl, err := loadBlocklist(*configFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	s := newIRCServer(ctx, bl, limits, *root)
+	go s.serve(ln)
+	fmt.Printf("Accepting IRC clients on %s\n", ln.Addr())
+
+	<-signals.ShutdownOnSignals(ctx)
+	ln.Close()
+	s.mu.Lock()
+	var channels []*ircChannel
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	s.mu.Unlock()
+	for _, ch := range channels {
+		ch.cr.Leave()
+		ch.cr.Close()
+	}
+	return nil
+}
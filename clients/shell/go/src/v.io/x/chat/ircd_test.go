@@ -0,0 +1,159 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"v.io/x/chat/chatlib"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ircMessage
+	}{
+		{"PING :abc", ircMessage{Command: "PING", Params: []string{"abc"}}},
+		{"nick alice", ircMessage{Command: "NICK", Params: []string{"alice"}}},
+		{"USER alice 0 * :Alice Liddell", ircMessage{Command: "USER", Params: []string{"alice", "0", "*", "Alice Liddell"}}},
+		{":alice PRIVMSG #a/b :hello  :world", ircMessage{Prefix: "alice", Command: "PRIVMSG", Params: []string{"#a/b", "hello  :world"}}},
+		{"PRIVMSG #a :", ircMessage{Command: "PRIVMSG", Params: []string{"#a", ""}}},
+		{"QUIT", ircMessage{Command: "QUIT"}},
+	}
+	for _, test := range tests {
+		if got := parseIRCLine(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseIRCLine(%q): got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestIRCNick(t *testing.T) {
+	tests := map[string]string{
+		"alice":             "alice",
+		"alice@example.com": "alice_example.com",
+		"bob smith!":        "bob_smith_",
+		"":                  "_",
+	}
+	for name, want := range tests {
+		if got := ircNick(name); got != want {
+			t.Errorf("ircNick(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestIRCChannelPath(t *testing.T) {
+	tests := []struct {
+		root, name, path string
+		ok               bool
+	}{
+		{"", "#path/to/channel", "path/to/channel", true},
+		{"users/bob/apps/chat", "#public", "users/bob/apps/chat/public", true},
+		{"users/bob/apps/chat/", "#public", "users/bob/apps/chat/public", true},
+		{"", "path/to/channel", "", false},
+		{"", "#", "", false},
+		{"", "#a,b", "", false},
+	}
+	for _, test := range tests {
+		path, ok := ircChannelPath(test.root, test.name)
+		if path != test.path || ok != test.ok {
+			t.Errorf("ircChannelPath(%q, %q): got %q, %v, want %q, %v", test.root, test.name, path, ok, test.path, test.ok)
+		}
+	}
+}
+
+func TestSplitIRCText(t *testing.T) {
+	long := strings.Repeat("é", maxIRCText)
+	pieces := splitIRCText("one\r\ntwo\n" + long)
+	if len(pieces) != 4 || pieces[0] != "one" || pieces[1] != "two" {
+		t.Fatalf("Got pieces %q", pieces)
+	}
+	if got := pieces[2] + pieces[3]; got != long {
+		t.Errorf("Long line was not split at rune boundaries")
+	}
+	for _, p := range pieces {
+		if len(p) > maxIRCText {
+			t.Errorf("Got piece of %d bytes, want at most %d", len(p), maxIRCText)
+		}
+	}
+}
+
+func TestIRCRegistration(t *testing.T) {
+	s := newIRCServer(nil, nil, chatlib.DefaultInboundLimits, "")
+	client, server := net.Pipe()
+	defer client.Close()
+	go newIRCConn(s, server).run()
+
+	r := bufio.NewReader(client)
+	exchange := func(line string, want ...string) {
+		client.Write([]byte(line + "\r\n"))
+		for _, w := range want {
+			got, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("After %q: %v", line, err)
+			}
+			if !strings.HasPrefix(got, w) {
+				t.Errorf("After %q: got %q, want a line starting with %q", line, got, w)
+			}
+		}
+	}
+	exchange("JOIN #a", ":chat.v.io 451 *")
+	exchange("NICK 1alice", ":chat.v.io 432 * 1alice")
+	exchange("NICK alice")
+	exchange("USER alice 0 * :Alice", ":chat.v.io 001 alice", ":chat.v.io 002", ":chat.v.io 003", ":chat.v.io 004", ":chat.v.io 422")
+	exchange("PING :123", ":chat.v.io PONG chat.v.io :123")
+	exchange("PART #a", ":chat.v.io 442 alice #a")
+	exchange("PRIVMSG bob :hi", ":chat.v.io 401 alice bob")
+	exchange("FOO", ":chat.v.io 421 alice FOO")
+	exchange("QUIT", "ERROR")
+
+	// The nick is released when the client goes away.
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Connection still open after QUIT")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.nicks) != 0 {
+		t.Errorf("Got nicks %v after QUIT, want none", s.nicks)
+	}
+}
+
+func TestIRCSlowClient(t *testing.T) {
+	s := newIRCServer(nil, nil, chatlib.DefaultInboundLimits, "")
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newIRCConn(s, server)
+	// The client never reads, so the lines pile up until it is
+	// disconnected rather than holding up the channels it is in.
+	for i := 0; i <= ircOutboxSize; i++ {
+		c.send("PING :%d", i)
+	}
+	select {
+	case <-c.closing:
+	default:
+		t.Errorf("Slow client still connected after %d lines", ircOutboxSize+1)
+	}
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Errorf("Connection still open after disconnecting the client")
+	}
+}
+
+func TestIRCRelayedBack(t *testing.T) {
+	c := newIRCConn(nil, nil)
+	c.addRelayed("1")
+	// Only the messages relayed for the user are not echoed to them, once.
+	if c.relayedBack("2") {
+		t.Errorf("Got a message relayed for someone else as relayed back")
+	}
+	if !c.relayedBack("1") {
+		t.Errorf("Got the relayed message as not relayed back")
+	}
+	if c.relayedBack("1") {
+		t.Errorf("Got the relayed message as relayed back twice")
+	}
+}
@@ -10,24 +10,131 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
 	"github.com/nlacasse/gocui"
 
 	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/security"
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
 	"v.io/x/lib/vlog"
+
+	_ "v.io/x/ref/runtime/factories/roaming"
 )
 
 var (
-	mounttable  = flag.String("mounttable", "/ns.dev.v.io:8101", "Mounttable where channel is mounted.")
-	proxy       = flag.String("proxy", "proxy", "Proxy to listen on.")
-	channelName = flag.String("channel", "users/vanadium.bot@gmail.com/apps/chat/public", "Channel to join.")
+	mounttable   = flag.String("mounttable", "/ns.dev.v.io:8101", "Mounttable where channel is mounted.")
+	proxy        = flag.String("proxy", "proxy", "Proxy to listen on.")
+	channelNames = flag.String("channel", "users/vanadium.bot@gmail.com/apps/chat/public", "Comma-separated list of channels to join.")
+
+	historyDir         = flag.String("history-dir", defaultHistoryDir(), "Directory where chat history is kept.  If empty, no history is kept.")
+	historyMaxMessages = flag.Int("history-max-messages", 10000, "Maximum number of messages to keep in the history of each channel.  Zero means no limit.")
+	historyMaxAge      = flag.Duration("history-max-age", 30*24*time.Hour, "Maximum age of messages to keep in the history of each channel.  Zero means no limit.")
+	historyReplay      = flag.Int("history-replay", 50, "Number of messages from the history to display on startup.")
+	historySync        = flag.Int("history-sync", 100, "Maximum number of messages to fetch from other members on joining the channel.")
+	serveHistory       = flag.Bool("serve-history", true, "Whether to share our history with members who join the channel.")
+
+	headless = flag.Bool("headless", false, "Run without the UI.  Commands are read from stdin and events are written to stdout, as JSON lines.")
+
+	encrypt = flag.Bool("encrypt", false, "Encrypt the messages we send end-to-end, with a key shared by the members of each channel.")
+
+	maxMessageSize = flag.Int("max-message-size", chatlib.DefaultInboundLimits.MaxMessageSize, "Maximum size in bytes of the messages we accept.  Zero means no limit.")
+	rateLimit      = flag.Float64("rate-limit", chatlib.DefaultInboundLimits.Rate, "Number of messages per second we accept from each sender on average.  Zero means no limit.")
+	rateBurst      = flag.Int("rate-burst", chatlib.DefaultInboundLimits.Burst, "Number of messages we accept from each sender at once.")
+	inboundQueue   = flag.Int("inbound-queue-size", chatlib.DefaultInboundLimits.QueueSize, "Number of received messages that can be waiting to be displayed.")
+	inboundPolicy  = flag.String("inbound-queue-policy", chatlib.DefaultInboundLimits.Policy.String(), "What to do with messages received while the inbound queue is full: drop them, or block their senders until there is room.")
+
+	configFile = flag.String("config", defaultConfigFile(), "File where the principals we blocked or muted are kept.  If empty, they are forgotten on exit.")
+
+	downloadDir = flag.String("download-dir", defaultDownloadDir(), "Directory where files that members send us are saved.  If empty, files are refused.")
+
+	trustedBridges = flag.String("trusted-bridges", "", "Comma-separated list of blessing patterns of the bridges trusted to relay messages on behalf of other users.")
+
+	membersPollInterval = flag.Duration("members-poll-interval", 2*time.Second, "How often to check for members joining or leaving the channel.")
+	membersPollJitter   = flag.Duration("members-poll-jitter", 500*time.Millisecond, "Maximum random amount added to or removed from members-poll-interval.")
 )
 
+// defaultHistoryDir returns the directory where chat history is kept by
+// default.
+func defaultHistoryDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".vanadium-chat", "history")
+}
+
+// defaultConfigFile returns the file where the blocklist is kept by default.
+func defaultConfigFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".vanadium-chat", "config.json")
+}
+
+// defaultDownloadDir returns the directory where received files are saved by
+// default.
+func defaultDownloadDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".vanadium-chat", "downloads")
+}
+
+// inboundLimitsFromFlags returns the limits on the messages we accept, as set
+// by the flags.
+func inboundLimitsFromFlags() (chatlib.InboundLimits, error) {
+	policy, err := chatlib.ParseQueuePolicy(*inboundPolicy)
+	if err != nil {
+		return chatlib.InboundLimits{}, err
+	}
+	limits := chatlib.InboundLimits{
+		MaxMessageSize: *maxMessageSize,
+		Rate:           *rateLimit,
+		Burst:          *rateBurst,
+		QueueSize:      *inboundQueue,
+		Policy:         policy,
+	}
+	if err := limits.Validate(); err != nil {
+		return chatlib.InboundLimits{}, err
+	}
+	return limits, nil
+}
+
+// openChannel creates a channel configured by the flags, and by any extra
+// options.  The channel is not joined.
+func openChannel(ctx *context.T, path string, bl *blocklist, limits chatlib.InboundLimits, extra ...chatlib.Option) (*chatlib.Channel, error) {
+	bridges, err := chatlib.ParsePatterns(*trustedBridges)
+	if err != nil {
+		return nil, err
+	}
+	opts := []chatlib.Option{
+		chatlib.WithMounttable(*mounttable),
+		chatlib.WithProxy(*proxy),
+		chatlib.WithEncryption(*encrypt),
+		chatlib.WithInboundLimits(limits),
+		chatlib.WithTrustedBridges(bridges),
+	}
+	if *historyDir != "" {
+		opts = append(opts, chatlib.WithHistory(*historyDir, *historyMaxMessages, *historyMaxAge), chatlib.WithServeHistory(*serveHistory))
+	}
+	if bl != nil {
+		opts = append(opts, chatlib.WithBlocked(bl.isBlocked))
+	}
+	return chatlib.New(ctx, path, append(opts, extra...)...)
+}
+
 const welcomeText = `***Welcome to Vanadium Chat***
+Press Alt-1 to Alt-9 to switch channels.
 Press Ctrl-C to exit.
 `
 
@@ -40,9 +147,6 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-
-	// Make sure that *nothing* ever gets printed to stderr.
-	os.Stderr.Close()
 }
 
 // Defines the layout of the UI.
@@ -51,13 +155,19 @@ func layout(g *gocui.Gui) error {
 
 	membersViewWidth := 30
 	messageInputViewHeight := 3
+	tabsViewHeight := 2
 
-	if _, err := g.SetView("history", -1, -1, maxX-membersViewWidth, maxY-messageInputViewHeight); err != nil {
+	if _, err := g.SetView("tabs", -1, -1, maxX, tabsViewHeight-1); err != nil {
 		if err != gocui.ErrorUnkView {
 			return err
 		}
 	}
-	if membersView, err := g.SetView("members", maxX-membersViewWidth, -1, maxX, maxY-messageInputViewHeight); err != nil {
+	if _, err := g.SetView("history", -1, tabsViewHeight-1, maxX-membersViewWidth, maxY-messageInputViewHeight); err != nil {
+		if err != gocui.ErrorUnkView {
+			return err
+		}
+	}
+	if membersView, err := g.SetView("members", maxX-membersViewWidth, tabsViewHeight-1, maxX, maxY-messageInputViewHeight); err != nil {
 		if err != gocui.ErrorUnkView {
 			return err
 		}
@@ -77,13 +187,22 @@ func layout(g *gocui.Gui) error {
 
 // app encapsulates the UI and the channel logic.
 type app struct {
-	cr            *channel
-	g             *gocui.Gui
-	hw            *historyWriter
-	cachedMembers []string
+	// Vanadium context.
+	ctx *context.T
+	g   *gocui.Gui
+	// Joined channels, in the order they are shown in the tabs view.
+	tabs []*chatTab
+	// Index in tabs of the channel being displayed.
+	current int
+	// Commands that can be typed in the message input.
+	commands *commandRegistry
+	// Principals whose messages are dropped or not displayed.
+	blocklist *blocklist
+	// Limits on the messages we accept in each channel.
+	limits chatlib.InboundLimits
 	// Function to call when shutting down the app.
 	shutdown func()
-	// Mutex to protect read/writes to cachedMembers array.
+	// Mutex to protect read/writes to tabs and current.
 	mu sync.Mutex
 }
 
@@ -107,26 +226,33 @@ func newApp() *app {
 		g.Close()
 	}
 
-	cr, err := newChannel(ctx, *mounttable, *proxy, *channelName)
+	limits, err := inboundLimitsFromFlags()
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	historyView, err := g.View("history")
+	bl, err := loadBlocklist(*configFile)
 	if err != nil {
 		log.Panicln(err)
 	}
-	hw := newHistoryWriter(historyView, cr.UserName())
-	hw.Write([]byte(color.RedString(welcomeText)))
-
-	hw.Write([]byte(fmt.Sprintf("You have joined channel '%s' on mounttable '%s'.\n"+
-		"Your username is '%s'.\n\n", *channelName, *mounttable, cr.UserName())))
 
 	a := &app{
-		cr:       cr,
-		g:        g,
-		hw:       hw,
-		shutdown: shutdown,
+		ctx:       ctx,
+		g:         g,
+		commands:  newCommandRegistry(),
+		blocklist: bl,
+		limits:    limits,
+		shutdown:  shutdown,
+	}
+
+	if err := a.registerBuiltinCommands(); err != nil {
+		log.Panicln(err)
+	}
+	if err := a.registerBlocklistCommands(); err != nil {
+		log.Panicln(err)
+	}
+	if err := a.registerFileCommands(); err != nil {
+		log.Panicln(err)
 	}
 
 	if err := a.setKeybindings(); err != nil {
@@ -138,7 +264,7 @@ func newApp() *app {
 
 // Helper method to log to the history console when debugging.
 func (a *app) log(m string) {
-	a.hw.Write([]byte("LOG: " + m + "\n"))
+	a.currentTab().hw.Write([]byte("LOG: " + m + "\n"))
 }
 
 func (a *app) quit(g *gocui.Gui, v *gocui.View) error {
@@ -147,13 +273,138 @@ func (a *app) quit(g *gocui.Gui, v *gocui.View) error {
 
 func (a *app) handleSendMessage(g *gocui.Gui, v *gocui.View) error {
 	text := strings.TrimSpace(v.Buffer())
+	t := a.currentTab()
+	if t == nil {
+		return nil
+	}
+	if id := t.editingID(); id != "" {
+		// Saving an edit with no text deletes the message.
+		t.setEditing("")
+		kind := vdl.MessageKindEdit
+		if text == "" {
+			kind = vdl.MessageKindDelete
+		}
+		if err := a.sendEdit(t, kind, id, text); err != nil {
+			a.print(red(err.Error()))
+			return nil
+		}
+		v.Clear()
+		v.SetCursor(0, 0)
+		return nil
+	}
 	if text == "" {
 		return nil
 	}
-	if err := a.cr.broadcastMessage(text); err != nil {
-		return err
+	if isCommand(text) {
+		v.Clear()
+		v.SetCursor(0, 0)
+		err := a.commands.run(text)
+		if err == gocui.Quit {
+			return err
+		}
+		if err != nil {
+			a.print(red(err.Error()))
+		}
+		return nil
+	}
+	// A message starting with "//" is sent starting with "/".
+	text = strings.TrimPrefix(text, "/")
+	opts := t.newMessageOptions()
+	if t.peer != "" {
+		if err := a.sendPrivate(t, vdl.MessageKindText, text, opts...); err != nil {
+			a.print(red(err.Error()))
+			return nil
+		}
+		v.Clear()
+		return nil
+	}
+	if err := t.cr.Broadcast(vdl.MessageKindText, text, opts...); err != nil {
+		// Keep the input, so that the message can be sent again.
+		a.print(red(err.Error()))
+		return nil
+	}
+	v.Clear()
+	return nil
+}
+
+// handleEditLast starts editing the last message we sent in the current tab,
+// if the message input is empty.  Otherwise the Up arrow moves the cursor up,
+// as it does without the binding.
+func (a *app) handleEditLast(g *gocui.Gui, v *gocui.View) error {
+	t := a.currentTab()
+	if t == nil || strings.TrimSpace(v.Buffer()) != "" {
+		moveCursorUp(v)
+		return nil
+	}
+	m, ok := t.lastOwnMessage()
+	if !ok {
+		return nil
+	}
+	t.setEditing(m.ID)
+	v.Clear()
+	v.Write([]byte(m.Text))
+	// The cursor is counted in runes, on the last line of the text.
+	lines := strings.Split(m.Text, "\n")
+	v.SetCursor(utf8.RuneCountInString(lines[len(lines)-1]), len(lines)-1)
+	a.print(yellow("Editing your last message.  Press Enter to save it, or Esc to cancel.  Saving it empty deletes it."))
+	return nil
+}
+
+// handleCancel stops editing a message, and clears the message input.  It
+// also stops replying to a message, and clears the selection.
+func (a *app) handleCancel(g *gocui.Gui, v *gocui.View) error {
+	t := a.currentTab()
+	if t == nil {
+		return nil
+	}
+	t.setReplying("")
+	t.hw.clearSelection()
+	if t.editingID() == "" {
+		return nil
 	}
+	t.setEditing("")
 	v.Clear()
+	v.SetCursor(0, 0)
+	return nil
+}
+
+// handleMoveSelection returns a handler that moves the selection in the
+// history by delta messages.
+func (a *app) handleMoveSelection(delta int) func(g *gocui.Gui, v *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if t := a.currentTab(); t != nil {
+			t.hw.moveSelection(delta)
+		}
+		return nil
+	}
+}
+
+// handleReplySelected makes the message being typed a reply to the selected
+// message.
+func (a *app) handleReplySelected(g *gocui.Gui, v *gocui.View) error {
+	t := a.currentTab()
+	if t == nil {
+		return nil
+	}
+	m, ok := t.hw.selectedMessage()
+	if !ok {
+		return nil
+	}
+	t.hw.clearSelection()
+	t.setReplying(m.ThreadID())
+	a.print(yellow("Replying to '" + quoteEntry(historyEntry{msg: &m}) + "'.  Press Esc to cancel."))
+	return nil
+}
+
+// handleShowThread displays the thread of the selected message.
+func (a *app) handleShowThread(g *gocui.Gui, v *gocui.View) error {
+	t := a.currentTab()
+	if t == nil {
+		return nil
+	}
+	if m, ok := t.hw.selectedMessage(); ok {
+		a.showThread(t, m)
+	}
 	return nil
 }
 
@@ -164,15 +415,22 @@ func (a *app) handleTabComplete(g *gocui.Gui, v *gocui.View) error {
 		return nil
 	}
 
-	// Get a list of names that match the last word.
+	// Get a list of names that match the last word.  Commands complete
+	// their own names and arguments, and messages complete member names.
+	t := a.currentTab()
+	if t == nil {
+		return nil
+	}
+	candidates := t.memberNames()
+	if line := strings.TrimLeft(v.Buffer(), " "); isCommand(line) {
+		candidates = a.commands.completions(strings.TrimRight(line, "\n"))
+	}
 	matchedNames := []string{}
-	a.mu.Lock()
-	for _, name := range a.cachedMembers {
+	for _, name := range candidates {
 		if strings.HasPrefix(name, lastWord) {
 			matchedNames = append(matchedNames, name)
 		}
 	}
-	a.mu.Unlock()
 
 	if len(matchedNames) == 0 {
 		return nil
@@ -198,12 +456,32 @@ func (a *app) handleTabComplete(g *gocui.Gui, v *gocui.View) error {
 	v.Write([]byte(newLine))
 
 	// Set the cursor to the end of the new line, and reset the origin.
-	v.SetCursor(len(newLine), 0)
+	v.SetCursor(utf8.RuneCountInString(newLine), 0)
 	v.SetOrigin(0, 0)
 
 	return nil
 }
 
+// moveCursorUp moves the cursor of v up a line, scrolling the view if the
+// cursor is on its first line.  The cursor stays at most at the end of the line
+// it moves to.
+func moveCursorUp(v *gocui.View) {
+	x, y := v.Cursor()
+	ox, oy := v.Origin()
+	if y == 0 {
+		if oy == 0 {
+			return
+		}
+		v.SetOrigin(ox, oy-1)
+	} else {
+		y--
+	}
+	if line, err := v.Line(y); err == nil && x > utf8.RuneCountInString(line) {
+		x = utf8.RuneCountInString(line)
+	}
+	v.SetCursor(x, y)
+}
+
 func (a *app) setKeybindings() error {
 	// Ctrl-C => Exit.
 	if err := a.g.SetKeybinding("", gocui.KeyCtrlC, 0, a.quit); err != nil {
@@ -220,82 +498,319 @@ func (a *app) setKeybindings() error {
 		return err
 	}
 
-	return nil
-}
+	// Up arrow in an empty input => Edit the last message we sent.
+	// Otherwise it moves the cursor up.
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyArrowUp, 0, a.handleEditLast); err != nil {
+		return err
+	}
 
-// updateMembers gets the members from the channel and writes them to the
-// members view. It also caches the members in app.cachedMembers for use in tab
-// autocomplete.
-func (a *app) updateMembers() {
-	membersView, err := a.g.View("members")
-	if err != nil {
-		log.Panicln(err)
+	// Esc => Cancel editing, replying or selecting.
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyEsc, 0, a.handleCancel); err != nil {
+		return err
 	}
 
-	members, err := a.cr.getMembers()
-	if err != nil {
-		log.Panicln(err)
+	// Ctrl-P and Ctrl-N => Select the previous or next message.
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyCtrlP, 0, a.handleMoveSelection(-1)); err != nil {
+		return err
+	}
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyCtrlN, 0, a.handleMoveSelection(1)); err != nil {
+		return err
 	}
 
+	// Ctrl-R => Reply to the selected message.
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyCtrlR, 0, a.handleReplySelected); err != nil {
+		return err
+	}
+
+	// Ctrl-T => Show the thread of the selected message.
+	if err := a.g.SetKeybinding("messageInput", gocui.KeyCtrlT, 0, a.handleShowThread); err != nil {
+		return err
+	}
+
+	// Alt-1 to Alt-9 => Switch channel.
+	for i := 0; i < 9; i++ {
+		if err := a.g.SetKeybinding("", rune('1'+i), gocui.ModAlt, a.handleSwitchTab(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateMembers caches the members of a channel for display and tab
+// autocomplete, and writes a line to the channel's history for each member that
+// joined or left.  The members view is redrawn if the channel is displayed.
+func (a *app) updateMembers(t *chatTab, update chatlib.MembershipUpdate) {
+	for _, event := range update.Events {
+		switch event.Kind {
+		case chatlib.MemberJoined:
+			t.hw.writeWordWrap([]byte(green(event.Member.Name+" joined") + "\n"))
+		case chatlib.MemberLeft:
+			t.hw.writeWordWrap([]byte(red(event.Member.Name+" left") + "\n"))
+		}
+	}
+
+	members := update.Members
 	memberNames := make([]string, len(members))
 
 	for i, member := range members {
 		memberNames[i] = member.Name
 	}
 
-	uniqMemberNames := uniqStrings(memberNames)
+	t.setMemberNames(uniqStrings(memberNames))
 
+	if a.currentTab() == t {
+		a.drawMembers(t)
+	}
+	a.g.Flush()
+}
+
+// drawMembers writes the members of a channel to the members view.
+func (a *app) drawMembers(t *chatTab) {
+	membersView, err := a.g.View("members")
+	if err != nil {
+		log.Panicln(err)
+	}
 	membersView.Clear()
-	for _, memberName := range uniqMemberNames {
+	for _, memberName := range t.memberNames() {
 		membersView.Write([]byte(memberName + "\n"))
 	}
-
-	a.mu.Lock()
-	a.cachedMembers = uniqMemberNames
-	a.mu.Unlock()
-	a.g.Flush()
 }
 
-// displayIncomingMessages listens for incoming messages and writes them to the
-// historyWriter.
-func (a *app) displayIncomingMessages() {
-	go func() {
-		for {
-			m := <-a.cr.messages
-			a.hw.writeMessage(m)
+// displayIncomingMessages listens for incoming messages on a channel and
+// writes them to the historyWriter of its tab, or of the tab for the private
+// conversation with their sender.  It also updates the delivery state of
+// messages we sent, shows notices about messages that were refused, and shows
+// the files that members offer to send us and the progress of file transfers
+// in the private conversations with them.  Messages and offers received while
+// their tab is not displayed are counted as unread.  Messages from muted
+// principals are not displayed, but are still kept in the history, and their
+// files are rejected.
+func (a *app) displayIncomingMessages(t *chatTab) {
+	for {
+		select {
+		case m := <-t.cr.Messages():
+			if a.blocklist.isMuted(m.SenderBlessings) {
+				continue
+			}
+			target := t
+			if m.Private {
+				target = a.privateTab(t.cr, m.SenderBlessings)
+			}
+			a.deliver(target, m)
+			if a.currentTab() != target && !m.IsOp() {
+				target.addUnread()
+				a.drawTabs()
+			}
+		case notice := <-t.cr.Notices():
+			t.hw.writeWordWrap([]byte(color.RedString(notice) + "\n"))
+		case o := <-t.cr.FileOffers():
+			if a.blocklist.isMuted(o.SenderBlessings) {
+				o.Reject()
+				continue
+			}
+			if target := a.offerFile(t.cr, o); a.currentTab() != target {
+				target.addUnread()
+				a.drawTabs()
+			}
+		case ft := <-t.cr.FileTransfers():
+			target := a.privateTab(t.cr, ft.PeerBlessings)
+			target.hw.setTransfer(ft)
+			if ft.Finished() && a.currentTab() != target {
+				target.addUnread()
+				a.drawTabs()
+			}
+		case ds := <-t.cr.Receipts():
+			// The message may have been sent from a private
+			// conversation.
+			for _, tab := range a.tabsFor(t.cr) {
+				tab.hw.setDeliveryStatus(ds)
+			}
+		case <-t.cr.Done():
+			return
 		}
-	}()
+	}
 }
 
-// run joins the channel and starts the main app loop.
+// run joins the channels and starts the main app loop.
 func (a *app) run() error {
-	// Join the channel.
-	if err := a.cr.join(); err != nil {
-		log.Panicln(err)
+	// Join the channels.
+	for _, name := range strings.Split(*channelNames, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, err := a.openTab(name); err != nil {
+			log.Panicln(err)
+		}
 	}
-	defer a.cr.leave()
+	defer a.closeAllTabs()
+	a.switchTab(0)
 
-	// Update the members view in a loop.
-	go func() {
-		for {
-			a.updateMembers()
-			time.Sleep(2 * time.Second)
+	// Start the main UI loop.
+	if err := a.g.MainLoop(); err != nil && err != gocui.Quit {
+		return err
+	}
+
+	return nil
+}
+
+// runGC deletes the names under the channel paths that were left behind by our
+// clients that crashed before they could leave the channel.  Names are only
+// deleted if they are still empty a couple of minutes after they are first
+// found, so it takes that long for each channel that has any.
+func runGC() error {
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	for _, name := range strings.Split(*channelNames, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		cr, err := chatlib.New(ctx, name, chatlib.WithMounttable(*mounttable), chatlib.WithProxy(*proxy))
+		if err != nil {
+			return err
 		}
-	}()
+		n, err := cr.CollectGarbage()
+		cr.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %d names under '%s'.\n", n, name)
+	}
+	return nil
+}
 
-	a.displayIncomingMessages()
+// runChannel manages the access control lists of channels.
+//
+// "channel create" sets the permissions of the channels so that only the
+// principals matching the -allow patterns, and us, can join them.  "channel
+// acl" prints who is allowed to join the channels, or replaces it if -allow is
+// given.
+func runChannel(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: chat channel create|acl [-allow=pattern,...] [channel,...]")
+	}
+	fs := flag.NewFlagSet("channel "+args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	allow := fs.String("allow", "", "Comma-separated list of blessing patterns allowed to join the channel.")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	names := *channelNames
+	if fs.NArg() > 0 {
+		names = fs.Arg(0)
+	}
+	allowed, err := chatlib.ParsePatterns(*allow)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "create":
+		if len(allowed) == 0 {
+			return fmt.Errorf("channel create needs -allow.")
+		}
+	case "acl":
+	default:
+		return fmt.Errorf("Unknown channel command '%s'.  The channel commands are 'create' and 'acl'.", args[0])
+	}
 
-	// Start the main UI loop.
-	if err := a.g.MainLoop(); err != nil && err != gocui.Quit {
+	ctx, shutdown := v23.Init()
+	defer shutdown()
+
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := manageChannel(ctx, args[0], name, allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manageChannel runs the channel command cmd on the channel with the given
+// name.
+func manageChannel(ctx *context.T, cmd, name string, allowed []security.BlessingPattern) error {
+	cr, err := chatlib.New(ctx, name, chatlib.WithMounttable(*mounttable), chatlib.WithProxy(*proxy))
+	if err != nil {
 		return err
 	}
+	defer cr.Close()
+	if cmd == "create" {
+		if err := cr.Create(allowed); err != nil {
+			return err
+		}
+		fmt.Printf("Created '%s'.\n", name)
+	} else if len(allowed) > 0 {
+		if err := cr.SetACL(allowed); err != nil {
+			return err
+		}
+		fmt.Printf("Changed who is allowed in '%s'.\n", name)
+	} else {
+		acl, err := cr.ACL()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Allowed in '%s': %v\n", name, acl.In)
+		if len(acl.NotIn) > 0 {
+			fmt.Printf("Not allowed in '%s': %v\n", name, acl.NotIn)
+		}
+	}
+	return nil
+}
 
+// checkPollFlags returns an error unless the members are polled at a positive
+// interval, with less jitter than the interval.
+func checkPollFlags() error {
+	if *membersPollInterval <= 0 {
+		return fmt.Errorf("-members-poll-interval must be positive, not %v.", *membersPollInterval)
+	}
+	if *membersPollJitter < 0 || *membersPollJitter >= *membersPollInterval {
+		return fmt.Errorf("-members-poll-jitter must be at least zero and less than -members-poll-interval (%v), not %v.", *membersPollInterval, *membersPollJitter)
+	}
 	return nil
 }
 
 func main() {
 	flag.Parse()
+	if err := checkPollFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "":
+	case "gc":
+		err = runGC()
+	case "channel":
+		err = runChannel(flag.Args()[1:])
+	case "bridge":
+		err = runBridge(flag.Args()[1:])
+	case "ircd":
+		err = runIRCD(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("Unknown command '%s'.  The commands are 'gc', 'channel', 'bridge' and 'ircd'.", flag.Arg(0))
+	}
+	if flag.Arg(0) != "" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *headless {
+		// Errors are reported on stdout as error events.
+		if err := runHeadless(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 
+	// Make sure that *nothing* ever gets printed to stderr while the UI
+	// owns the terminal.
+	os.Stderr.Close()
 	a := newApp()
 	defer a.shutdown()
 	if err := a.run(); err != nil {
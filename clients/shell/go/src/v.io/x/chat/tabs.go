@@ -0,0 +1,501 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/nlacasse/gocui"
+
+	"v.io/x/chat/chatlib"
+	"v.io/x/chat/vdl"
+	"v.io/x/lib/vlog"
+)
+
+// chatTab is a channel that we joined, or a private conversation with one of
+// its members, along with its history and members as displayed in the UI.
+// Only one tab is displayed at a time.
+type chatTab struct {
+	cr *chatlib.Channel
+	hw *historyWriter
+	// peer is the blessing name of the member that private messages are
+	// exchanged with, or empty if the tab shows the channel itself.
+	// peerName is the short name of the member, which the tab is titled
+	// with.
+	peer     string
+	peerName string
+	// thread is the ID of the message that started the thread shown in the
+	// tab, or empty if the tab shows a whole conversation.  Messages sent
+	// in a thread tab are replies to that message.
+	thread string
+	// threadName names the thread in the tabs view.
+	threadName string
+	// Mutex to protect members, unread, editing, replying and offers.
+	mu sync.Mutex
+	// Cached member names, used in tab autocomplete.
+	members []string
+	// Number of messages received since the tab was last displayed.
+	unread int
+	// ID of the message being edited in the message input, or empty if
+	// the input holds a new message.
+	editing string
+	// ID of the message that the message in the input replies to, or
+	// empty if it is not a reply.
+	replying string
+	// Files offered to us in the private conversation, oldest first, that
+	// have not been accepted or rejected yet.
+	offers []chatlib.FileOffer
+}
+
+// isChannel returns true if the tab shows a channel itself, as opposed to a
+// private conversation or a thread in it.
+func (t *chatTab) isChannel() bool {
+	return t.peer == "" && t.thread == ""
+}
+
+// encloses returns true if the tab other shows a conversation or thread inside
+// the one shown by t, i.e. if t is a channel and other is in that channel, or
+// if t is a private conversation and other is a thread in it.
+func (t *chatTab) encloses(other *chatTab) bool {
+	if other == t || other.cr != t.cr || t.thread != "" {
+		return false
+	}
+	return t.peer == "" || (other.peer == t.peer && other.thread != "")
+}
+
+func (t *chatTab) memberNames() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.members
+}
+
+func (t *chatTab) setMemberNames(names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.members = names
+}
+
+func (t *chatTab) editingID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.editing
+}
+
+func (t *chatTab) setEditing(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.editing = id
+}
+
+func (t *chatTab) setReplying(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replying = id
+}
+
+// newMessageOptions returns the options of a new message sent from the tab,
+// which make it a reply if one was started, or if the tab shows a thread.  The
+// reply that was started is done with.
+func (t *chatTab) newMessageOptions() []chatlib.MessageOption {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent := t.thread
+	if t.replying != "" {
+		parent, t.replying = t.replying, ""
+	}
+	if parent == "" {
+		return nil
+	}
+	return []chatlib.MessageOption{chatlib.WithParent(parent)}
+}
+
+// lastOwnMessage returns the last message we sent in the tab that can still be
+// edited.  Messages relayed by a bridge we run are not ours to edit.
+func (t *chatTab) lastOwnMessage() (chatlib.Message, bool) {
+	return t.hw.lastMessage(func(m chatlib.Message) bool {
+		return t.cr.IsOwn(m) && m.OnBehalfOf == "" && !m.DecryptFailed
+	})
+}
+
+func (t *chatTab) addUnread() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unread++
+}
+
+// title returns the text shown for the tab in the tabs view.
+func (t *chatTab) title(index int, current bool) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := shortChannelName(t.cr.Path())
+	if t.peer != "" {
+		name = "@" + t.peerName
+	}
+	if t.thread != "" {
+		name = "↳" + t.threadName
+	}
+	if t.cr.Encrypted() {
+		// Messages sent from this tab are end-to-end encrypted.
+		name += " [e2e]"
+	}
+	title := fmt.Sprintf("%d:%s", index+1, name)
+	if current {
+		return cyan("[" + title + "]")
+	}
+	if t.unread > 0 {
+		return fmt.Sprintf(" %s %s ", title, yellow(fmt.Sprintf("(%d)", t.unread)))
+	}
+	return " " + title + " "
+}
+
+// shortChannelName returns the last component of a channel path.
+func shortChannelName(path string) string {
+	path = strings.TrimRight(path, "/")
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+// currentTab returns the tab being displayed.
+func (a *app) currentTab() *chatTab {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current >= len(a.tabs) {
+		return nil
+	}
+	return a.tabs[a.current]
+}
+
+// openTab joins the channel at the given path and adds a tab for it.  The new
+// tab is not displayed until switched to.
+func (a *app) openTab(path string) (*chatTab, error) {
+	var opts []chatlib.Option
+	if *downloadDir != "" {
+		// Only the UI can ask the user to accept files.
+		opts = append(opts, chatlib.WithDownloadDir(*downloadDir))
+	}
+	cr, err := openChannel(a.ctx, path, a.blocklist, a.limits, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	hw := newHistoryWriter(nil, cr.UserName())
+	// Let senders know when their messages have been displayed.
+	hw.onDisplay = func(m chatlib.Message) {
+		cr.Acknowledge(m, vdl.ReceiptStateRead)
+	}
+	hw.Write([]byte(color.RedString(welcomeText)))
+
+	for _, m := range cr.ReplayHistory(*historyReplay) {
+		if a.blocklist.isMuted(m.SenderBlessings) || a.blocklist.isBlocked(m.SenderBlessings) {
+			continue
+		}
+		hw.writeMessage(m)
+	}
+
+	hw.Write([]byte(fmt.Sprintf("You have joined channel '%s' on mounttable '%s'.\n"+
+		"Your username is '%s'.\n", path, *mounttable, cr.UserName())))
+	if cr.Encrypted() {
+		hw.Write([]byte("Messages you send to this channel are end-to-end encrypted.\n"))
+	}
+	hw.Write([]byte("\n"))
+
+	if err := cr.Join(); err != nil {
+		cr.Close()
+		return nil, err
+	}
+
+	t := &chatTab{cr: cr, hw: hw}
+	a.mu.Lock()
+	a.tabs = append(a.tabs, t)
+	a.mu.Unlock()
+
+	// Update the members view whenever the members change.
+	go func() {
+		for update := range cr.WatchMembers(*membersPollInterval, *membersPollJitter) {
+			a.updateMembers(t, update)
+		}
+	}()
+
+	go a.displayIncomingMessages(t)
+
+	// Fetch the messages we missed from other members.
+	go func() {
+		if n, err := cr.SyncHistory(*historySync); err == nil && n > 0 {
+			hw.writeWordWrap([]byte(fmt.Sprintf("Fetched %d earlier messages from other members.\n", n)))
+		}
+	}()
+
+	a.drawTabs()
+	return t, nil
+}
+
+// privateTab returns the tab for the private conversation with the member of a
+// channel that has the given blessings, and adds one if there is none.
+// Conversations are identified by blessing names rather than short names, since
+// principals under different blessing roots can have the same short name.
+func (a *app) privateTab(cr *chatlib.Channel, blessings []string) *chatTab {
+	a.mu.Lock()
+	for _, t := range a.tabs {
+		if t.cr == cr && t.thread == "" && t.peer != "" && chatlib.HasBlessing(blessings, t.peer) {
+			a.mu.Unlock()
+			return t
+		}
+	}
+	peer, name := "unknown", chatlib.ShortName(blessings)
+	if len(blessings) > 0 {
+		peer = blessings[0]
+	}
+	hw := newHistoryWriter(nil, cr.UserName())
+	hw.onDisplay = func(m chatlib.Message) {
+		cr.Acknowledge(m, vdl.ReceiptStateRead)
+	}
+	hw.Write([]byte(fmt.Sprintf("Private conversation with '%s' (%s) in channel '%s'.\n"+
+		"Messages in this conversation are only sent to '%s', and are not kept in the channel history.\n\n",
+		name, peer, cr.Path(), name)))
+	t := &chatTab{cr: cr, hw: hw, peer: peer, peerName: name, members: []string{name}}
+	a.tabs = append(a.tabs, t)
+	a.mu.Unlock()
+
+	a.drawTabs()
+	return t
+}
+
+// channelTab returns the tab that shows the channel itself, as opposed to a
+// private conversation in it.
+func (a *app) channelTab(cr *chatlib.Channel) *chatTab {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, t := range a.tabs {
+		if t.cr == cr && t.isChannel() {
+			return t
+		}
+	}
+	return nil
+}
+
+// conversationTab returns the tab of the conversation that a tab shows a
+// thread of, or the tab itself if it does not show a thread.
+func (a *app) conversationTab(t *chatTab) *chatTab {
+	switch {
+	case t.thread == "":
+		return t
+	case t.peer != "":
+		return a.privateTab(t.cr, []string{t.peer})
+	default:
+		return a.channelTab(t.cr)
+	}
+}
+
+// threadTab returns the tab for the thread started by the message with the
+// given ID, in the conversation shown by the tab conv, and adds one if there
+// is none.
+func (a *app) threadTab(conv *chatTab, root chatlib.Message) *chatTab {
+	a.mu.Lock()
+	for _, t := range a.tabs {
+		if t.cr == conv.cr && t.peer == conv.peer && t.thread == root.ID {
+			a.mu.Unlock()
+			return t
+		}
+	}
+	name := root.SenderName
+	if user := root.RelayedFor(); user != "" {
+		name = user
+	}
+	hw := conv.hw.threadWriter(root.ID, []byte(fmt.Sprintf("Thread started by '%s'.\n"+
+		"Messages you send in this tab are replies to it.\n\n", name)))
+	t := &chatTab{cr: conv.cr, hw: hw, peer: conv.peer, peerName: conv.peerName, thread: root.ID, threadName: name, members: conv.memberNames()}
+	a.tabs = append(a.tabs, t)
+	a.mu.Unlock()
+
+	a.drawTabs()
+	return t
+}
+
+// deliver writes a message to the tab of the conversation it was sent in,
+// and to the tab of the thread it belongs to, if one is open.
+func (a *app) deliver(conv *chatTab, m chatlib.Message) {
+	conv.hw.writeMessage(m)
+	a.mu.Lock()
+	var threads []*chatTab
+	for _, t := range a.tabs {
+		if t.cr == conv.cr && t.peer == conv.peer && t.thread != "" {
+			threads = append(threads, t)
+		}
+	}
+	a.mu.Unlock()
+	for _, t := range threads {
+		inThread := m.ThreadID() == t.thread
+		if m.IsOp() {
+			_, inThread = t.hw.message(m.Target)
+		}
+		if inThread {
+			t.hw.writeMessage(m)
+		}
+	}
+}
+
+// tabsFor returns the tabs that show a channel or the private conversations
+// in it.
+func (a *app) tabsFor(cr *chatlib.Channel) []*chatTab {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var tabs []*chatTab
+	for _, t := range a.tabs {
+		if t.cr == cr {
+			tabs = append(tabs, t)
+		}
+	}
+	return tabs
+}
+
+// tabIndex returns the index of a tab, or -1 if it was closed.
+func (a *app) tabIndex(t *chatTab) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return indexOfTab(a.tabs, t)
+}
+
+// closeTab removes a tab, and the tabs of the conversations and threads it
+// encloses.  If the tab shows a channel, the channel is left.  If the displayed
+// tab was removed, the tab before it is displayed instead.
+func (a *app) closeTab(t *chatTab) error {
+	a.mu.Lock()
+	index := indexOfTab(a.tabs, t)
+	if index < 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	current := a.tabs[a.current]
+	var kept, removed []*chatTab
+	for _, tab := range a.tabs {
+		if tab == t || t.encloses(tab) {
+			removed = append(removed, tab)
+		} else {
+			kept = append(kept, tab)
+		}
+	}
+	// Keep displaying the same tab if it was not removed.  Otherwise
+	// display the nearest remaining tab before the one that was closed.
+	newCurrent := indexOfTab(kept, current)
+	wasCurrent := newCurrent < 0
+	if wasCurrent {
+		newCurrent = 0
+		for i := index - 1; i >= 0; i-- {
+			if j := indexOfTab(kept, a.tabs[i]); j >= 0 {
+				newCurrent = j
+				break
+			}
+		}
+	}
+	a.tabs = kept
+	a.current = newCurrent
+	a.mu.Unlock()
+
+	for _, tab := range removed {
+		tab.hw.detach()
+	}
+	var err error
+	if t.isChannel() {
+		err = t.cr.Leave()
+		t.cr.Close()
+	}
+
+	if wasCurrent {
+		a.switchTab(newCurrent)
+	} else {
+		a.drawTabs()
+	}
+	return err
+}
+
+// indexOfTab returns the index of t in tabs, or -1 if it is not there.
+func indexOfTab(tabs []*chatTab, t *chatTab) int {
+	for i, tab := range tabs {
+		if tab == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// closeAllTabs leaves all channels.
+func (a *app) closeAllTabs() {
+	a.mu.Lock()
+	tabs := append([]*chatTab(nil), a.tabs...)
+	a.mu.Unlock()
+	for _, t := range tabs {
+		if err := a.closeTab(t); err != nil {
+			vlog.Errorf("leaving %q failed: %v", t.cr.Path(), err)
+		}
+	}
+}
+
+// switchTab displays the tab at the given index.  It does nothing if there is
+// no such tab.
+func (a *app) switchTab(index int) {
+	a.mu.Lock()
+	if index < 0 || index >= len(a.tabs) {
+		a.mu.Unlock()
+		return
+	}
+	prev := a.tabs[a.current%len(a.tabs)]
+	a.current = index
+	t := a.tabs[index]
+	a.mu.Unlock()
+
+	historyView, err := a.g.View("history")
+	if err != nil {
+		log.Panicln(err)
+	}
+	if prev != t {
+		prev.hw.detach()
+		// An edit is only sent from the tab it was started in.
+		prev.setEditing("")
+		prev.setReplying("")
+		prev.hw.clearSelection()
+	}
+	t.mu.Lock()
+	t.unread = 0
+	t.mu.Unlock()
+	t.hw.attach(historyView)
+	a.drawMembers(t)
+	a.drawTabs()
+}
+
+// handleSwitchTab returns a keybinding handler that displays the tab at the
+// given index.
+func (a *app) handleSwitchTab(index int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		a.switchTab(index)
+		return nil
+	}
+}
+
+// drawTabs writes the title of every tab to the tabs view.  Tabs other than
+// the one displayed show the number of unread messages they have.
+func (a *app) drawTabs() {
+	tabsView, err := a.g.View("tabs")
+	if err != nil {
+		log.Panicln(err)
+	}
+	a.mu.Lock()
+	tabs := append([]*chatTab(nil), a.tabs...)
+	current := a.current
+	a.mu.Unlock()
+
+	titles := make([]string, len(tabs))
+	for i, t := range tabs {
+		titles[i] = t.title(i, i == current)
+	}
+	tabsView.Clear()
+	tabsView.Write([]byte(strings.Join(titles, "|")))
+	a.g.Flush()
+}
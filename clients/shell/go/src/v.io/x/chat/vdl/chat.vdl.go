@@ -8,19 +8,326 @@
 package vdl
 
 import (
+	"fmt"
+	"io"
+	"time"
+
 	"v.io/v23"
 	"v.io/v23/context"
 	"v.io/v23/rpc"
+	"v.io/v23/security"
+	"v.io/v23/vdl"
+	_ "v.io/v23/vdlroot/time"
 )
 
 func __VDLEnsureNativeBuilt_chat() {
 }
 
+// MessageKind describes how the content of a message should be displayed.
+type MessageKind int
+
+const (
+	MessageKindText MessageKind = iota
+	MessageKindAction
+	MessageKindEdit
+	MessageKindDelete
+	MessageKindReact
+	MessageKindUnreact
+)
+
+// MessageKindAll holds all labels for MessageKind.
+var MessageKindAll = [...]MessageKind{MessageKindText, MessageKindAction, MessageKindEdit, MessageKindDelete, MessageKindReact, MessageKindUnreact}
+
+// MessageKindFromString creates a MessageKind from a string label.
+func MessageKindFromString(label string) (x MessageKind, err error) {
+	err = x.Set(label)
+	return
+}
+
+// Set assigns label to x.
+func (x *MessageKind) Set(label string) error {
+	switch label {
+	case "Text", "text":
+		*x = MessageKindText
+		return nil
+	case "Action", "action":
+		*x = MessageKindAction
+		return nil
+	case "Edit", "edit":
+		*x = MessageKindEdit
+		return nil
+	case "Delete", "delete":
+		*x = MessageKindDelete
+		return nil
+	case "React", "react":
+		*x = MessageKindReact
+		return nil
+	case "Unreact", "unreact":
+		*x = MessageKindUnreact
+		return nil
+	}
+	*x = -1
+	return fmt.Errorf("unknown label %q in vdl.MessageKind", label)
+}
+
+// String returns the string label of x.
+func (x MessageKind) String() string {
+	switch x {
+	case MessageKindText:
+		return "Text"
+	case MessageKindAction:
+		return "Action"
+	case MessageKindEdit:
+		return "Edit"
+	case MessageKindDelete:
+		return "Delete"
+	case MessageKindReact:
+		return "React"
+	case MessageKindUnreact:
+		return "Unreact"
+	}
+	return ""
+}
+
+func (MessageKind) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.MessageKind"`
+	Enum struct{ Text, Action, Edit, Delete, React, Unreact string }
+}) {
+}
+
+// ReceiptState is the state of a message at one of its recipients.
+type ReceiptState int
+
+const (
+	ReceiptStateDelivered ReceiptState = iota
+	ReceiptStateRead
+)
+
+// ReceiptStateAll holds all labels for ReceiptState.
+var ReceiptStateAll = [...]ReceiptState{ReceiptStateDelivered, ReceiptStateRead}
+
+// ReceiptStateFromString creates a ReceiptState from a string label.
+func ReceiptStateFromString(label string) (x ReceiptState, err error) {
+	err = x.Set(label)
+	return
+}
+
+// Set assigns label to x.
+func (x *ReceiptState) Set(label string) error {
+	switch label {
+	case "Delivered", "delivered":
+		*x = ReceiptStateDelivered
+		return nil
+	case "Read", "read":
+		*x = ReceiptStateRead
+		return nil
+	}
+	*x = -1
+	return fmt.Errorf("unknown label %q in vdl.ReceiptState", label)
+}
+
+// String returns the string label of x.
+func (x ReceiptState) String() string {
+	switch x {
+	case ReceiptStateDelivered:
+		return "Delivered"
+	case ReceiptStateRead:
+		return "Read"
+	}
+	return ""
+}
+
+func (ReceiptState) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.ReceiptState"`
+	Enum struct{ Delivered, Read string }
+}) {
+}
+
+// Message is a chat message, as generated by its sender.
+type Message struct {
+	// Id uniquely identifies the message.  It is generated by the sender,
+	// and can be used by recipients to detect duplicates.
+	Id string
+	// Timestamp is the time the message was sent, according to the
+	// sender's clock.
+	Timestamp time.Time
+	// Channel is the path of the channel the message was sent to.
+	Channel string
+	// Kind is the kind of content carried by the message.
+	Kind MessageKind
+	// Text is the content of the message.
+	Text string
+	// Clock is the sender's Lamport clock at the time the message was sent.
+	// Messages are displayed in order of (Clock, Id), which is the same at
+	// all members and respects causality.
+	Clock uint64
+	// ReplyTo is the name of the sender's chat server, which receipts for
+	// the message should be sent to.  It is empty if the sender does not
+	// want receipts.
+	ReplyTo string
+	// Private is true if the message was sent to the recipient only, rather
+	// than to all members of the channel.  Private messages are not kept
+	// in the history of the channel.
+	Private bool
+	// KeyId identifies the group key that the text of the message was
+	// encrypted with, or is empty if the message is not encrypted.  The
+	// Text of an encrypted message is a placeholder, for members that
+	// cannot decrypt it.
+	KeyId string
+	// Nonce and Ciphertext hold the encrypted text of the message.
+	Nonce      []byte
+	Ciphertext []byte
+	// OnBehalfOf is the name of the user that the sender relayed the
+	// message for, e.g. the user of a bridge to another chat system.  It is
+	// empty if the sender wrote the message.
+	OnBehalfOf string
+	// Target is the Id of the earlier message that an Edit, Delete, React
+	// or Unreact message applies to.  Edits and deletions are only applied
+	// if they are signed by the sender of the earlier message.
+	Target string
+	// Parent is the Id of the message that this message replies to, or
+	// empty if the message is not a reply.  Replies to a reply name the
+	// message that started the thread, so threads are one level deep.
+	Parent string
+	// Signer is the blessings of the sender, that the message was signed
+	// with.
+	Signer security.Blessings
+	// Signature is a signature of the message by the principal of the
+	// sender.  It covers all other fields of the message, so that the
+	// message can be attributed to its sender however it was received.
+	Signature security.Signature
+}
+
+func (Message) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.Message"`
+}) {
+}
+
+// HistoryEntry is a message in the history of a channel, as kept by one of
+// its members.
+type HistoryEntry struct {
+	Message Message
+	// SenderBlessings is the blessings of the sender of the message, as seen
+	// by the member that received it.
+	SenderBlessings []string
+}
+
+func (HistoryEntry) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.HistoryEntry"`
+}) {
+}
+
+// GroupKeyRequest asks a member of a channel for the key that messages to the
+// channel are encrypted with.
+type GroupKeyRequest struct {
+	// KeyId identifies the key requested.  If it is empty, the member's
+	// current key is requested.
+	KeyId string
+	// PublicKey is an ephemeral ECDH public key of the requester, that the
+	// group key is encrypted for.
+	PublicKey []byte
+	// Signature is a signature of the request by the principal of the
+	// requester, which binds PublicKey to the requester's blessings.
+	Signature security.Signature
+}
+
+func (GroupKeyRequest) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.GroupKeyRequest"`
+}) {
+}
+
+// GroupKeyGrant is a group key, encrypted for the member that requested it.
+type GroupKeyGrant struct {
+	// KeyId identifies the key.
+	KeyId string
+	// Epoch is incremented every time the key is rotated.  Members use the
+	// key with the highest epoch, and of those the one with the highest
+	// KeyId, to encrypt the messages they send.
+	Epoch uint64
+	// PublicKey is an ephemeral ECDH public key of the granter.
+	PublicKey []byte
+	// Signature is a signature of the grant by the principal of the
+	// granter, which binds PublicKey to the granter's blessings.
+	Signature security.Signature
+	// Nonce and WrappedKey hold the group key, encrypted with the key
+	// shared by the two ECDH key pairs.
+	Nonce      []byte
+	WrappedKey []byte
+}
+
+func (GroupKeyGrant) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.GroupKeyGrant"`
+}) {
+}
+
+// FileOffer announces a file that a member wants to send to another.
+type FileOffer struct {
+	// Id identifies the transfer.  An interrupted transfer is resumed by
+	// offering the same file again with the same Id.
+	Id string
+	// Name is the name of the file, without any directory.
+	Name string
+	// Size is the size of the file in bytes.
+	Size int64
+	// Sha256 is the SHA-256 hash of the contents of the file, which the
+	// recipient checks once it has received all of them.
+	Sha256 []byte
+}
+
+func (FileOffer) __VDLReflect(struct {
+	Name string `vdl:"v.io/x/chat/vdl.FileOffer"`
+}) {
+}
+
+func init() {
+	vdl.Register((*MessageKind)(nil))
+	vdl.Register((*ReceiptState)(nil))
+	vdl.Register((*Message)(nil))
+	vdl.Register((*HistoryEntry)(nil))
+	vdl.Register((*GroupKeyRequest)(nil))
+	vdl.Register((*GroupKeyGrant)(nil))
+	vdl.Register((*FileOffer)(nil))
+}
+
+// ProtocolVersion is the version of the Chat protocol that this client
+// implements.  Version 2 added the Edit, Delete, React and Unreact message
+// kinds, which clients that implement version 1 fail to decode.
+const ProtocolVersion = int32(2)
+
 // ChatClientMethods is the client interface
 // containing Chat methods.
 type ChatClientMethods interface {
 	// SendMessage sends a message to a user.
+	//
+	// Deprecated: SendMessage is only kept for compatibility with older
+	// clients.  Use SendMessageV2 instead.
 	SendMessage(_ *context.T, text string, _ ...rpc.CallOpt) error
+	// SendMessageV2 sends a structured message to a user.
+	SendMessageV2(_ *context.T, msg Message, _ ...rpc.CallOpt) error
+	// Acknowledge tells the sender of the given messages that they have
+	// reached the given state at the caller.
+	Acknowledge(_ *context.T, ids []string, state ReceiptState, _ ...rpc.CallOpt) error
+	// GetHistory returns up to limit of the most recent messages sent to
+	// the channel after the given time, in display order.  Members may
+	// choose not to share their history.
+	GetHistory(_ *context.T, since time.Time, limit int32, _ ...rpc.CallOpt) ([]HistoryEntry, error)
+	// Ping does nothing.  It is used to check that a member is reachable.
+	Ping(*context.T, ...rpc.CallOpt) error
+	// Version returns the version of the protocol that the member
+	// implements, i.e. its ProtocolVersion.  Members that do not implement
+	// Version implement version 1.
+	Version(*context.T, ...rpc.CallOpt) (int32, error)
+	// GetGroupKey returns a key that messages to the channel are encrypted
+	// with.  It is only granted to members of the channel.
+	GetGroupKey(_ *context.T, req GroupKeyRequest, _ ...rpc.CallOpt) (GroupKeyGrant, error)
+	// SendFile sends a file to a user, who first decides whether to accept
+	// it.  If the file is accepted, the user sends the offset that it
+	// wants the file from, which is past what it already received in an
+	// interrupted transfer of the same file.  The caller then streams the
+	// rest of the file in chunks, and closes its stream once it is done.
+	// The call fails if the file is rejected, or if the file received
+	// does not match the size and hash it was offered with.
+	SendFile(_ *context.T, offer FileOffer, _ ...rpc.CallOpt) (ChatSendFileClientCall, error)
 }
 
 // ChatClientStub adds universal methods to ChatClientMethods.
@@ -43,18 +350,220 @@ func (c implChatClientStub) SendMessage(ctx *context.T, i0 string, opts ...rpc.C
 	return
 }
 
+func (c implChatClientStub) SendMessageV2(ctx *context.T, i0 Message, opts ...rpc.CallOpt) (err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "SendMessageV2", []interface{}{i0}, nil, opts...)
+	return
+}
+
+func (c implChatClientStub) Acknowledge(ctx *context.T, i0 []string, i1 ReceiptState, opts ...rpc.CallOpt) (err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "Acknowledge", []interface{}{i0, i1}, nil, opts...)
+	return
+}
+
+func (c implChatClientStub) GetHistory(ctx *context.T, i0 time.Time, i1 int32, opts ...rpc.CallOpt) (o0 []HistoryEntry, err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "GetHistory", []interface{}{i0, i1}, []interface{}{&o0}, opts...)
+	return
+}
+
+func (c implChatClientStub) Ping(ctx *context.T, opts ...rpc.CallOpt) (err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "Ping", nil, nil, opts...)
+	return
+}
+
+func (c implChatClientStub) Version(ctx *context.T, opts ...rpc.CallOpt) (o0 int32, err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "Version", nil, []interface{}{&o0}, opts...)
+	return
+}
+
+func (c implChatClientStub) GetGroupKey(ctx *context.T, i0 GroupKeyRequest, opts ...rpc.CallOpt) (o0 GroupKeyGrant, err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "GetGroupKey", []interface{}{i0}, []interface{}{&o0}, opts...)
+	return
+}
+
+func (c implChatClientStub) SendFile(ctx *context.T, i0 FileOffer, opts ...rpc.CallOpt) (ocall ChatSendFileClientCall, err error) {
+	var call rpc.ClientCall
+	if call, err = v23.GetClient(ctx).StartCall(ctx, c.name, "SendFile", []interface{}{i0}, opts...); err != nil {
+		return
+	}
+	ocall = &implChatSendFileClientCall{ClientCall: call}
+	return
+}
+
+// ChatSendFileClientStream is the client stream for Chat.SendFile.
+type ChatSendFileClientStream interface {
+	// RecvStream returns the receiver side of the Chat.SendFile client stream.
+	RecvStream() interface {
+		// Advance stages an item so that it may be retrieved via Value.  Returns
+		// true iff there is an item to retrieve.  Advance must be called before
+		// Value is called.  May block if an item is not available.
+		Advance() bool
+		// Value returns the item that was staged by Advance.  May panic if Advance
+		// returned false or was not called.  Never blocks.
+		Value() int64
+		// Err returns any error encountered by Advance.  Never blocks.
+		Err() error
+	}
+	// SendStream returns the send side of the Chat.SendFile client stream.
+	SendStream() interface {
+		// Send places the item onto the output stream.  Returns errors
+		// encountered while sending, or if Send is called after Close or
+		// the stream has been canceled.  Blocks if there is no buffer
+		// space; will unblock when buffer space is available or after
+		// the stream has been canceled.
+		Send(item []byte) error
+		// Close indicates to the server that no more items will be sent;
+		// server Recv calls will receive io.EOF after all sent items.
+		// This is an optional call - e.g. a client might call Close if it
+		// needs to continue receiving items from the server after it's
+		// done sending.  Returns errors encountered while closing, or if
+		// Close is called after the stream has been canceled.  Like Send,
+		// Close blocks when there's no buffer space available.
+		Close() error
+	}
+}
+
+// ChatSendFileClientCall represents the call returned from Chat.SendFile.
+type ChatSendFileClientCall interface {
+	ChatSendFileClientStream
+	// Finish performs the equivalent of SendStream().Close, then blocks until
+	// the server is done, and returns the positional return values for the call.
+	//
+	// Finish returns immediately if the call has been canceled; depending on the
+	// timing the output could either be an error signaling cancelation, or the
+	// valid positional return values from the server.
+	//
+	// Calling Finish is mandatory for releasing stream resources, unless the call
+	// has been canceled or any of the other methods return an error.  Finish should
+	// be called at most once.
+	Finish() error
+}
+
+type implChatSendFileClientCall struct {
+	rpc.ClientCall
+	valRecv int64
+	errRecv error
+}
+
+func (c *implChatSendFileClientCall) RecvStream() interface {
+	Advance() bool
+	Value() int64
+	Err() error
+} {
+	return implChatSendFileClientCallRecv{c}
+}
+
+type implChatSendFileClientCallRecv struct {
+	c *implChatSendFileClientCall
+}
+
+func (c implChatSendFileClientCallRecv) Advance() bool {
+	c.c.errRecv = c.c.Recv(&c.c.valRecv)
+	return c.c.errRecv == nil
+}
+func (c implChatSendFileClientCallRecv) Value() int64 {
+	return c.c.valRecv
+}
+func (c implChatSendFileClientCallRecv) Err() error {
+	if c.c.errRecv == io.EOF {
+		return nil
+	}
+	return c.c.errRecv
+}
+func (c *implChatSendFileClientCall) SendStream() interface {
+	Send(item []byte) error
+	Close() error
+} {
+	return implChatSendFileClientCallSend{c}
+}
+
+type implChatSendFileClientCallSend struct {
+	c *implChatSendFileClientCall
+}
+
+func (c implChatSendFileClientCallSend) Send(item []byte) error {
+	return c.c.Send(item)
+}
+func (c implChatSendFileClientCallSend) Close() error {
+	return c.c.CloseSend()
+}
+func (c *implChatSendFileClientCall) Finish() (err error) {
+	err = c.ClientCall.Finish()
+	return
+}
+
 // ChatServerMethods is the interface a server writer
 // implements for Chat.
 type ChatServerMethods interface {
 	// SendMessage sends a message to a user.
+	//
+	// Deprecated: SendMessage is only kept for compatibility with older
+	// clients.  Use SendMessageV2 instead.
 	SendMessage(_ *context.T, _ rpc.ServerCall, text string) error
+	// SendMessageV2 sends a structured message to a user.
+	SendMessageV2(_ *context.T, _ rpc.ServerCall, msg Message) error
+	// Acknowledge tells the sender of the given messages that they have
+	// reached the given state at the caller.
+	Acknowledge(_ *context.T, _ rpc.ServerCall, ids []string, state ReceiptState) error
+	// GetHistory returns up to limit of the most recent messages sent to
+	// the channel after the given time, in display order.  Members may
+	// choose not to share their history.
+	GetHistory(_ *context.T, _ rpc.ServerCall, since time.Time, limit int32) ([]HistoryEntry, error)
+	// Ping does nothing.  It is used to check that a member is reachable.
+	Ping(*context.T, rpc.ServerCall) error
+	// Version returns the version of the protocol that the member
+	// implements, i.e. its ProtocolVersion.  Members that do not implement
+	// Version implement version 1.
+	Version(*context.T, rpc.ServerCall) (int32, error)
+	// GetGroupKey returns a key that messages to the channel are encrypted
+	// with.  It is only granted to members of the channel.
+	GetGroupKey(_ *context.T, _ rpc.ServerCall, req GroupKeyRequest) (GroupKeyGrant, error)
+	// SendFile sends a file to a user, who first decides whether to accept
+	// it.  If the file is accepted, the user sends the offset that it
+	// wants the file from, which is past what it already received in an
+	// interrupted transfer of the same file.  The caller then streams the
+	// rest of the file in chunks, and closes its stream once it is done.
+	// The call fails if the file is rejected, or if the file received
+	// does not match the size and hash it was offered with.
+	SendFile(_ *context.T, _ ChatSendFileServerCall, offer FileOffer) error
 }
 
 // ChatServerStubMethods is the server interface containing
 // Chat methods, as expected by rpc.Server.
-// There is no difference between this interface and ChatServerMethods
-// since there are no streaming methods.
-type ChatServerStubMethods ChatServerMethods
+// The only difference between this interface and ChatServerMethods
+// is the streaming methods.
+type ChatServerStubMethods interface {
+	// SendMessage sends a message to a user.
+	//
+	// Deprecated: SendMessage is only kept for compatibility with older
+	// clients.  Use SendMessageV2 instead.
+	SendMessage(_ *context.T, _ rpc.ServerCall, text string) error
+	// SendMessageV2 sends a structured message to a user.
+	SendMessageV2(_ *context.T, _ rpc.ServerCall, msg Message) error
+	// Acknowledge tells the sender of the given messages that they have
+	// reached the given state at the caller.
+	Acknowledge(_ *context.T, _ rpc.ServerCall, ids []string, state ReceiptState) error
+	// GetHistory returns up to limit of the most recent messages sent to
+	// the channel after the given time, in display order.  Members may
+	// choose not to share their history.
+	GetHistory(_ *context.T, _ rpc.ServerCall, since time.Time, limit int32) ([]HistoryEntry, error)
+	// Ping does nothing.  It is used to check that a member is reachable.
+	Ping(*context.T, rpc.ServerCall) error
+	// Version returns the version of the protocol that the member
+	// implements, i.e. its ProtocolVersion.  Members that do not implement
+	// Version implement version 1.
+	Version(*context.T, rpc.ServerCall) (int32, error)
+	// GetGroupKey returns a key that messages to the channel are encrypted
+	// with.  It is only granted to members of the channel.
+	GetGroupKey(_ *context.T, _ rpc.ServerCall, req GroupKeyRequest) (GroupKeyGrant, error)
+	// SendFile sends a file to a user, who first decides whether to accept
+	// it.  If the file is accepted, the user sends the offset that it
+	// wants the file from, which is past what it already received in an
+	// interrupted transfer of the same file.  The caller then streams the
+	// rest of the file in chunks, and closes its stream once it is done.
+	// The call fails if the file is rejected, or if the file received
+	// does not match the size and hash it was offered with.
+	SendFile(_ *context.T, _ *ChatSendFileServerCallStub, offer FileOffer) error
+}
 
 // ChatServerStub adds universal methods to ChatServerStubMethods.
 type ChatServerStub interface {
@@ -89,6 +598,34 @@ func (s implChatServerStub) SendMessage(ctx *context.T, call rpc.ServerCall, i0
 	return s.impl.SendMessage(ctx, call, i0)
 }
 
+func (s implChatServerStub) SendMessageV2(ctx *context.T, call rpc.ServerCall, i0 Message) error {
+	return s.impl.SendMessageV2(ctx, call, i0)
+}
+
+func (s implChatServerStub) Acknowledge(ctx *context.T, call rpc.ServerCall, i0 []string, i1 ReceiptState) error {
+	return s.impl.Acknowledge(ctx, call, i0, i1)
+}
+
+func (s implChatServerStub) GetHistory(ctx *context.T, call rpc.ServerCall, i0 time.Time, i1 int32) ([]HistoryEntry, error) {
+	return s.impl.GetHistory(ctx, call, i0, i1)
+}
+
+func (s implChatServerStub) Ping(ctx *context.T, call rpc.ServerCall) error {
+	return s.impl.Ping(ctx, call)
+}
+
+func (s implChatServerStub) Version(ctx *context.T, call rpc.ServerCall) (int32, error) {
+	return s.impl.Version(ctx, call)
+}
+
+func (s implChatServerStub) GetGroupKey(ctx *context.T, call rpc.ServerCall, i0 GroupKeyRequest) (GroupKeyGrant, error) {
+	return s.impl.GetGroupKey(ctx, call, i0)
+}
+
+func (s implChatServerStub) SendFile(ctx *context.T, call *ChatSendFileServerCallStub, i0 FileOffer) error {
+	return s.impl.SendFile(ctx, call, i0)
+}
+
 func (s implChatServerStub) Globber() *rpc.GlobState {
 	return s.gs
 }
@@ -107,10 +644,149 @@ var descChat = rpc.InterfaceDesc{
 	Methods: []rpc.MethodDesc{
 		{
 			Name: "SendMessage",
-			Doc:  "// SendMessage sends a message to a user.",
+			Doc:  "// SendMessage sends a message to a user.\n//\n// Deprecated: SendMessage is only kept for compatibility with older\n// clients.  Use SendMessageV2 instead.",
 			InArgs: []rpc.ArgDesc{
 				{"text", ``}, // string
 			},
 		},
+		{
+			Name: "SendMessageV2",
+			Doc:  "// SendMessageV2 sends a structured message to a user.",
+			InArgs: []rpc.ArgDesc{
+				{"msg", ``}, // Message
+			},
+		},
+		{
+			Name: "Acknowledge",
+			Doc:  "// Acknowledge tells the sender of the given messages that they have\n// reached the given state at the caller.",
+			InArgs: []rpc.ArgDesc{
+				{"ids", ``},   // []string
+				{"state", ``}, // ReceiptState
+			},
+		},
+		{
+			Name: "GetHistory",
+			Doc:  "// GetHistory returns up to limit of the most recent messages sent to\n// the channel after the given time, in display order.  Members may\n// choose not to share their history.",
+			InArgs: []rpc.ArgDesc{
+				{"since", ``}, // time.Time
+				{"limit", ``}, // int32
+			},
+			OutArgs: []rpc.ArgDesc{
+				{"", ``}, // []HistoryEntry
+			},
+		},
+		{
+			Name: "Ping",
+			Doc:  "// Ping does nothing.  It is used to check that a member is reachable.",
+		},
+		{
+			Name: "Version",
+			Doc:  "// Version returns the version of the protocol that the member\n// implements, i.e. its ProtocolVersion.  Members that do not implement\n// Version implement version 1.",
+			OutArgs: []rpc.ArgDesc{
+				{"", ``}, // int32
+			},
+		},
+		{
+			Name: "GetGroupKey",
+			Doc:  "// GetGroupKey returns a key that messages to the channel are encrypted\n// with.  It is only granted to members of the channel.",
+			InArgs: []rpc.ArgDesc{
+				{"req", ``}, // GroupKeyRequest
+			},
+			OutArgs: []rpc.ArgDesc{
+				{"", ``}, // GroupKeyGrant
+			},
+		},
+		{
+			Name: "SendFile",
+			Doc:  "// SendFile sends a file to a user, who first decides whether to accept\n// it.  If the file is accepted, the user sends the offset that it\n// wants the file from, which is past what it already received in an\n// interrupted transfer of the same file.  The caller then streams the\n// rest of the file in chunks, and closes its stream once it is done.\n// The call fails if the file is rejected, or if the file received\n// does not match the size and hash it was offered with.",
+			InArgs: []rpc.ArgDesc{
+				{"offer", ``}, // FileOffer
+			},
+		},
 	},
 }
+
+// ChatSendFileServerStream is the server stream for Chat.SendFile.
+type ChatSendFileServerStream interface {
+	// RecvStream returns the receiver side of the Chat.SendFile server stream.
+	RecvStream() interface {
+		// Advance stages an item so that it may be retrieved via Value.  Returns
+		// true iff there is an item to retrieve.  Advance must be called before
+		// Value is called.  May block if an item is not available.
+		Advance() bool
+		// Value returns the item that was staged by Advance.  May panic if Advance
+		// returned false or was not called.  Never blocks.
+		Value() []byte
+		// Err returns any error encountered by Advance.  Never blocks.
+		Err() error
+	}
+	// SendStream returns the send side of the Chat.SendFile server stream.
+	SendStream() interface {
+		// Send places the item onto the output stream.  Returns errors encountered
+		// while sending.  Blocks if there is no buffer space; will unblock when
+		// buffer space is available.
+		Send(item int64) error
+	}
+}
+
+// ChatSendFileServerCall represents the context passed to Chat.SendFile.
+type ChatSendFileServerCall interface {
+	rpc.ServerCall
+	ChatSendFileServerStream
+}
+
+// ChatSendFileServerCallStub is a wrapper that converts rpc.StreamServerCall into
+// a typesafe stub that implements ChatSendFileServerCall.
+type ChatSendFileServerCallStub struct {
+	rpc.StreamServerCall
+	valRecv []byte
+	errRecv error
+}
+
+// Init initializes ChatSendFileServerCallStub from rpc.StreamServerCall.
+func (s *ChatSendFileServerCallStub) Init(call rpc.StreamServerCall) {
+	s.StreamServerCall = call
+}
+
+// RecvStream returns the receiver side of the Chat.SendFile server stream.
+func (s *ChatSendFileServerCallStub) RecvStream() interface {
+	Advance() bool
+	Value() []byte
+	Err() error
+} {
+	return implChatSendFileServerCallRecv{s}
+}
+
+type implChatSendFileServerCallRecv struct {
+	s *ChatSendFileServerCallStub
+}
+
+func (s implChatSendFileServerCallRecv) Advance() bool {
+	s.s.valRecv = nil
+	s.s.errRecv = s.s.Recv(&s.s.valRecv)
+	return s.s.errRecv == nil
+}
+func (s implChatSendFileServerCallRecv) Value() []byte {
+	return s.s.valRecv
+}
+func (s implChatSendFileServerCallRecv) Err() error {
+	if s.s.errRecv == io.EOF {
+		return nil
+	}
+	return s.s.errRecv
+}
+
+// SendStream returns the send side of the Chat.SendFile server stream.
+func (s *ChatSendFileServerCallStub) SendStream() interface {
+	Send(item int64) error
+} {
+	return implChatSendFileServerCallSend{s}
+}
+
+type implChatSendFileServerCallSend struct {
+	s *ChatSendFileServerCallStub
+}
+
+func (s implChatSendFileServerCallSend) Send(item int64) error {
+	return s.s.Send(item)
+}